@@ -0,0 +1,54 @@
+package dockertrace
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/alexflint/go-arg"
+	"github.com/nathants/docker-trace/lib"
+)
+
+func init() {
+	lib.Commands["gc"] = gc
+	lib.Args["gc"] = gcArgs{}
+}
+
+type gcArgs struct {
+	MinAge  string `arg:"-a,--min-age" default:"1h" help:"only remove workspaces at least this old, like 30m or 24h"`
+	MinSize int64  `arg:"-s,--min-size" default:"0" help:"only remove workspaces at least this many bytes"`
+	List    bool   `arg:"-l,--list" help:"list every workspace and remove nothing"`
+	DryRun  bool   `arg:"-n,--dry-run" help:"print the workspaces that would be removed"`
+}
+
+func (gcArgs) Description() string {
+	return "\nremove stale temp files from the data dir\n"
+}
+
+func gc() {
+	var args gcArgs
+	arg.MustParse(&args)
+	minAge, err := time.ParseDuration(args.MinAge)
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+	//
+	fmt.Fprintln(os.Stderr, "path\tage-seconds\tsize-bytes\tlive")
+	if args.List {
+		workspaces, err := lib.Workspaces()
+		if err != nil {
+			lib.Logger.Fatal("error: ", err)
+		}
+		for _, ws := range workspaces {
+			fmt.Printf("%s\t%d\t%d\t%t\n", ws.Path, int(ws.Age.Seconds()), ws.Size, ws.Live)
+		}
+		return
+	}
+	removed, err := lib.WorkspacesGC(minAge, args.MinSize, args.DryRun)
+	for _, ws := range removed {
+		fmt.Printf("%s\t%d\t%d\t%t\n", ws.Path, int(ws.Age.Seconds()), ws.Size, ws.Live)
+	}
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+}
@@ -1,21 +1,18 @@
 package dockertrace
 
 import (
-	"archive/tar"
-	"bufio"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path"
-	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/alexflint/go-arg"
-	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
-	"github.com/gofrs/uuid"
 	"github.com/nathants/docker-trace/lib"
 )
 
@@ -25,380 +22,285 @@ func init() {
 }
 
 type minifyArgs struct {
-	ContainerIn  string `arg:"positional,required"`
-	ContainerOut string `arg:"positional,required"`
+	ContainerIn        string   `arg:"positional,required"`
+	ContainerOut       string   `arg:"positional,required"`
+	Trace              []string `arg:"-t,--trace,separate" help:"read paths from this file instead of stdin, may be raw files output, ndjson events or a plain path list"`
+	Profile            []string `arg:"-p,--profile,separate" help:"keep files matching this rule profile, a built-in name, a yaml file, or a name in ~/.docker-trace/profiles/. replaces the defaults: root-links, ld-so, shells"`
+	Flatten            bool     `arg:"-f,--flatten" help:"write a single layer with each path once, directories before their contents"`
+	PreserveLayers     bool     `arg:"-l,--preserve-layers" help:"write one output layer per input layer that still has files"`
+	OCI                string   `arg:"--oci" help:"write an oci image layout to this directory instead of loading into docker"`
+	OCIArchive         string   `arg:"--oci-archive" help:"write an oci image layout tarball to this file instead of loading into docker, loadable with docker load"`
+	SetEnv             []string `arg:"--set-env,separate" help:"set KEY=VALUE in the env of the output image"`
+	DropEnv            []string `arg:"--drop-env,separate" help:"remove KEY from the env of the output image"`
+	SetLabel           []string `arg:"--set-label,separate" help:"set KEY=VALUE in the labels of the output image"`
+	DropLabel          []string `arg:"--drop-label,separate" help:"remove labels matching this glob from the output image"`
+	VerifyCmd          string   `arg:"--verify-cmd" help:"after loading, run this shell command against the input and output images and compare exit status, DOCKER_TRACE_CONTAINER is set to the container id"`
+	VerifyHTTP         string   `arg:"--verify-http" help:"after loading, request this url from the input and output images and compare http status"`
+	VerifyRunArg       []string `arg:"--verify-run-arg,separate" help:"a docker run arg used to start the images for verification, passed through unchanged, repeat it like --verify-run-arg=--network --verify-run-arg=host"`
+	VerifyTimeout      int      `arg:"--verify-timeout" default:"30" help:"seconds to wait for the verification probe to pass"`
+	DryRun             bool     `arg:"-n,--dry-run" help:"print a report of what would be kept and removed instead of building the output"`
+	DryRunTop          int      `arg:"--dry-run-top" default:"20" help:"number of largest removed files in the dry run report"`
+	JSON               bool     `arg:"--json" help:"print the dry run report as json"`
+	HardLinks          string   `arg:"--hardlinks" default:"include" help:"include: keep the targets of kept hard links, copy: write hard links whose target is not kept as regular files"`
+	Iterate            int      `arg:"--iterate" help:"after loading, trace the verification workload against the output image and add files it failed to find, for up to this many rounds"`
+	BpfRingBufferPages int      `arg:"--rb-pages" default:"65536" help:"bpftrace ring buffer pages used by --iterate"`
+	Platform           []string `arg:"--platform,separate" help:"minify this platform of a multi platform image, like linux/arm64. repeat it, or use all, to write a multi platform image"`
+	PlatformTrace      []string `arg:"--platform-trace,separate" help:"PLATFORM=FILE, read paths for one platform from this file, in addition to the traces shared by every platform"`
+	Provenance         string   `arg:"--provenance" help:"write the in-toto provenance statement to this file, defaults to next to the oci output or ~/.docker-trace/provenance/<digest>.json"`
+	NoProvenance       bool     `arg:"--no-provenance" help:"do not stamp provenance labels and annotations or write a provenance statement"`
+	KeepWholePackages  bool     `arg:"--keep-whole-packages" help:"keep every file of dpkg, apk and rpm packages which would be partially kept"`
+	KeepPackageDB      bool     `arg:"--keep-package-db" help:"keep the dpkg and apk databases, rewritten to list only the packages and files that remain"`
+	TraceAnyContainer  bool     `arg:"--trace-any-container" help:"keep traced paths of every container, for inputs not in docker when docker is not running to match containers to the image"`
 }
 
 func (minifyArgs) Description() string {
-	return "\nminify a container keeping files passed on stdin\n"
+	return "\nminify a container keeping files passed on stdin or via --trace\n"
 }
 
 func minify() {
 	var args minifyArgs
 	arg.MustParse(&args)
-	//
-	lib.Logger.Println("start minification", args.ContainerIn, "=>", args.ContainerOut)
-	ctx := context.Background()
-	uid := uuid.Must(uuid.NewV4()).String()
-	//
-	cli, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+	if args.Flatten && args.PreserveLayers {
+		lib.Logger.Fatal("error: --flatten and --preserve-layers cannot be used together")
 	}
-	//
-	lib.Logger.Println("created docker client")
-	//
-	r, err := cli.ImageSave(ctx, []string{args.ContainerIn})
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+	verify := args.VerifyCmd != "" || args.VerifyHTTP != ""
+	if args.VerifyCmd != "" && args.VerifyHTTP != "" {
+		lib.Logger.Fatal("error: --verify-cmd and --verify-http cannot be used together")
 	}
-	w, err := os.OpenFile(lib.DataDir()+"/in.tar."+uid, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+	if args.HardLinks != "include" && args.HardLinks != "copy" {
+		lib.Logger.Fatal("error: --hardlinks must be include or copy")
 	}
-	_, err = io.Copy(w, r)
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+	if args.JSON && !args.DryRun {
+		lib.Logger.Fatal("error: --json is only used with --dry-run")
 	}
-	err = w.Close()
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+	if args.DryRun && verify {
+		lib.Logger.Fatal("error: --dry-run does not build an image to verify or iterate on")
 	}
-	lib.Logger.Println("saved input container to disk")
-	//
-	files, layers, err := lib.Scan(ctx, args.ContainerIn, lib.DataDir()+"/in.tar."+uid, false)
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+	if args.Iterate > 0 && !verify {
+		lib.Logger.Fatal("error: --iterate needs a workload from --verify-cmd or --verify-http")
+	}
+	if verify && (args.OCI != "" || args.OCIArchive != "" || !lib.IsDockerRef(args.ContainerOut)) {
+		lib.Logger.Fatal("error: verification needs the output loaded into docker, it cannot be used with --oci, --oci-archive or a registry output")
+	}
+	if verify && !lib.IsDockerRef(args.ContainerIn) {
+		lib.Logger.Fatal("error: verification needs the input image in docker")
+	}
+	if strings.HasPrefix(args.ContainerOut, lib.RefOCI) {
+		lib.Logger.Fatal("error: use --oci to write an oci image layout")
 	}
-	lib.Logger.Println("scanned container")
 	//
-	includePaths := map[string]interface{}{}
-	bytes, err := io.ReadAll(os.Stdin)
+	lib.Logger.Println("start minification", args.ContainerIn, "=>", args.ContainerOut)
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
 		lib.Logger.Fatal("error: ", err)
 	}
-	for _, path := range strings.Split(string(bytes), "\n") {
-		path = strings.Trim(path, " ")
-		path = filepath.Clean(path)
-		path = strings.ReplaceAll(path, "/./", "/")
-		if path != "" {
-			includePaths[path] = nil
-		}
-	}
-	lib.Logger.Println("included paths:", len(includePaths))
 	//
-	includeFiles := make(map[string]*lib.ScanFile)
-	var last *lib.ScanFile
-	links := make(map[string]string)
-	for _, f := range files {
-		if f.LinkTarget != "" {
-			links[f.Path] = f.LinkTarget
-		}
-	}
+	lib.Logger.Println("created docker client")
 	//
-	// recursively resolve all links
-	for p := range includePaths {
-		last := ""
-		for {
-			if last == p {
-				break // break when no further change
-			}
-			last = p
-			parts := strings.Split(strings.TrimLeft(p, "/"), "/")
-			for i := 0; i <= len(parts); i++ {
-				subPath := "/" + path.Join(parts[:i]...)
-				link, ok := links[subPath]
-				if ok {
-					if link[:1] != "/" {
-						link = path.Join(path.Dir(subPath), link)
-					}
-					includePaths[subPath] = nil
-					includePaths[link] = nil
-					for j := range parts[:i] {
-						parts[j] = ""
-					}
-					parts[0] = link
-				}
-			}
-			p2 := path.Join(parts...)
-			includePaths[p2] = nil
-			p = p2
-		}
+	source := lib.ImageSource{Image: args.ContainerIn}
+	platforms, err := lib.MinifyPlatforms(ctx, source, args.Platform)
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
 	}
-	lib.Logger.Println("recursively resolved links")
-	//
-	for _, f := range files {
-		f.Path = strings.ReplaceAll(f.Path, "/./", "/")
-		_, ok := includePaths[strings.TrimRight(f.Path, "/")]
+	events, traces := minifyTraces(args.Trace, len(args.Trace) == 0 && len(args.PlatformTrace) == 0)
+	platformEvents := make(map[string][]lib.TraceEvent)
+	for _, platformTrace := range args.PlatformTrace {
+		platform, trace, ok := strings.Cut(platformTrace, "=")
 		if !ok {
-			// sometimes files must always be included, here are some hard coded special cases
-			atRoot := len(strings.Split(f.Path, "/")) == 2 && f.LinkTarget != ""
-			ldSo := strings.Contains(f.Path, "/lib") && strings.HasPrefix(path.Base(f.Path), "ld-") && strings.Contains(f.Path, ".so")
-			name := path.Base(f.Path)
-			isShell := (name == "bash" || name == "sh" || name == "env") && strings.Contains(f.Path, "/bin/")
-			if !(atRoot || ldSo || isShell) {
+			lib.Logger.Fatal("error: --platform-trace must look like PLATFORM=FILE, got: ", platformTrace)
+		}
+		found := false
+		for _, p := range platforms {
+			if p == "" {
 				continue
 			}
-			includePaths[f.Path] = nil
+			parsed, err := lib.ParsePlatform(p)
+			if err != nil {
+				lib.Logger.Fatal("error: ", err)
+			}
+			found = found || lib.PlatformMatch(parsed, platform)
 		}
-		if last != nil && f.Path != last.Path {
-			includeFiles[last.Path] = last
+		if !found {
+			lib.Logger.Fatal("error: --platform-trace for a platform that is not being minified: ", platform)
 		}
-		last = f
+		traceEvents, traceDigests := minifyTraces([]string{trace}, false)
+		platformEvents[platform] = append(platformEvents[platform], traceEvents...)
+		traces = append(traces, traceDigests...)
 	}
-	includeFiles[last.Path] = last
-	lib.Logger.Println("update include paths for ld-*.so and symlinks at root")
-	//
-	r, err = os.Open(lib.DataDir() + "/in.tar." + uid)
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+	if len(args.Profile) == 0 {
+		args.Profile = lib.DefaultProfiles
+	}
+	var profiles []*lib.Profile
+	for _, name := range args.Profile {
+		profile, err := lib.LoadProfile(name)
+		if err != nil {
+			lib.Logger.Fatal("error: ", err)
+		}
+		profiles = append(profiles, profile)
 	}
-	tr := tar.NewReader(r)
 	//
-	w, err = os.OpenFile(lib.DataDir()+"/out.tar."+uid, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+	opts := lib.MinifyOptions{
+		Source: source,
+		Keeper: &lib.TraceKeeper{
+			Events:         events,
+			PlatformEvents: platformEvents,
+			Profiles:       profiles,
+			Client:         cli,
+			Image:          args.ContainerIn,
+			AnyContainer:   args.TraceAnyContainer,
+		},
+		Ref:               args.ContainerOut,
+		OCIDir:            args.OCI,
+		Platforms:         platforms,
+		Flatten:           args.Flatten,
+		PreserveLayers:    args.PreserveLayers,
+		HardLinksCopy:     args.HardLinks == "copy",
+		KeepWholePackages: args.KeepWholePackages,
+		KeepPackageDB:     args.KeepPackageDB,
+		Config: lib.ConfigOverrides{
+			SetEnv:    args.SetEnv,
+			DropEnv:   args.DropEnv,
+			SetLabel:  args.SetLabel,
+			DropLabel: args.DropLabel,
+		},
+		NoProvenance:       args.NoProvenance,
+		Traces:             traces,
+		Profiles:           args.Profile,
+		DryRun:             args.DryRun,
+		DryRunTop:          args.DryRunTop,
+		Iterate:            args.Iterate,
+		BpfRingBufferPages: args.BpfRingBufferPages,
 	}
-	tw := tar.NewWriter(w)
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
+	switch {
+	case !lib.IsDockerRef(args.ContainerOut):
+		ref, err := lib.ParseRegistryRef(args.ContainerOut)
 		if err != nil {
 			lib.Logger.Fatal("error: ", err)
 		}
-		if header == nil {
-			continue
-		}
-		switch header.Typeflag {
-		case tar.TypeReg:
-			if path.Base(header.Name) == "layer.tar" {
-				minifyLayer(header.Name, tr, tw, layers, includeFiles)
-				lib.Logger.Println("minified layer", header.Name)
-			}
-		}
-	}
-	err = tw.Close()
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+		opts.Ref = ref.Name()
+		opts.Sinks = append(opts.Sinks, &lib.RegistrySink{Name: args.ContainerOut})
+	case args.OCI == "" && args.OCIArchive == "":
+		opts.Sinks = append(opts.Sinks, &lib.DockerSink{Client: cli, Name: args.ContainerOut})
 	}
-	err = w.Close()
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+	if args.OCIArchive != "" {
+		opts.Sinks = append(opts.Sinks, &lib.OCIArchiveSink{File: args.OCIArchive})
 	}
-	lib.Logger.Println("finished writing out.tar")
-	//
-	f, err := os.OpenFile(lib.DataDir()+"/Dockerfile."+uid, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+	if verify {
+		opts.Verify = &lib.VerifyOptions{
+			RunArgs: args.VerifyRunArg,
+			Cmd:     args.VerifyCmd,
+			HTTP:    args.VerifyHTTP,
+			Timeout: time.Duration(args.VerifyTimeout) * time.Second,
+		}
 	}
-	lines, err := lib.Dockerfile(ctx, args.ContainerIn, lib.DataDir()+"/in.tar."+uid)
+	result, err := lib.Minify(ctx, opts)
 	if err != nil {
 		lib.Logger.Fatal("error: ", err)
 	}
-	lib.Logger.Println("read original dockerfile")
 	//
-	_, err = f.WriteString("FROM scratch\n")
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
-	}
-	_, err = f.WriteString(fmt.Sprintf("ADD %s/out.tar.%s /\n", lib.DataDir(), uid))
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+	if args.DryRun {
+		minifyDryRun(args, result)
+		return
 	}
-	for _, line := range lines {
-		_, err := f.WriteString(line + "\n")
-		if err != nil {
-			lib.Logger.Fatal("error: ", err)
+	for _, platform := range result.Platforms {
+		diff, ok := result.PlatformDiffs[platform]
+		if ok {
+			fmt.Fprintf(os.Stderr, "platform\t%s\n\n", platform)
+			diff.Write(os.Stderr)
+			fmt.Fprintln(os.Stderr)
 		}
 	}
-	err = f.Close()
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+	if result.Provenance != nil {
+		minifyProvenance(args, *result.Provenance)
 	}
-	lib.Logger.Println("created new dockerfile")
-	//
-	prContext, pwContext := io.Pipe()
-	go func() {
-		// defer func() {}()
-		tw = tar.NewWriter(pwContext)
-		//
-		fi, err := os.Stat(lib.DataDir() + "/out.tar." + uid)
-		if err != nil {
-			lib.Logger.Fatal("error: ", err)
-		}
-		header, err := tar.FileInfoHeader(fi, "")
-		header.Name = lib.DataDir() + "/out.tar." + uid
-		if err != nil {
-			lib.Logger.Fatal("error: ", err)
-		}
-		err = tw.WriteHeader(header)
-		if err != nil {
-			lib.Logger.Fatal("error: ", err)
-		}
-		err = r.Close()
-		if err != nil {
-			lib.Logger.Fatal("error: ", err)
-		}
-		r, err = os.Open(lib.DataDir() + "/out.tar." + uid)
-		if err != nil {
-			lib.Logger.Fatal("error: ", err)
-		}
-		_, err = io.Copy(tw, r)
-		if err != nil {
-			lib.Logger.Fatal("error: ", err)
-		}
-		//
-		fi, err = os.Stat(lib.DataDir() + "/Dockerfile." + uid)
-		if err != nil {
-			lib.Logger.Fatal("error: ", err)
-		}
-		header, err = tar.FileInfoHeader(fi, "")
-		header.Name = lib.DataDir() + "/Dockerfile." + uid
-		if err != nil {
-			lib.Logger.Fatal("error: ", err)
-		}
-		err = tw.WriteHeader(header)
-		if err != nil {
-			lib.Logger.Fatal("error: ", err)
-		}
-		err = r.Close()
-		if err != nil {
-			lib.Logger.Fatal("error: ", err)
-		}
-		r, err = os.Open(lib.DataDir() + "/Dockerfile." + uid)
-		if err != nil {
-			lib.Logger.Fatal("error: ", err)
-		}
-		_, err = io.Copy(tw, r)
+	lib.Logger.Println("minification complete")
+}
+
+// minifyDryRun prints the report of each platform, or a json report, or a json map of platform to
+// report for multi platform images
+func minifyDryRun(args minifyArgs, result *lib.MinifyResult) {
+	if args.JSON {
+		var value interface{} = result.Reports
+		if len(result.Platforms) == 1 {
+			value = result.Reports[result.Platforms[0]]
+		}
+		err := json.NewEncoder(os.Stdout).Encode(value)
 		if err != nil {
 			lib.Logger.Fatal("error: ", err)
 		}
-		//
-		err = tw.Close()
-		if err != nil {
-			lib.Logger.Fatal("error: ", err)
+		return
+	}
+	if len(result.Platforms) == 1 {
+		result.Reports[result.Platforms[0]].Write(os.Stdout)
+		return
+	}
+	for i, platform := range result.Platforms {
+		if i > 0 {
+			fmt.Println()
 		}
-		err = pwContext.Close()
+		fmt.Printf("platform\t%s\n\n", platform)
+		result.Reports[platform].Write(os.Stdout)
+	}
+}
+
+// minifyTraces reads trace events from files, or from stdin when asked, returning the digest of each
+// trace for provenance
+func minifyTraces(traces []string, stdin bool) ([]lib.TraceEvent, []lib.ProvenanceTrace) {
+	var events []lib.TraceEvent
+	var digests []lib.ProvenanceTrace
+	read := func(name string, r io.Reader) {
+		hash := sha256.New()
+		traceEvents, err := lib.ParseTrace(io.TeeReader(r, hash))
 		if err != nil {
 			lib.Logger.Fatal("error: ", err)
 		}
-		//
-		err = r.Close()
+		_, _ = io.Copy(hash, r)
+		events = append(events, traceEvents...)
+		digests = append(digests, lib.ProvenanceTrace{Path: name, SHA256: fmt.Sprintf("sha256:%x", hash.Sum(nil))})
+	}
+	if stdin {
+		read("-", os.Stdin)
+	}
+	for _, trace := range traces {
+		f, err := os.Open(trace)
 		if err != nil {
 			lib.Logger.Fatal("error: ", err)
 		}
-		lib.Logger.Println("finished writing context")
-	}()
-	//
-	out, err := cli.ImageBuild(ctx, prContext, types.ImageBuildOptions{
-		NoCache:    true,
-		Tags:       []string{args.ContainerOut},
-		Dockerfile: lib.DataDir() + "/Dockerfile." + uid,
-		Remove:     true,
-	})
-	defer func() { _ = out.Body.Close() }()
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
-	}
-	//
-	scanner := bufio.NewScanner(out.Body)
-	val := make(map[string]string)
-	for scanner.Scan() {
-		err := json.Unmarshal(scanner.Bytes(), &val)
-		if err == nil {
-			lib.Logger.Println(strings.Trim(val["stream"], "\n"))
-		}
+		read(trace, f)
+		_ = f.Close()
 	}
-	err = scanner.Err()
+	return events, digests
+}
+
+// minifyProvenance writes the in-toto provenance statement of the output images to --provenance, next
+// to the oci output, or into the data dir named by digest
+func minifyProvenance(args minifyArgs, statement lib.ProvenanceStatement) {
+	data, err := statement.Marshal()
 	if err != nil {
 		lib.Logger.Fatal("error: ", err)
 	}
-	if val["stream"] != "Successfully tagged "+args.ContainerOut+"\n" {
-		lib.Logger.Fatal("error: failed to build " + args.ContainerOut)
-	}
-	lib.Logger.Println("built minified image")
-	//
-	err = os.Remove(lib.DataDir() + "/in.tar." + uid)
-	if err != nil {
-		lib.Logger.Fatal("error: ", err)
+	file := args.Provenance
+	switch {
+	case file != "":
+	case args.OCI != "":
+		file = path.Join(args.OCI, "provenance.json")
+	case args.OCIArchive != "":
+		file = args.OCIArchive + ".provenance.json"
+	default:
+		dataDir, err := lib.DataDir()
+		if err != nil {
+			lib.Logger.Fatal("error: ", err)
+		}
+		file = path.Join(dataDir, "provenance", fmt.Sprintf("%x.json", sha256.Sum256(data)))
 	}
-	err = os.Remove(lib.DataDir() + "/out.tar." + uid)
+	err = os.MkdirAll(path.Dir(file), os.ModePerm)
 	if err != nil {
 		lib.Logger.Fatal("error: ", err)
 	}
-	err = os.Remove(lib.DataDir() + "/Dockerfile." + uid)
+	err = os.WriteFile(file, data, 0644)
 	if err != nil {
 		lib.Logger.Fatal("error: ", err)
 	}
-	lib.Logger.Println("minification complete")
-}
-
-func minifyLayer(layer string, r io.Reader, tw *tar.Writer, layers map[string]int, includeFiles map[string]*lib.ScanFile) {
-	layerIndex, ok := layers[layer]
-	if !ok {
-		panic(layer)
-	}
-	tr := tar.NewReader(r)
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			lib.Logger.Fatal("error: ", err)
-		}
-		if header == nil {
-			continue
-		}
-		pth := strings.ReplaceAll("/"+header.Name, "/./", "/")
-		includeFile, ok := includeFiles[pth]
-		if !ok {
-			continue
-		}
-		if includeFile.LayerIndex != layerIndex {
-			continue
-		}
-		switch header.Typeflag {
-		case tar.TypeReg:
-			err := tw.WriteHeader(header)
-			if err != nil {
-				lib.Logger.Fatal("error: ", err)
-			}
-			_, err = io.Copy(tw, tr)
-			if err != nil {
-				lib.Logger.Fatal("error: ", err)
-			}
-		case tar.TypeSymlink:
-			err := tw.WriteHeader(header)
-			if err != nil {
-				lib.Logger.Fatal("error: ", err)
-			}
-			_, err = io.Copy(tw, tr)
-			if err != nil {
-				lib.Logger.Fatal("error: ", err)
-			}
-		case tar.TypeDir:
-			err := tw.WriteHeader(header)
-			if err != nil {
-				lib.Logger.Fatal("error: ", err)
-			}
-			_, err = io.Copy(tw, tr)
-			if err != nil {
-				lib.Logger.Fatal("error: ", err)
-			}
-		case tar.TypeLink:
-			err := tw.WriteHeader(header)
-			if err != nil {
-				lib.Logger.Fatal("error: ", err)
-			}
-			_, err = io.Copy(tw, tr)
-			if err != nil {
-				lib.Logger.Fatal("error: ", err)
-			}
-		default:
-			panic(fmt.Sprintf("unknown tar type: %v", header.Typeflag))
-		}
-	}
+	lib.Logger.Println("wrote provenance", file)
 }
@@ -0,0 +1,24 @@
+package dockertrace
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/alexflint/go-arg"
+)
+
+func TestMinifyArgsVerifyRunArg(t *testing.T) {
+	var args minifyArgs
+	p, err := arg.NewParser(arg.Config{}, &args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Parse([]string{"web:latest", "web:minified", "--verify-run-arg=--network", "--verify-run-arg=host", "--verify-run-arg=-e", "--verify-run-arg=A=b c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"--network", "host", "-e", "A=b c"}
+	if !reflect.DeepEqual(args.VerifyRunArg, expected) {
+		t.Fatal("bad run args", args.VerifyRunArg)
+	}
+}
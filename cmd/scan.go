@@ -1,9 +1,9 @@
 package dockertrace
 
 import (
+	"bufio"
 	"context"
 	"fmt"
-	"io/fs"
 	"os"
 	"strings"
 
@@ -17,49 +17,58 @@ func init() {
 }
 
 type scanArgs struct {
-	Name string `arg:"positional,required"`
+	Name      string `arg:"positional,required"`
+	Format    string `arg:"-f,--format" default:"table" help:"table, json, ndjson, csv or tree"`
+	Fields    string `arg:"--fields" help:"comma separated fields to print: path,layer,size,mode,link-target,sha256,content-type,mode-symbolic,mode-octal,mtime,uid,gid,status. defaults to the first seven for table, only names for tree, and all for other formats"`
+	AllLayers bool   `arg:"-a,--all-layers" help:"list every copy of every path in every layer, with status kept, overwritten, deleted, shadowed, whiteout or opaque"`
 }
 
 func (scanArgs) Description() string {
 	return "\nscan a container and list filesystem contents\n"
 }
 
-func valueOrDash(x interface{}) string {
-	y := fmt.Sprint(x)
-	if y == "" {
-		return "-"
-	}
-	return y
-}
-
 func scan() {
 	var args scanArgs
-	arg.MustParse(&args)
+	p := arg.MustParse(&args)
+	if !lib.Contains(lib.ScanFormats, args.Format) {
+		p.Fail("--format must be one of: " + strings.Join(lib.ScanFormats, ","))
+	}
+	fields, err := lib.ParseScanFields(args.Fields, args.Format, args.AllLayers)
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
 	ctx := context.Background()
-	files, _, err := lib.Scan(ctx, args.Name, "", true)
+	var files []*lib.ScanFile
+	if args.AllLayers {
+		files, err = lib.ScanAllLayers(ctx, args.Name, "", true)
+	} else {
+		files, _, err = lib.Scan(ctx, args.Name, "", true)
+	}
 	if err != nil {
 		lib.Logger.Fatal("error: ", err)
 	}
-	header := []string{
-		"path",
-		"layer",
-		"size",
-		"mode",
-		"link-target",
-		"sha256",
-		"content-type",
+	if args.Format == lib.ScanFormatTable {
+		fmt.Fprintln(os.Stderr, strings.Join(fields, "\t"))
+	}
+	w := bufio.NewWriter(os.Stdout)
+	err = lib.ScanWrite(w, files, args.Format, fields)
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+	err = w.Flush()
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
 	}
-	fmt.Fprintln(os.Stderr, strings.Join(header, "\t"))
-	for _, file := range files {
-		vals := []string{
-			valueOrDash(file.Path),
-			valueOrDash(file.LayerIndex),
-			valueOrDash(file.Size),
-			valueOrDash(fs.FileMode(file.Mode).String()),
-			valueOrDash(file.LinkTarget),
-			valueOrDash(file.Hash),
-			valueOrDash(file.ContentType),
+	// copies not in the final filesystem still take space in their layers
+	if args.AllLayers {
+		count := 0
+		var size int64
+		for _, f := range files {
+			if f.Status != lib.ScanKept {
+				count++
+				size += f.Size
+			}
 		}
-		fmt.Println(strings.Join(vals, "\t"))
+		lib.Logger.Println("wasted bytes:", size, "in copies not kept:", count)
 	}
 }
@@ -0,0 +1,122 @@
+package dockertrace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/alexflint/go-arg"
+	"github.com/docker/docker/client"
+	"github.com/nathants/docker-trace/lib"
+)
+
+func init() {
+	lib.Commands["traces"] = traces
+	lib.Args["traces"] = tracesArgs{}
+}
+
+type tracesOpArgs struct {
+	Traces   []string `arg:"positional,required" help:"trace files, raw files output, ndjson events or plain path lists, - reads stdin"`
+	Image    string   `arg:"-i,--image" help:"compare paths after resolving symlinks in this image, and drop traces of containers from other images when it is in docker"`
+	Platform string   `arg:"--platform" help:"the platform of a multi platform --image, like linux/arm64"`
+	NDJSON   bool     `arg:"--ndjson" help:"print a json object per path with the runs that touched it, instead of a path list"`
+}
+
+type tracesArgs struct {
+	Union     *tracesOpArgs `arg:"subcommand:union" help:"paths touched by any run"`
+	Intersect *tracesOpArgs `arg:"subcommand:intersect" help:"paths touched by every run"`
+	Diff      *tracesOpArgs `arg:"subcommand:diff" help:"paths touched by the first run and no other"`
+}
+
+func (tracesArgs) Description() string {
+	return "\nunion, intersect or diff traces and keep-lists of several runs\n"
+}
+
+func traces() {
+	var args tracesArgs
+	p := arg.MustParse(&args)
+	var op string
+	var opArgs *tracesOpArgs
+	switch {
+	case args.Union != nil:
+		op, opArgs = lib.TracesUnion, args.Union
+	case args.Intersect != nil:
+		op, opArgs = lib.TracesIntersect, args.Intersect
+	case args.Diff != nil:
+		op, opArgs = lib.TracesDiff, args.Diff
+	default:
+		p.Fail("missing subcommand: union, intersect or diff")
+	}
+	ctx := context.Background()
+	//
+	var runs []lib.TraceRun
+	for _, name := range opArgs.Traces {
+		f := os.Stdin
+		if name != "-" {
+			var err error
+			f, err = os.Open(name)
+			if err != nil {
+				lib.Logger.Fatal("error: ", err)
+			}
+		}
+		events, err := lib.ParseTrace(f)
+		if err != nil {
+			lib.Logger.Fatal("error: ", err)
+		}
+		_ = f.Close()
+		runs = append(runs, lib.TraceRun{Name: name, Events: events})
+	}
+	//
+	var filesystem *lib.Filesystem
+	if opArgs.Image != "" {
+		filesystem = tracesFilesystem(ctx, opArgs.Image, opArgs.Platform)
+		if lib.IsDockerRef(opArgs.Image) {
+			cli, err := client.NewClientWithOpts(client.FromEnv)
+			if err != nil {
+				lib.Logger.Fatal("error: ", err)
+			}
+			for i := range runs {
+				runs[i].Events, err = lib.TraceFilterImage(ctx, cli, opArgs.Image, runs[i].Events)
+				if err != nil {
+					lib.Logger.Fatal("error: ", err)
+				}
+			}
+		}
+	}
+	paths, err := lib.TracesCombine(op, runs, filesystem)
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+	for _, p := range paths {
+		if !opArgs.NDJSON {
+			fmt.Println(p.Path)
+			continue
+		}
+		data, err := json.Marshal(p)
+		if err != nil {
+			lib.Logger.Fatal("error: ", err)
+		}
+		fmt.Println(string(data))
+	}
+	lib.Logger.Println(op, "paths:", len(paths), "runs:", len(runs))
+}
+
+// tracesFilesystem scans the image whose symlinks are used to compare paths
+func tracesFilesystem(ctx context.Context, image, platform string) *lib.Filesystem {
+	ws, err := lib.NewWorkspace("traces")
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+	defer func() { _ = ws.Remove() }()
+	archive, err := lib.ImageOpen(ctx, image, ws.Dir+"/image.tar", platform)
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+	defer func() { _ = archive.Close() }()
+	files, _, err := lib.ScanArchive(archive, false)
+	if err != nil {
+		lib.Logger.Fatal("error: ", err)
+	}
+	return lib.NewFilesystem(files)
+}
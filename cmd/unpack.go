@@ -1,8 +1,10 @@
 package dockertrace
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
@@ -29,139 +31,93 @@ func (unpackArgs) Description() string {
 func unpack() {
 	var args unpackArgs
 	arg.MustParse(&args)
-
-	shell := fmt.Sprintf("set -eou pipefail; docker save %s | tar xf -", args.Name)
-	cmd := exec.Command("bash", "-c", shell)
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	// layers stream in tarball order, so extract each to a staging directory and rename them once the
+	// manifest has been read at the end of the stream
+	staged := make(map[string]string)
+	archive, err := lib.ImageStream(context.Background(), args.Name, "", func(layer string, r io.Reader) error {
+		dir := ".unpack-" + lib.LayerID(layer)
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			return err
+		}
+		staged[layer] = dir
+		if args.NoUntar {
+			return writeLayer(r, path.Join(dir, "layer.tar"))
+		}
+		return untarLayer(r, dir)
+	})
 	if err != nil {
-		lib.Logger.Fatal("error:", shell, err)
+		lib.Logger.Fatal("error: ", err)
 	}
-
-	bytes, err := os.ReadFile("manifest.json")
+	//
+	err = os.WriteFile("config.json", archive.Config, 0644)
 	if err != nil {
-		lib.Logger.Fatal("error:", err)
+		lib.Logger.Fatal("error: ", err)
 	}
-
-	var manifests []lib.Manifest
-
-	err = json.Unmarshal(bytes, &manifests)
+	// the manifest as docker save writes it, naming layers and config as they were in the tarball
+	manifest, err := json.Marshal([]lib.Manifest{archive.Manifest})
 	if err != nil {
-		lib.Logger.Fatal("error:", err)
+		lib.Logger.Fatal("error: ", err)
 	}
-
-	manifest, err := lib.FindManifest(manifests, args.Name)
+	err = os.WriteFile("manifest.json", manifest, 0644)
 	if err != nil {
 		lib.Logger.Fatal("error: ", err)
 	}
-
-	layerNames := make(map[string]string)
-	for i, layerID := range manifest.Layers {
-		layerID = path.Dir(layerID)
-		layerNames[layerID] = fmt.Sprintf("layer%02d", i)
-	}
-
-	if !args.NoRename {
-		for _, layerTar := range manifest.Layers {
-			err := renameSymlink(layerTar, layerNames)
-			if err != nil {
-				lib.Logger.Fatal("error:", err)
-			}
-			err = renameDirectory(layerTar, layerNames)
-			if err != nil {
-				lib.Logger.Fatal("error:", err)
-			}
+	done := make(map[string]string)
+	for i, layer := range archive.Manifest.Layers {
+		dir := fmt.Sprintf("layer%02d", i)
+		if args.NoRename {
+			dir = lib.LayerID(layer)
 		}
-	}
-
-	if !args.NoUntar {
-		for _, layerTar := range manifest.Layers {
-			err := untarLayer(args.NoRename, layerTar, layerNames)
-			if err != nil {
-				lib.Logger.Fatal("error:", err)
-			}
+		entry, err := archive.Resolve(layer)
+		if err != nil {
+			lib.Logger.Fatal("error: ", err)
 		}
-	}
-
-	if !args.NoUntar {
-		for _, layerTar := range manifest.Layers {
-			err := deleteLayerExtras(args.NoRename, layerTar, layerNames)
-			if err != nil {
-				lib.Logger.Fatal("error:", err)
-			}
+		// a layer listed twice in the manifest is copied from its first directory
+		if prev, ok := done[entry]; ok {
+			err = exec.Command("cp", "-a", prev, dir).Run()
+		} else if staging, ok := staged[entry]; ok {
+			err = os.Rename(staging, dir)
+		} else {
+			err = fmt.Errorf("layer not found in image tarball: %s", layer)
 		}
-	}
-
-}
-
-func deleteLayerExtras(noRename bool, layerTar string, layerNames map[string]string) error {
-	layerID := path.Base(path.Dir(layerTar))
-	if !noRename {
-		var ok bool
-		layerID, ok = layerNames[layerID]
-		if !ok {
-			return fmt.Errorf("error: %s %v", layerID, layerNames)
+		if err != nil {
+			lib.Logger.Fatal("error: ", err)
 		}
+		done[entry] = dir
 	}
-	for _, name := range []string{"json", "VERSION", "layer.tar"} {
-		err := os.Remove(path.Join(layerID, name))
-		if err != nil {
-			return err
+	// entries not in the manifest of this image
+	for _, staging := range staged {
+		err := os.RemoveAll(staging)
+		if err != nil && !os.IsNotExist(err) {
+			lib.Logger.Fatal("error: ", err)
 		}
 	}
-	return nil
 }
 
-func untarLayer(noRename bool, layerTar string, layerNames map[string]string) error {
-	layerID := path.Base(path.Dir(layerTar))
-	if !noRename {
-		var ok bool
-		layerID, ok = layerNames[layerID]
-		if !ok {
-			return fmt.Errorf("no layer match: %s %v", layerID, layerNames)
-		}
-	}
-	cmd := exec.Command("tar", "--delay-directory-restore", "-xf", "layer.tar")
-	cmd.Dir = layerID
-	err := cmd.Run()
+// writeLayer writes the uncompressed tarball of a layer
+func writeLayer(r io.Reader, file string) error {
+	w, err := os.Create(file)
 	if err != nil {
-		return fmt.Errorf("tar expansion failure: %w %s", err, layerID)
+		return err
 	}
-	return nil
-}
-
-func renameSymlink(layerTar string, layerNames map[string]string) error {
-	link, err := os.Readlink(layerTar)
-	if err == nil {
-		err := os.Remove(layerTar)
-		if err != nil {
-			return err
-		}
-		layerID := path.Base(path.Dir(link))
-		layerName, ok := layerNames[layerID]
-		if !ok {
-			lib.Logger.Fatal("error:", layerID, layerNames)
-		}
-		err = os.Symlink(
-			path.Join("..", layerName, "layer.tar"),
-			path.Join(layerTar),
-		)
-		if err != nil {
-			return err
-		}
+	_, err = io.Copy(w, r)
+	if err != nil {
+		_ = w.Close()
+		return err
 	}
-	return nil
+	return w.Close()
 }
 
-func renameDirectory(layerTar string, layerNames map[string]string) error {
-	layerID := path.Base(path.Dir(layerTar))
-	layerName, ok := layerNames[layerID]
-	if !ok {
-		return fmt.Errorf("error: %s %v", layerID, layerNames)
-	}
-	err := os.Rename(layerID, layerName)
+// untarLayer extracts the uncompressed tarball of a layer into a directory
+func untarLayer(r io.Reader, dir string) error {
+	cmd := exec.Command("tar", "--delay-directory-restore", "-xf", "-")
+	cmd.Dir = dir
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
 	if err != nil {
-		return err
+		return fmt.Errorf("tar expansion failure: %w %s", err, dir)
 	}
 	return nil
 }
@@ -7,7 +7,9 @@ require (
 	github.com/avast/retry-go v3.0.0+incompatible
 	github.com/docker/docker v20.10.17+incompatible
 	github.com/gofrs/uuid v4.2.0+incompatible
+	github.com/klauspost/compress v1.16.7
 	github.com/mattn/go-isatty v0.0.14
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,689 @@
+package lib
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/klauspost/compress/zstd"
+)
+
+type archiveEntry struct {
+	file   *os.File
+	offset int64
+	size   int64
+	link   string
+	data   []byte // set for entries kept in memory by ArchiveStream
+}
+
+// Archive is an indexed image tarball from docker save, in the legacy or oci image layout, or an oci
+// image layout directory, where any entry can be read without reading the entries before it. archives
+// from ArchiveStream keep only their json entries.
+type Archive struct {
+	files          []*os.File
+	entries        map[string]archiveEntry
+	Manifest       Manifest
+	ManifestDigest string // known when the image was found through index.json, or saved from docker
+	Config         []byte
+	Layers         map[string]int
+}
+
+// positionReader tracks the offset of a seekable reader so tar entries can be located
+type positionReader struct {
+	r   io.ReadSeeker
+	pos int64
+}
+
+func (p *positionReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.pos += int64(n)
+	return n, err
+}
+
+func (p *positionReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := p.r.Seek(offset, whence)
+	if err == nil {
+		p.pos = pos
+	}
+	return pos, err
+}
+
+// ArchiveOpen indexes an image tarball by reading only its tar headers, then reads the manifest and
+// config of the named image
+func ArchiveOpen(tarball string, name string) (*Archive, error) {
+	f, err := os.Open(tarball)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	archive := &Archive{
+		files:   []*os.File{f},
+		entries: make(map[string]archiveEntry),
+		Layers:  make(map[string]int),
+	}
+	r := &positionReader{r: f}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_ = archive.Close()
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		switch header.Typeflag {
+		case tar.TypeReg:
+			archive.entries[header.Name] = archiveEntry{file: f, offset: r.pos, size: header.Size}
+		case tar.TypeSymlink:
+			archive.entries[header.Name] = archiveEntry{link: path.Join(path.Dir(header.Name), header.Linkname)}
+		}
+	}
+	err = archive.load(name, false, "")
+	if err != nil {
+		_ = archive.Close()
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return archive, nil
+}
+
+// archiveStreamMemory is the largest json entry kept in memory by ArchiveStream, enough for manifests,
+// indexes and configs
+const archiveStreamMemory = 16 * 1024 * 1024
+
+// ArchiveStream reads an image tarball in one pass without writing it to disk, calling fn with the
+// uncompressed tarball of each layer in tarball order. json entries are kept in memory, and when the
+// stream ends the manifest and config of the named image are read from them. layers are named by their
+// entry, which manifest layers reach through Archive.Resolve. a nil fn skips layers.
+func ArchiveStream(r io.Reader, name string, fn func(layer string, r io.Reader) error) (*Archive, error) {
+	archive := &Archive{
+		entries: make(map[string]archiveEntry),
+		Layers:  make(map[string]int),
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		switch header.Typeflag {
+		case tar.TypeReg:
+			buf := bufio.NewReader(tr)
+			head, _ := buf.Peek(1)
+			if header.Size <= archiveStreamMemory && (bytes.Equal(head, []byte("{")) || bytes.Equal(head, []byte("["))) {
+				data, err := io.ReadAll(buf)
+				if err != nil {
+					Logger.Println("error:", err)
+					return nil, err
+				}
+				archive.entries[header.Name] = archiveEntry{data: data, size: header.Size}
+				continue
+			}
+			archive.entries[header.Name] = archiveEntry{size: header.Size}
+			isLayer := path.Base(header.Name) == "layer.tar" || strings.HasPrefix(header.Name, "blobs/")
+			if fn == nil || !isLayer {
+				continue
+			}
+			lr, err := LayerDecompress(buf)
+			if err != nil {
+				Logger.Println("error:", err)
+				return nil, err
+			}
+			err = fn(header.Name, lr)
+			_ = lr.Close()
+			if err != nil {
+				Logger.Println("error:", err)
+				return nil, err
+			}
+		case tar.TypeSymlink:
+			archive.entries[header.Name] = archiveEntry{link: path.Join(path.Dir(header.Name), header.Linkname)}
+		default:
+		}
+	}
+	err := archive.load(name, false, "")
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return archive, nil
+}
+
+// ArchiveOpenDir indexes an oci image layout directory, then reads the manifest and config of the
+// named image, or of the only image when name is empty. platform chooses from multi platform indexes,
+// defaulting to the platform of this machine.
+func ArchiveOpenDir(dir string, name string, platform string) (*Archive, error) {
+	archive := &Archive{
+		entries: make(map[string]archiveEntry),
+		Layers:  make(map[string]int),
+	}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		archive.files = append(archive.files, f)
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		archive.entries[filepath.ToSlash(rel)] = archiveEntry{file: f, size: info.Size()}
+		return nil
+	})
+	if err != nil {
+		_ = archive.Close()
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	err = archive.load(name, true, platform)
+	if err != nil {
+		_ = archive.Close()
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return archive, nil
+}
+
+// load reads the manifest and config of the named image. docker before 25 writes only manifest.json,
+// docker 25+ writes both, and other tools write only the oci image layout.
+func (archive *Archive) load(name string, preferIndex bool, platform string) error {
+	_, hasManifest := archive.entries["manifest.json"]
+	_, hasIndex := archive.entries["index.json"]
+	var err error
+	if hasManifest && !(preferIndex && hasIndex) {
+		var data []byte
+		data, err = archive.ReadFile("manifest.json")
+		if err == nil {
+			var manifests []Manifest
+			err = json.Unmarshal(data, &manifests)
+			if err == nil {
+				archive.Manifest, err = FindManifest(manifests, name)
+			}
+		}
+	} else {
+		archive.Manifest, err = archive.ociManifest(name, platform)
+	}
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	archive.Config, err = archive.ReadFile(archive.Manifest.Config)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	for i, layer := range archive.Manifest.Layers {
+		archive.Layers[layer] = i
+	}
+	return nil
+}
+
+// Open returns a reader of one entry, following symlinks between entries
+func (archive *Archive) Open(name string) (*io.SectionReader, error) {
+	name, err := archive.Resolve(name)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	entry := archive.entries[name]
+	if entry.data != nil {
+		return io.NewSectionReader(bytes.NewReader(entry.data), 0, int64(len(entry.data))), nil
+	}
+	if entry.file == nil {
+		err := fmt.Errorf("entry was not kept from image stream: %s", name)
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return io.NewSectionReader(entry.file, entry.offset, entry.size), nil
+}
+
+// Resolve follows symlinks between entries, like the legacy layer.tar links of docker 25+, to the
+// name of the entry with the data
+func (archive *Archive) Resolve(name string) (string, error) {
+	for i := 0; i < 40; i++ {
+		entry, ok := archive.entries[name]
+		if !ok {
+			err := fmt.Errorf("no such entry in image tarball: %s", name)
+			Logger.Println("error:", err)
+			return "", err
+		}
+		if entry.link == "" {
+			return name, nil
+		}
+		name = entry.link
+	}
+	err := fmt.Errorf("too many links in image tarball: %s", name)
+	Logger.Println("error:", err)
+	return "", err
+}
+
+// ReadFile reads all of one entry
+func (archive *Archive) ReadFile(name string) ([]byte, error) {
+	r, err := archive.Open(name)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// ociManifest finds the manifest of the named image through index.json, choosing the platform from
+// multi platform indexes
+func (archive *Archive) ociManifest(name string, platform string) (Manifest, error) {
+	data, err := archive.ReadFile("index.json")
+	if err != nil {
+		err := fmt.Errorf("image tarball has neither manifest.json nor index.json")
+		Logger.Println("error:", err)
+		return Manifest{}, err
+	}
+	var index OCIIndex
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		Logger.Println("error:", err)
+		return Manifest{}, err
+	}
+	desc, err := ociFindDescriptor(index.Manifests, name)
+	if err != nil {
+		Logger.Println("error:", err)
+		return Manifest{}, err
+	}
+	for i := 0; i < 8; i++ {
+		data, err := archive.ReadFile(OCIBlobPath("", desc.Digest))
+		if err != nil {
+			Logger.Println("error:", err)
+			return Manifest{}, err
+		}
+		if desc.MediaType != MediaTypeOCIIndex && desc.MediaType != MediaTypeDockerManifestList {
+			var manifest OCIManifest
+			err = json.Unmarshal(data, &manifest)
+			if err != nil {
+				Logger.Println("error:", err)
+				return Manifest{}, err
+			}
+			archive.ManifestDigest = desc.Digest
+			result := Manifest{
+				Config:   OCIBlobPath("", manifest.Config.Digest),
+				RepoTags: []string{name},
+			}
+			for _, layer := range manifest.Layers {
+				result.Layers = append(result.Layers, OCIBlobPath("", layer.Digest))
+			}
+			return result, nil
+		}
+		var nested OCIIndex
+		err = json.Unmarshal(data, &nested)
+		if err != nil {
+			Logger.Println("error:", err)
+			return Manifest{}, err
+		}
+		desc, err = ociFindPlatform(nested.Manifests, platform)
+		if err != nil {
+			Logger.Println("error:", err)
+			return Manifest{}, err
+		}
+	}
+	err = fmt.Errorf("too many nested indexes in image tarball")
+	Logger.Println("error:", err)
+	return Manifest{}, err
+}
+
+// manifestDigest finds the manifest blob naming the config of the image, which docker 25+ saves along
+// with manifest.json, or nothing for older versions of docker
+func (archive *Archive) manifestDigest() string {
+	for name, entry := range archive.entries {
+		if !strings.HasPrefix(name, "blobs/sha256/") || entry.link != "" || entry.size > archiveStreamMemory {
+			continue
+		}
+		r, err := archive.Open(name)
+		if err != nil {
+			continue
+		}
+		head := make([]byte, 1)
+		_, err = r.ReadAt(head, 0)
+		if err != nil || head[0] != '{' {
+			continue
+		}
+		data, err := archive.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		var manifest OCIManifest
+		err = json.Unmarshal(data, &manifest)
+		if err == nil && manifest.Config.Digest != "" && OCIBlobPath("", manifest.Config.Digest) == archive.Manifest.Config {
+			return "sha256:" + path.Base(name)
+		}
+	}
+	return ""
+}
+
+// imageRepoDigest is the digest docker pulled an image by, which is of the multi platform index for
+// images pulled from one, and unknown for images built locally
+func imageRepoDigest(ctx context.Context, name string) string {
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		Logger.Println("warning: cannot find source digest:", err)
+		return ""
+	}
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, name)
+	if err != nil {
+		Logger.Println("warning: cannot find source digest:", err)
+		return ""
+	}
+	repo := name
+	i := strings.LastIndex(repo, ":")
+	if i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+	for _, repoDigest := range inspect.RepoDigests {
+		r, digest, ok := strings.Cut(repoDigest, "@")
+		if ok && (len(inspect.RepoDigests) == 1 || r == repo || strings.HasSuffix(r, "/"+repo)) {
+			return digest
+		}
+	}
+	return ""
+}
+
+// ociFindDescriptor finds an image in index.json by digest or by its name annotations
+func ociFindDescriptor(descs []OCIDescriptor, name string) (OCIDescriptor, error) {
+	if len(descs) == 1 {
+		return descs[0], nil
+	}
+	for _, desc := range descs {
+		if name != "" && (strings.HasPrefix(desc.Digest, name) || strings.HasPrefix(strings.TrimPrefix(desc.Digest, "sha256:"), name)) {
+			return desc, nil
+		}
+		// containerd names are fully qualified, like docker.io/library/alpine:latest
+		fullName := desc.Annotations["io.containerd.image.name"]
+		if fullName != "" && (fullName == name || strings.HasSuffix(fullName, "/"+name)) {
+			return desc, nil
+		}
+	}
+	for _, desc := range descs {
+		refName := desc.Annotations["org.opencontainers.image.ref.name"]
+		if refName != "" && (refName == name || (strings.Contains(name, ":") && refName == ociRefName(name))) {
+			return desc, nil
+		}
+	}
+	err := fmt.Errorf("image not found in index.json: %s", name)
+	Logger.Println("error:", err)
+	return OCIDescriptor{}, err
+}
+
+type layerReader struct {
+	io.Reader
+	close func()
+}
+
+func (r *layerReader) Close() error {
+	r.close()
+	return nil
+}
+
+// Layer returns a reader of the uncompressed tarball of a layer, detecting gzip and zstd compression
+func (archive *Archive) Layer(layer string) (io.ReadCloser, error) {
+	r, err := archive.Open(layer)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return LayerDecompress(r)
+}
+
+// LayerDecompress wraps a layer tarball in a decompressor chosen by its magic bytes
+func LayerDecompress(r io.Reader) (io.ReadCloser, error) {
+	buf := bufio.NewReader(r)
+	magic, _ := buf.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(buf)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		return &layerReader{Reader: gr, close: func() { _ = gr.Close() }}, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(buf, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		return &layerReader{Reader: zr, close: zr.Close}, nil
+	default:
+		return &layerReader{Reader: buf, close: func() {}}, nil
+	}
+}
+
+// LayerID names a layer by its directory in the legacy layout, or by its digest in the oci layout
+func LayerID(layer string) string {
+	if path.Base(layer) == "layer.tar" {
+		return path.Base(path.Dir(layer))
+	}
+	return path.Base(layer)
+}
+
+func (archive *Archive) Close() error {
+	var result error
+	for _, f := range archive.files {
+		err := f.Close()
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// ImageSaveFile writes the output of docker save for an image to a file
+func ImageSaveFile(ctx context.Context, name string, file string) error {
+	r, err := imageSave(ctx, name)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	defer func() { _ = r.Close() }()
+	w, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err != nil {
+		_ = w.Close()
+		Logger.Println("error:", err)
+		return err
+	}
+	return w.Close()
+}
+
+// imageSave streams docker save of one image
+func imageSave(ctx context.Context, name string) (io.ReadCloser, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	r, err := cli.ImageSave(ctx, []string{name})
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return r, nil
+}
+
+// ImageOpen opens an image from docker, from a registry:// reference or from an oci:<dir> layout.
+// docker and registry images are first written as a tarball to file, which the caller removes. oci
+// layouts are read in place. platform, like linux/arm64, chooses from multi platform images and is
+// checked against the config of single platform images. empty means the platform of this machine.
+func ImageOpen(ctx context.Context, name string, file string, platform string) (*Archive, error) {
+	var archive *Archive
+	var err error
+	switch {
+	case strings.HasPrefix(name, RefOCI):
+		dir, ref := ParseOCIRef(name)
+		archive, err = ArchiveOpenDir(dir, ref, platform)
+	case strings.HasPrefix(name, RefRegistry):
+		err = RegistryPull(ctx, name, file, platform)
+		if err == nil {
+			archive, err = ArchiveOpen(file, name)
+		}
+	default:
+		err = ImageSaveFile(ctx, name, file)
+		if err == nil {
+			archive, err = ArchiveOpen(file, name)
+		}
+		if err == nil && archive.ManifestDigest == "" {
+			archive.ManifestDigest = archive.manifestDigest()
+		}
+		if err == nil && archive.ManifestDigest == "" {
+			archive.ManifestDigest = imageRepoDigest(ctx, name)
+		}
+	}
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	if platform != "" {
+		var config OCIPlatform
+		_ = json.Unmarshal(archive.Config, &config)
+		if config.OS != "" && !PlatformMatch(config, platform) {
+			_ = archive.Close()
+			err := fmt.Errorf("image %s is %s, not %s", name, PlatformString(config), platform)
+			Logger.Println("error:", err)
+			return nil, err
+		}
+	}
+	return archive, nil
+}
+
+// ImageStream reads an image in one pass, calling fn with the uncompressed tarball of each layer named
+// as in ArchiveStream. images in docker are streamed from docker save without writing them to disk.
+// tarballs and oci layouts are read in place, and registry images are pulled to a workspace first. the
+// returned archive has the manifest and config, but its layers cannot be read again.
+func ImageStream(ctx context.Context, name string, tarball string, fn func(layer string, r io.Reader) error) (*Archive, error) {
+	if tarball == "" && IsDockerRef(name) {
+		r, err := imageSave(ctx, name)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		defer func() { _ = r.Close() }()
+		return ArchiveStream(r, name, fn)
+	}
+	archive, closeArchive, err := archiveOpenImage(ctx, name, tarball)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	defer closeArchive()
+	done := make(map[string]bool)
+	for _, layer := range archive.Manifest.Layers {
+		entry, err := archive.Resolve(layer)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		if fn == nil || done[entry] {
+			continue
+		}
+		done[entry] = true
+		r, err := archive.Layer(entry)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		err = fn(entry, r)
+		_ = r.Close()
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+	}
+	return archive, nil
+}
+
+// archiveOpenImage opens a saved image tarball, or when there is none opens the image to a tarball in
+// a workspace which is removed by the returned close func
+func archiveOpenImage(ctx context.Context, name string, tarball string) (*Archive, func(), error) {
+	if tarball != "" {
+		archive, err := ArchiveOpen(tarball, name)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, nil, err
+		}
+		return archive, func() { _ = archive.Close() }, nil
+	}
+	ws, err := NewWorkspace("save")
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, nil, err
+	}
+	archive, err := ImageOpen(ctx, name, ws.Dir+"/image.tar", "")
+	if err != nil {
+		_ = ws.Remove()
+		Logger.Println("error:", err)
+		return nil, nil, err
+	}
+	return archive, func() {
+		_ = archive.Close()
+		_ = ws.Remove()
+	}, nil
+}
+
+type DiskUsage struct {
+	patterns []string
+	Peak     int64
+}
+
+// NewDiskUsage tracks the total size of files and directories matching glob patterns
+func NewDiskUsage(patterns ...string) *DiskUsage {
+	return &DiskUsage{patterns: patterns}
+}
+
+// Sample measures the current size of the tracked paths and updates the peak
+func (usage *DiskUsage) Sample() int64 {
+	var total int64
+	for _, pattern := range usage.patterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			_ = filepath.WalkDir(match, func(p string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return nil
+				}
+				info, err := d.Info()
+				if err == nil {
+					total += info.Size()
+				}
+				return nil
+			})
+		}
+	}
+	if total > usage.Peak {
+		usage.Peak = total
+	}
+	return total
+}
@@ -0,0 +1,293 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestArchiveOpen(t *testing.T) {
+	dir := t.TempDir()
+	layer0 := testTar([]testEntry{testDir("etc/"), testFile("etc/a", "a")})
+	layer1 := testTar([]testEntry{testFile("etc/b", "b")})
+	manifest := []Manifest{{
+		Config:   "abc.json",
+		RepoTags: []string{"test:latest"},
+		Layers:   []string{"l0/layer.tar", "l1/layer.tar", "l2/layer.tar"},
+	}}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarball := path.Join(dir, "image.tar")
+	// layer.tar entries in docker save may be symlinks to identical layers, and gnu long names must
+	// not shift the offsets of entries after them
+	longName := "very/"
+	for len(longName) < 200 {
+		longName += "long/"
+	}
+	err = os.WriteFile(tarball, testTar([]testEntry{
+		testDir("l0/"),
+		testFile("l0/layer.tar", string(layer0)),
+		testFile(longName+"padding", "xyz"),
+		testFile("l1/layer.tar", string(layer1)),
+		testSymlink("l2/layer.tar", "../l0/layer.tar"),
+		testFile("abc.json", `{"config": {"Env": ["A=1"]}}`),
+		testFile("manifest.json", string(data)),
+	}), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := ArchiveOpen(tarball, "test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = archive.Close() }()
+	if string(archive.Config) != `{"config": {"Env": ["A=1"]}}` {
+		t.Fatal("bad config", string(archive.Config))
+	}
+	if !reflect.DeepEqual(archive.Layers, map[string]int{"l0/layer.tar": 0, "l1/layer.tar": 1, "l2/layer.tar": 2}) {
+		t.Fatal("bad layers", archive.Layers)
+	}
+	for name, expected := range map[string][]byte{"l1/layer.tar": layer1, "l2/layer.tar": layer0, longName + "padding": []byte("xyz")} {
+		r, err := archive.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(data, expected) {
+			t.Fatal("bad entry", name)
+		}
+	}
+	files, _, err := ScanArchive(archive, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make(map[string]int)
+	for _, f := range files {
+		paths[f.Path] = f.LayerIndex
+	}
+	if !reflect.DeepEqual(paths, map[string]int{"/etc/": 2, "/etc/a": 2, "/etc/b": 1}) {
+		t.Fatal("bad scan", paths)
+	}
+}
+
+func TestArchiveStream(t *testing.T) {
+	layer0 := testTar([]testEntry{testDir("etc/"), testFile("etc/a", "a")})
+	layer1 := testTar([]testEntry{testFile("etc/b", "b")})
+	manifest := []Manifest{{
+		Config:   "abc.json",
+		RepoTags: []string{"test:latest"},
+		Layers:   []string{"l0/layer.tar", "l1/layer.tar", "l2/layer.tar"},
+	}}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// docker save writes manifest.json last, and l2 is a link to the same layer as l0
+	tarball := testTar([]testEntry{
+		testFile("l0/layer.tar", string(layer0)),
+		testFile("l1/layer.tar", string(layer1)),
+		testSymlink("l2/layer.tar", "../l0/layer.tar"),
+		testFile("abc.json", `{"config": {"Env": ["A=1"]}}`),
+		testFile("manifest.json", string(data)),
+	})
+	archive, err := ArchiveStream(bytes.NewReader(tarball), "test:latest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(archive.Config) != `{"config": {"Env": ["A=1"]}}` {
+		t.Fatal("bad config", string(archive.Config))
+	}
+	entry, err := archive.Resolve("l2/layer.tar")
+	if err != nil || entry != "l0/layer.tar" {
+		t.Fatal("bad link", entry, err)
+	}
+	_, err = archive.Open("l1/layer.tar")
+	if err == nil {
+		t.Fatal("layers are not kept from the stream")
+	}
+	files, _, err := ScanStream(bytes.NewReader(tarball), "test:latest", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, fmt.Sprintf("%s:%d", f.Path, f.LayerIndex))
+	}
+	if !reflect.DeepEqual(paths, []string{"/etc/:0", "/etc/a:0", "/etc/b:1", "/etc/:2", "/etc/a:2"}) {
+		t.Fatal("bad scan", paths)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	dir := t.TempDir()
+	err := os.MkdirAll(path.Join(dir, "oci.x", "blobs"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(dir, "in.tar.x"), make([]byte, 100), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(dir, "oci.x", "blobs", "a"), make([]byte, 50), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(dir, "in.tar.y"), make([]byte, 1000), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := NewDiskUsage(path.Join(dir, "*.x"), "")
+	if usage.Sample() != 150 {
+		t.Fatal("bad sample", usage.Peak)
+	}
+	err = os.Remove(path.Join(dir, "in.tar.x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Sample() != 50 || usage.Peak != 150 {
+		t.Fatal("bad peak", usage.Peak)
+	}
+}
+
+func TestArchiveOpenOCI(t *testing.T) {
+	dir := t.TempDir()
+	layer0 := testTar([]testEntry{testDir("etc/"), testFile("etc/a", "a")})
+	layer1 := testTar([]testEntry{testFile("etc/b", "b")})
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, err := gw.Write(layer0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zst := zw.EncodeAll(layer1, nil)
+	_ = zw.Close()
+	//
+	var entries []testEntry
+	blob := func(data []byte, mediaType string) OCIDescriptor {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+		entries = append(entries, testFile(OCIBlobPath("", digest), string(data)))
+		return OCIDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(data))}
+	}
+	marshal := func(v any) []byte {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	config := blob([]byte(`{"config": {"Env": ["A=1"]}}`), MediaTypeOCIConfig)
+	layers := []OCIDescriptor{
+		blob(gz.Bytes(), MediaTypeOCILayerGz),
+		blob(zst, "application/vnd.oci.image.layer.v1.tar+zstd"),
+	}
+	manifest := blob(marshal(OCIManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        config,
+		Layers:        layers,
+	}), MediaTypeOCIManifest)
+	manifest.Platform = &OCIPlatform{OS: "linux", Architecture: runtime.GOARCH}
+	other := blob([]byte(`{}`), MediaTypeOCIManifest)
+	other.Platform = &OCIPlatform{OS: "linux", Architecture: "other"}
+	attestation := blob([]byte(`{"attestation": true}`), MediaTypeOCIManifest)
+	attestation.Platform = &OCIPlatform{OS: "unknown", Architecture: "unknown"}
+	nested := blob(marshal(OCIIndex{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIIndex,
+		Manifests:     []OCIDescriptor{attestation, other, manifest},
+	}), MediaTypeOCIIndex)
+	nested.Annotations = map[string]string{"io.containerd.image.name": "docker.io/library/test:latest"}
+	unrelated := blob([]byte(`{}`), MediaTypeOCIManifest)
+	unrelated.Annotations = map[string]string{"io.containerd.image.name": "docker.io/library/other:latest"}
+	entries = append(entries,
+		testFile("oci-layout", `{"imageLayoutVersion": "1.0.0"}`),
+		testFile("index.json", string(marshal(OCIIndex{SchemaVersion: 2, Manifests: []OCIDescriptor{unrelated, nested}}))),
+	)
+	tarball := path.Join(dir, "image.tar")
+	err = os.WriteFile(tarball, testTar(entries), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//
+	archive, err := ArchiveOpen(tarball, "test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = archive.Close() }()
+	if string(archive.Config) != `{"config": {"Env": ["A=1"]}}` {
+		t.Fatal("bad config", string(archive.Config))
+	}
+	if len(archive.Manifest.Layers) != 2 || LayerID(archive.Manifest.Layers[1]) != strings.TrimPrefix(layers[1].Digest, "sha256:") {
+		t.Fatal("bad layers", archive.Manifest.Layers)
+	}
+	for i, expected := range [][]byte{layer0, layer1} {
+		r, err := archive.Layer(archive.Manifest.Layers[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Close()
+		if !reflect.DeepEqual(data, expected) {
+			t.Fatal("bad layer", i)
+		}
+	}
+	files, _, err := ScanArchive(archive, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make(map[string]int)
+	for _, f := range files {
+		paths[f.Path] = f.LayerIndex
+	}
+	if !reflect.DeepEqual(paths, map[string]int{"/etc/": 0, "/etc/a": 0, "/etc/b": 1}) {
+		t.Fatal("bad scan", paths)
+	}
+	//
+	_, err = ArchiveOpen(tarball, "missing:latest")
+	if err == nil {
+		t.Fatal("expected missing image to fail")
+	}
+}
+
+func TestFindManifestBlobConfig(t *testing.T) {
+	manifests := []Manifest{
+		{Config: "blobs/sha256/aaa111", RepoTags: []string{"a:latest"}},
+		{Config: "blobs/sha256/bbb222", RepoTags: []string{"b:latest"}},
+	}
+	for _, name := range []string{"sha256:bbb222", "bbb", "b:latest"} {
+		m, err := FindManifest(manifests, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Config != "blobs/sha256/bbb222" {
+			t.Fatal("bad manifest", name, m.Config)
+		}
+	}
+}
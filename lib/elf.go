@@ -0,0 +1,260 @@
+package lib
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+type ElfInfo struct {
+	Class   elf.Class
+	Machine elf.Machine
+	Interp  string
+	Needed  []string
+	Rpath   []string
+	Runpath []string
+}
+
+// ScanElf reads the dynamic linking info of an elf file, returning nil when the data cannot be parsed
+func ScanElf(r io.ReaderAt) *ElfInfo {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = f.Close() }()
+	info := &ElfInfo{
+		Class:   f.Class,
+		Machine: f.Machine,
+	}
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			var interp bytes.Buffer
+			_, err := interp.ReadFrom(prog.Open())
+			if err == nil {
+				info.Interp = strings.TrimRight(interp.String(), "\x00")
+			}
+		}
+	}
+	info.Needed, _ = f.ImportedLibraries()
+	rpath, _ := f.DynString(elf.DT_RPATH)
+	for _, val := range rpath {
+		info.Rpath = append(info.Rpath, strings.Split(val, ":")...)
+	}
+	runpath, _ := f.DynString(elf.DT_RUNPATH)
+	for _, val := range runpath {
+		info.Runpath = append(info.Runpath, strings.Split(val, ":")...)
+	}
+	return info
+}
+
+// ScanContentPath decides which files lib.ScanLayer keeps the content of
+func ScanContentPath(pth string) bool {
+	return pth == "/etc/ld.so.conf" ||
+		strings.HasPrefix(pth, "/etc/ld.so.conf.d/") ||
+		(strings.HasPrefix(pth, "/etc/ld-musl-") && strings.HasSuffix(pth, ".path")) ||
+		PackageDBPath(pth)
+}
+
+func splitSearchPath(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ':' || r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+// ldSoConf reads the library directories from /etc/ld.so.conf and its includes
+func ldSoConf(filesystem *Filesystem, file string, seen map[string]bool) []string {
+	if seen[file] {
+		return nil
+	}
+	seen[file] = true
+	f, ok := filesystem.Lookup(file)
+	if !ok {
+		return nil
+	}
+	var dirs []string
+	for _, line := range strings.Split(string(f.Content), "\n") {
+		line = strings.TrimSpace(strings.Split(line, "#")[0])
+		if strings.HasPrefix(line, "include ") || strings.HasPrefix(line, "include\t") {
+			for _, pattern := range strings.Fields(line)[1:] {
+				if !strings.HasPrefix(pattern, "/") {
+					pattern = path.Join(path.Dir(file), pattern)
+				}
+				var includes []string
+				for p := range filesystem.Files {
+					if (KeepRule{Pattern: pattern}).Match(p) {
+						includes = append(includes, p)
+					}
+				}
+				sort.Strings(includes)
+				for _, include := range includes {
+					dirs = append(dirs, ldSoConf(filesystem, include, seen)...)
+				}
+			}
+		} else {
+			dirs = append(dirs, splitSearchPath(line)...)
+		}
+	}
+	return dirs
+}
+
+type elfResolver struct {
+	filesystem    *Filesystem
+	ldLibraryPath []string
+	glibcConf     []string
+	muslConf      map[string][]string
+}
+
+func newElfResolver(filesystem *Filesystem, env []string) *elfResolver {
+	resolver := &elfResolver{
+		filesystem: filesystem,
+		glibcConf:  ldSoConf(filesystem, "/etc/ld.so.conf", make(map[string]bool)),
+		muslConf:   make(map[string][]string),
+	}
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "LD_LIBRARY_PATH=") {
+			resolver.ldLibraryPath = splitSearchPath(strings.TrimPrefix(kv, "LD_LIBRARY_PATH="))
+		}
+	}
+	return resolver
+}
+
+// searchPath returns the directories searched for the needed libraries of an object, following the
+// order of the interpreter it is loaded by
+func (resolver *elfResolver) searchPath(info *ElfInfo, root *ElfInfo, origin string) []string {
+	expand := func(dirs []string) []string {
+		var result []string
+		for _, dir := range dirs {
+			dir = strings.ReplaceAll(dir, "${ORIGIN}", origin)
+			dir = strings.ReplaceAll(dir, "$ORIGIN", origin)
+			if strings.Contains(dir, "$LIB") || strings.Contains(dir, "${LIB}") {
+				for _, lib := range []string{"lib", "lib64"} {
+					result = append(result, strings.ReplaceAll(strings.ReplaceAll(dir, "${LIB}", lib), "$LIB", lib))
+				}
+				continue
+			}
+			result = append(result, dir)
+		}
+		return result
+	}
+	var dirs []string
+	if strings.Contains(root.Interp, "ld-musl-") {
+		dirs = append(dirs, resolver.ldLibraryPath...)
+		dirs = append(dirs, expand(info.Rpath)...)
+		dirs = append(dirs, expand(info.Runpath)...)
+		conf, ok := resolver.muslConf[root.Interp]
+		if !ok {
+			arch := strings.TrimSuffix(strings.TrimPrefix(path.Base(root.Interp), "ld-musl-"), ".so.1")
+			f, ok := resolver.filesystem.Lookup("/etc/ld-musl-" + arch + ".path")
+			if ok {
+				conf = splitSearchPath(string(f.Content))
+			} else {
+				conf = []string{"/lib", "/usr/local/lib", "/usr/lib"}
+			}
+			resolver.muslConf[root.Interp] = conf
+		}
+		return append(dirs, conf...)
+	}
+	if len(info.Runpath) == 0 {
+		dirs = append(dirs, expand(info.Rpath)...)
+		if info != root && len(root.Runpath) == 0 {
+			dirs = append(dirs, expand(root.Rpath)...)
+		}
+	}
+	dirs = append(dirs, resolver.ldLibraryPath...)
+	dirs = append(dirs, expand(info.Runpath)...)
+	dirs = append(dirs, resolver.glibcConf...)
+	if info.Class == elf.ELFCLASS64 {
+		dirs = append(dirs, "/lib64", "/usr/lib64")
+	}
+	return append(dirs, "/lib", "/usr/lib")
+}
+
+// find returns the path of a needed library which matches the class and machine of the object needing it
+func (resolver *elfResolver) find(needed string, dirs []string, info *ElfInfo) (string, bool) {
+	candidates := dirs
+	if strings.Contains(needed, "/") {
+		candidates = []string{""}
+	}
+	for _, dir := range candidates {
+		candidate := path.Join("/", dir, needed)
+		f, ok := resolver.filesystem.Lookup(candidate)
+		if !ok || f.Elf == nil {
+			continue
+		}
+		if f.Elf.Class != info.Class || f.Elf.Machine != info.Machine {
+			continue
+		}
+		return candidate, true
+	}
+	return "", false
+}
+
+// ElfClosure adds the interpreter and needed libraries of every kept elf file to paths, recursively,
+// returning a description of every dependency that could not be found in the image
+func ElfClosure(filesystem *Filesystem, env []string, paths map[string]string) []string {
+	resolver := newElfResolver(filesystem, env)
+	type item struct {
+		path string
+		root *ElfInfo
+	}
+	var queue []item
+	for p := range paths {
+		queue = append(queue, item{path: p})
+	}
+	sort.Slice(queue, func(i, j int) bool { return queue[i].path < queue[j].path })
+	var missing []string
+	done := make(map[string]bool)
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		final, _, ok := filesystem.Resolve(current.path)
+		if !ok || done[final] {
+			continue
+		}
+		done[final] = true
+		f := filesystem.Files[final]
+		// hard links are elf files when their target is, and load from the directory of the link
+		if IsHardLink(f) {
+			target, ok := filesystem.Files[CleanPath(f.LinkTarget)]
+			if ok {
+				f = target
+			}
+		}
+		if f.Elf == nil {
+			continue
+		}
+		root := current.root
+		if root == nil {
+			root = f.Elf
+		}
+		add := func(p, reason string) {
+			_, ok := paths[p]
+			if !ok {
+				paths[p] = reason
+			}
+			queue = append(queue, item{path: p, root: root})
+		}
+		if f.Elf.Interp != "" {
+			_, ok := filesystem.Lookup(f.Elf.Interp)
+			if ok {
+				add(f.Elf.Interp, "elf interpreter of "+current.path)
+			} else {
+				missing = append(missing, fmt.Sprintf("%s needs interpreter %s", current.path, f.Elf.Interp))
+			}
+		}
+		dirs := resolver.searchPath(f.Elf, root, path.Dir(final))
+		for _, needed := range f.Elf.Needed {
+			dep, ok := resolver.find(needed, dirs, f.Elf)
+			if ok {
+				add(dep, "elf dependency of "+current.path)
+			} else {
+				missing = append(missing, fmt.Sprintf("%s needs library %s", current.path, needed))
+			}
+		}
+	}
+	return missing
+}
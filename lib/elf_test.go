@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"bytes"
+	"debug/elf"
+	"io/fs"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestElfClosureGlibc(t *testing.T) {
+	amd64 := func(interp string, needed ...string) *ElfInfo {
+		return &ElfInfo{Class: elf.ELFCLASS64, Machine: elf.EM_X86_64, Interp: interp, Needed: needed}
+	}
+	link := func(p, target string) *ScanFile {
+		return &ScanFile{Path: p, Mode: fs.ModeSymlink | 0777, LinkTarget: target}
+	}
+	filesystem := NewFilesystem([]*ScanFile{
+		link("/lib", "usr/lib"),
+		link("/lib64", "usr/lib64"),
+		{Path: "/etc/ld.so.conf", Content: []byte("include /etc/ld.so.conf.d/*.conf\n")},
+		{Path: "/etc/ld.so.conf.d/x86_64-linux-gnu.conf", Content: []byte("# multiarch support\n/usr/lib/x86_64-linux-gnu\n")},
+		{Path: "/usr/bin/curl", Elf: amd64("/lib64/ld-linux-x86-64.so.2", "libcurl.so.4", "libc.so.6")},
+		link("/usr/lib64/ld-linux-x86-64.so.2", "../lib/x86_64-linux-gnu/ld-linux-x86-64.so.2"),
+		{Path: "/usr/lib/x86_64-linux-gnu/ld-linux-x86-64.so.2", Elf: amd64("")},
+		link("/usr/lib/x86_64-linux-gnu/libcurl.so.4", "libcurl.so.4.8.0"),
+		{Path: "/usr/lib/x86_64-linux-gnu/libcurl.so.4.8.0", Elf: amd64("", "libssl.so.3", "libc.so.6", "libgone.so.1")},
+		{Path: "/usr/lib/x86_64-linux-gnu/libssl.so.3", Elf: amd64("", "libc.so.6")},
+		{Path: "/usr/lib/x86_64-linux-gnu/libc.so.6", Elf: amd64("/lib64/ld-linux-x86-64.so.2")},
+		{Path: "/usr/lib/libc.so.6", Elf: &ElfInfo{Class: elf.ELFCLASS32, Machine: elf.EM_386}},
+		{Path: "/usr/lib/x86_64-linux-gnu/libunused.so.1", Elf: amd64("")},
+	})
+	paths := map[string]string{"/usr/bin/curl": "trace"}
+	missing := ElfClosure(filesystem, nil, paths)
+	if paths["/lib64/ld-linux-x86-64.so.2"] != "elf interpreter of /usr/bin/curl" {
+		t.Errorf("interpreter not kept: %s", Pformat(paths))
+	}
+	if paths["/usr/lib/x86_64-linux-gnu/libcurl.so.4"] != "elf dependency of /usr/bin/curl" {
+		t.Errorf("libcurl not kept: %s", Pformat(paths))
+	}
+	for _, p := range []string{"libcurl.so.4.8.0", "libssl.so.3", "libc.so.6", "ld-linux-x86-64.so.2"} {
+		f, ok := filesystem.Lookup("/usr/lib/x86_64-linux-gnu/" + p)
+		if !ok {
+			t.Errorf("missing %s", p)
+			continue
+		}
+		found := false
+		for kept := range paths {
+			g, ok := filesystem.Lookup(kept)
+			if ok && g == f {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s was not kept: %s", p, Pformat(paths))
+		}
+	}
+	for kept := range paths {
+		f, _ := filesystem.Lookup(kept)
+		if f.Elf.Class == elf.ELFCLASS32 || f.Path == "/usr/lib/x86_64-linux-gnu/libunused.so.1" {
+			t.Errorf("kept %s", kept)
+		}
+	}
+	if !reflect.DeepEqual(missing, []string{"/usr/lib/x86_64-linux-gnu/libcurl.so.4 needs library libgone.so.1"}) {
+		t.Errorf("unexpected missing: %v", missing)
+	}
+}
+
+func TestElfClosureMusl(t *testing.T) {
+	musl := func(interp string, needed ...string) *ElfInfo {
+		return &ElfInfo{Class: elf.ELFCLASS64, Machine: elf.EM_X86_64, Interp: interp, Needed: needed}
+	}
+	filesystem := NewFilesystem([]*ScanFile{
+		{Path: "/etc/ld-musl-x86_64.path", Content: []byte("/lib:/usr/lib:/opt/app/lib\n")},
+		{Path: "/opt/app/bin/app", Elf: musl("/lib/ld-musl-x86_64.so.1", "libapp.so", "libc.musl-x86_64.so.1")},
+		{Path: "/opt/app/lib/libapp.so", Elf: musl("")},
+		{Path: "/lib/ld-musl-x86_64.so.1", Elf: musl("")},
+		{Path: "/lib/libc.musl-x86_64.so.1", Mode: fs.ModeSymlink | 0777, LinkTarget: "ld-musl-x86_64.so.1"},
+	})
+	paths := map[string]string{"/opt/app/bin/app": "trace"}
+	missing := ElfClosure(filesystem, nil, paths)
+	if len(missing) != 0 {
+		t.Errorf("unexpected missing: %v", missing)
+	}
+	for _, p := range []string{"/lib/ld-musl-x86_64.so.1", "/opt/app/lib/libapp.so", "/lib/libc.musl-x86_64.so.1"} {
+		_, ok := paths[p]
+		if !ok {
+			t.Errorf("missing %s: %s", p, Pformat(paths))
+		}
+	}
+}
+
+func TestElfClosureHardLink(t *testing.T) {
+	info := &ElfInfo{Class: elf.ELFCLASS64, Machine: elf.EM_X86_64, Needed: []string{"libz.so.1"}}
+	filesystem := NewFilesystem([]*ScanFile{
+		{Path: "/usr/bin/app", Elf: info},
+		{Path: "/usr/bin/app-link", LinkTarget: "/usr/bin/app"},
+		{Path: "/usr/lib/libz.so.1", Elf: &ElfInfo{Class: elf.ELFCLASS64, Machine: elf.EM_X86_64}},
+	})
+	paths := map[string]string{"/usr/bin/app-link": "trace"}
+	missing := ElfClosure(filesystem, nil, paths)
+	if len(missing) != 0 || paths["/usr/lib/libz.so.1"] != "elf dependency of /usr/bin/app-link" {
+		t.Errorf("hard link dependencies not kept: %v %s", missing, Pformat(paths))
+	}
+}
+
+func TestScanUTF8(t *testing.T) {
+	data := []byte("héllo ✓")
+	for i := 0; i <= len(data); i++ {
+		v := &scanUTF8{}
+		_, _ = v.Write(data[:i])
+		_, _ = v.Write(data[i:])
+		if !v.Valid() {
+			t.Errorf("split at %d is not valid", i)
+		}
+	}
+	v := &scanUTF8{}
+	_, _ = v.Write(data[:2])
+	if v.Valid() {
+		t.Error("truncated rune is valid")
+	}
+	v = &scanUTF8{}
+	_, _ = v.Write([]byte{'a', 0xff, 'b'})
+	if v.Valid() {
+		t.Error("invalid byte is valid")
+	}
+}
+
+func TestScanElf(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		return
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	info := ScanElf(bytes.NewReader(data))
+	if info == nil || info.Class == elf.ELFCLASSNONE {
+		t.Errorf("failed to scan elf: %s", exe)
+	}
+	spooled, err := scanElfStream(bytes.NewReader(data), scanElfMemory+1)
+	if err != nil || !reflect.DeepEqual(spooled, info) {
+		t.Errorf("failed to scan spooled elf: %v %v", err, spooled)
+	}
+	if ScanElf(bytes.NewReader([]byte("#!/bin/sh\n"))) != nil {
+		t.Error("scanned a script as elf")
+	}
+}
+
+func TestFilesystemResolve(t *testing.T) {
+	filesystem := NewFilesystem([]*ScanFile{
+		{Path: "/lib", Mode: fs.ModeSymlink | 0777, LinkTarget: "usr/lib"},
+		{Path: "/usr/", Mode: fs.ModeDir | 0755},
+		{Path: "/usr/lib/", Mode: fs.ModeDir | 0755},
+		{Path: "/usr/lib/libz.so.1", Mode: fs.ModeSymlink | 0777, LinkTarget: "/lib/libz.so.1.2"},
+		{Path: "/usr/lib/libz.so.1.2"},
+	})
+	final, links, ok := filesystem.Resolve("/lib/libz.so.1")
+	if !ok || final != "/usr/lib/libz.so.1.2" || !reflect.DeepEqual(links, []string{"/lib", "/usr/lib/libz.so.1", "/lib"}) {
+		t.Errorf("%s %v %v", final, links, ok)
+	}
+	final, _, ok = filesystem.Resolve("/usr/lib/../lib/./libz.so.1.2")
+	if !ok || final != "/usr/lib/libz.so.1.2" {
+		t.Errorf("%s %v", final, ok)
+	}
+}
@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"archive/tar"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+type Filesystem struct {
+	Files map[string]*ScanFile
+}
+
+// NewFilesystem indexes the final view of an image from lib.Scan by clean path
+func NewFilesystem(files []*ScanFile) *Filesystem {
+	filesystem := &Filesystem{Files: make(map[string]*ScanFile)}
+	for _, f := range files {
+		filesystem.Files[CleanPath(f.Path)] = f
+	}
+	return filesystem
+}
+
+// Resolve follows symlinks in every component of a path, returning the final path, the symlinks
+// traversed on the way, and whether the final path exists
+func (filesystem *Filesystem) Resolve(pth string) (string, []string, bool) {
+	var links []string
+	parts := splitPath(pth)
+	hops := 0
+	for i := 0; i < len(parts); i++ {
+		if parts[i] == "." || parts[i] == ".." {
+			j := i
+			if parts[i] == ".." && i > 0 {
+				j = i - 1
+			}
+			parts = append(parts[:j:j], parts[i+1:]...)
+			i = j - 1
+			continue
+		}
+		subPath := "/" + strings.Join(parts[:i+1], "/")
+		f, ok := filesystem.Files[subPath]
+		if !ok {
+			// parent directories are not always present as entries in layer tarballs
+			if i < len(parts)-1 {
+				continue
+			}
+			return "/" + strings.Join(parts, "/"), links, false
+		}
+		if f.Mode&fs.ModeSymlink == 0 {
+			continue
+		}
+		hops++
+		if hops > 40 {
+			return subPath, links, false
+		}
+		links = append(links, subPath)
+		target := f.LinkTarget
+		if !strings.HasPrefix(target, "/") {
+			target = path.Join(path.Dir(subPath), target)
+		}
+		parts = append(splitPath(path.Clean(target)), parts[i+1:]...)
+		i = -1
+	}
+	return "/" + strings.Join(parts, "/"), links, true
+}
+
+// Lookup resolves a path and returns the file it points to
+func (filesystem *Filesystem) Lookup(pth string) (*ScanFile, bool) {
+	final, _, ok := filesystem.Resolve(pth)
+	if !ok {
+		return nil, false
+	}
+	f, ok := filesystem.Files[final]
+	return f, ok
+}
+
+// ScanFileHeader creates a tar header for a directory or link from scanned metadata
+func ScanFileHeader(f *ScanFile) *tar.Header {
+	mode := int64(f.Mode.Perm())
+	if f.Mode&fs.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if f.Mode&fs.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if f.Mode&fs.ModeSticky != 0 {
+		mode |= 01000
+	}
+	header := &tar.Header{
+		Name:    strings.TrimPrefix(f.Path, "/"),
+		Mode:    mode,
+		Uid:     f.Uid,
+		Gid:     f.Gid,
+		ModTime: f.ModTime,
+	}
+	switch {
+	case f.Mode.IsDir():
+		header.Typeflag = tar.TypeDir
+		if !strings.HasSuffix(header.Name, "/") {
+			header.Name += "/"
+		}
+	case f.Mode&fs.ModeSymlink != 0:
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = f.LinkTarget
+	case f.LinkTarget != "":
+		header.Typeflag = tar.TypeLink
+		header.Linkname = strings.TrimPrefix(f.LinkTarget, "/")
+	default:
+		header.Typeflag = tar.TypeReg
+		header.Size = f.Size
+	}
+	return header
+}
+
+type AncestorDirs struct {
+	filesystem *Filesystem
+	written    map[string]bool
+}
+
+// NewAncestorDirs tracks the directories written to one output tarball
+func NewAncestorDirs(filesystem *Filesystem) *AncestorDirs {
+	return &AncestorDirs{
+		filesystem: filesystem,
+		written:    make(map[string]bool),
+	}
+}
+
+// Mark records a directory written from its original tar entry
+func (dirs *AncestorDirs) Mark(pth string) {
+	dirs.written[CleanPath(pth)] = true
+}
+
+// Write writes every ancestor directory of a path not yet in the tarball, from the root down, with the
+// mode, owner and mtime of the directory in the final view of the image. ancestors missing from the
+// image, or which are not directories there, are left to be created implicitly.
+func (dirs *AncestorDirs) Write(tw *tar.Writer, pth string) error {
+	parts := splitPath(CleanPath(pth))
+	for i := 1; i < len(parts); i++ {
+		dir := "/" + strings.Join(parts[:i], "/")
+		if dirs.written[dir] {
+			continue
+		}
+		dirs.written[dir] = true
+		f, ok := dirs.filesystem.Files[dir]
+		if !ok || !f.Mode.IsDir() {
+			continue
+		}
+		err := tw.WriteHeader(ScanFileHeader(f))
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+	}
+	return nil
+}
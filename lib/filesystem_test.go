@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+func TestAncestorDirs(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	filesystem := NewFilesystem([]*ScanFile{
+		{Path: "/home/", Mode: fs.ModeDir | 0755, ModTime: mtime},
+		{Path: "/home/app/", Mode: fs.ModeDir | 0700, Uid: 1000, Gid: 1000, ModTime: mtime},
+		{Path: "/home/app/.config", Mode: 0600, Uid: 1000, Gid: 1000},
+		{Path: "/var/run/postgresql/", Mode: fs.ModeDir | fs.ModeSetgid | 0775, Uid: 70, Gid: 70, ModTime: mtime},
+		{Path: "/var/run/postgresql/.s.PGSQL.5432.lock", Mode: 0600},
+		{Path: "/tmp/", Mode: fs.ModeDir | fs.ModeSticky | 0777, ModTime: mtime},
+		{Path: "/tmp/x", Mode: 0644},
+		{Path: "/lib", Mode: fs.ModeSymlink | 0777, LinkTarget: "usr/lib"},
+	})
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	dirs := NewAncestorDirs(filesystem)
+	dirs.Mark("/tmp/")
+	for _, p := range []string{"/home/app/.config", "/home/app/.profile", "/var/run/postgresql/.s.PGSQL.5432.lock", "/tmp/x", "/lib/libc.so.6"} {
+		err := dirs.Write(tw, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type entry struct {
+		name     string
+		mode     int64
+		uid, gid int
+	}
+	var entries []entry
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag != tar.TypeDir || !header.ModTime.Equal(mtime) {
+			t.Fatal("bad header", header)
+		}
+		entries = append(entries, entry{header.Name, header.Mode, header.Uid, header.Gid})
+	}
+	expected := []entry{
+		{"home/", 0755, 0, 0},
+		{"home/app/", 0700, 1000, 1000},
+		{"var/run/postgresql/", 02775, 70, 70},
+	}
+	if len(entries) != len(expected) {
+		t.Fatal("bad entries", entries)
+	}
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Fatal("bad entries", entries)
+		}
+	}
+}
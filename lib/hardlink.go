@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+)
+
+// IsHardLink is true for scanned hard links, which unlike symlinks have no mode type bits
+func IsHardLink(f *ScanFile) bool {
+	return f.LinkTarget != "" && f.Mode&fs.ModeSymlink == 0
+}
+
+// HardLinks makes every kept hard link extractable. Unless copy is set, the target of each link is
+// kept. Links whose target is not kept, or whose target in the final view is not the file from the
+// layer of the link, are returned mapped to their target so they can be written as regular files.
+func HardLinks(filesystem *Filesystem, paths map[string]string, copy bool) map[string]string {
+	var links []string
+	for p := range paths {
+		f, ok := filesystem.Files[p]
+		if ok && IsHardLink(f) {
+			links = append(links, p)
+		}
+	}
+	sort.Strings(links)
+	copies := make(map[string]string)
+	for _, p := range links {
+		f := filesystem.Files[p]
+		target := CleanPath(f.LinkTarget)
+		targetFile, ok := filesystem.Files[target]
+		sameLayer := ok && targetFile.LayerIndex == f.LayerIndex
+		if !copy && sameLayer {
+			_, ok := paths[target]
+			if !ok {
+				paths[target] = "hard link target of " + p
+			}
+		}
+		_, kept := paths[target]
+		if !kept || !sameLayer {
+			copies[p] = target
+		}
+	}
+	return copies
+}
+
+type HardLinkBuffer struct {
+	copies   map[string]string
+	targets  map[string]bool
+	contents map[string][]byte
+}
+
+// NewHardLinkBuffer prepares to copy the targets of the given links while a layer is streamed
+func NewHardLinkBuffer(copies map[string]string, links []string) *HardLinkBuffer {
+	buffer := &HardLinkBuffer{
+		copies:   make(map[string]string),
+		targets:  make(map[string]bool),
+		contents: make(map[string][]byte),
+	}
+	for _, link := range links {
+		target, ok := copies[link]
+		if ok {
+			buffer.copies[link] = target
+			buffer.targets[target] = true
+		}
+	}
+	return buffer
+}
+
+// Entry is called for every entry of a layer in order. It buffers the content of targets needed
+// later, and turns links to be copied into regular files, returning the header and body to write.
+func (buffer *HardLinkBuffer) Entry(pth string, header *tar.Header, r io.Reader) (*tar.Header, io.Reader, error) {
+	if buffer.targets[pth] {
+		switch header.Typeflag {
+		case tar.TypeReg:
+			data, err := io.ReadAll(r)
+			if err != nil {
+				Logger.Println("error:", err)
+				return nil, nil, err
+			}
+			buffer.contents[pth] = data
+			r = bytes.NewReader(data)
+		case tar.TypeLink:
+			data, ok := buffer.contents[CleanPath("/"+header.Linkname)]
+			if ok {
+				buffer.contents[pth] = data
+			}
+		}
+	}
+	target, ok := buffer.copies[pth]
+	if !ok || header.Typeflag != tar.TypeLink {
+		return header, r, nil
+	}
+	data, ok := buffer.contents[target]
+	if !ok {
+		err := fmt.Errorf("hard link target not found before link in layer: %s => %s", pth, target)
+		Logger.Println("error:", err)
+		return nil, nil, err
+	}
+	copied := *header
+	copied.Typeflag = tar.TypeReg
+	copied.Linkname = ""
+	copied.Size = int64(len(data))
+	return &copied, bytes.NewReader(data), nil
+}
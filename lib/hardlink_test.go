@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// hardLinkWrite filters a layer the way minify does, returning the written entries as name to content
+// or link target
+func hardLinkWrite(t *testing.T, layer []byte, include map[string]string, copies map[string]string) map[string]string {
+	var links []string
+	for link := range copies {
+		links = append(links, link)
+	}
+	sort.Strings(links)
+	buffer := NewHardLinkBuffer(copies, links)
+	var out bytes.Buffer
+	tw := tar.NewWriter(&out)
+	tr := tar.NewReader(bytes.NewReader(layer))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		pth := CleanPath("/" + header.Name)
+		header, body, err := buffer.Entry(pth, header, tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ok := include[pth]
+		if !ok {
+			continue
+		}
+		err = tw.WriteHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(tw, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]string)
+	tr = tar.NewReader(&out)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeLink {
+			result[header.Name] = "link:" + header.Linkname
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result[header.Name] = string(data)
+	}
+	return result
+}
+
+func hardLinkFilesystem(t *testing.T, layers ...[]testEntry) *Filesystem {
+	files, _, err := Scan(context.Background(), "test:latest", writeTestImage(t, layers...), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewFilesystem(files)
+}
+
+func TestHardLinksInclude(t *testing.T) {
+	layer := []testEntry{
+		testDir("usr/bin/"),
+		testFile("usr/bin/perl5.36", "perl"),
+		testHardlink("usr/bin/perl", "usr/bin/perl5.36"),
+		testFile("usr/bin/other", "other"),
+	}
+	filesystem := hardLinkFilesystem(t, layer)
+	paths := map[string]string{"/usr/bin/perl": "trace"}
+	copies := HardLinks(filesystem, paths, false)
+	if len(copies) != 0 {
+		t.Fatal("bad copies", copies)
+	}
+	if paths["/usr/bin/perl5.36"] != "hard link target of /usr/bin/perl" {
+		t.Fatal("target not kept", paths)
+	}
+	result := hardLinkWrite(t, testTar(layer), paths, copies)
+	expected := map[string]string{"usr/bin/perl5.36": "perl", "usr/bin/perl": "link:usr/bin/perl5.36"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatal("bad layer", result)
+	}
+}
+
+func TestHardLinksCopy(t *testing.T) {
+	layer := []testEntry{
+		testDir("usr/bin/"),
+		testFile("usr/bin/perl5.36", "perl"),
+		testHardlink("usr/bin/perl", "usr/bin/perl5.36"),
+		testHardlink("usr/bin/perl-alias", "usr/bin/perl"),
+	}
+	filesystem := hardLinkFilesystem(t, layer)
+	paths := map[string]string{"/usr/bin/perl": "trace", "/usr/bin/perl-alias": "trace"}
+	copies := HardLinks(filesystem, paths, true)
+	// the alias links to a kept path which is written as a regular file, so it stays a link
+	expectedCopies := map[string]string{"/usr/bin/perl": "/usr/bin/perl5.36"}
+	if !reflect.DeepEqual(copies, expectedCopies) {
+		t.Fatal("bad copies", copies)
+	}
+	_, ok := paths["/usr/bin/perl5.36"]
+	if ok {
+		t.Fatal("target should not be kept", paths)
+	}
+	result := hardLinkWrite(t, testTar(layer), paths, copies)
+	expected := map[string]string{"usr/bin/perl": "perl", "usr/bin/perl-alias": "link:usr/bin/perl"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatal("bad layer", result)
+	}
+}
+
+func TestHardLinksTargetReplaced(t *testing.T) {
+	lower := []testEntry{
+		testDir("etc/"),
+		testFile("etc/a", "original"),
+		testHardlink("etc/b", "etc/a"),
+	}
+	upper := []testEntry{
+		testFile("etc/a", "replaced"),
+	}
+	filesystem := hardLinkFilesystem(t, lower, upper)
+	paths := map[string]string{"/etc/b": "trace"}
+	copies := HardLinks(filesystem, paths, false)
+	if !reflect.DeepEqual(copies, map[string]string{"/etc/b": "/etc/a"}) {
+		t.Fatal("bad copies", copies)
+	}
+	result := hardLinkWrite(t, testTar(lower), paths, copies)
+	if !reflect.DeepEqual(result, map[string]string{"etc/b": "original"}) {
+		t.Fatal("bad layer", result)
+	}
+}
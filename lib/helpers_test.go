@@ -0,0 +1,286 @@
+package lib
+
+// test helpers shared by test files, which the Makefile runs one file at a time
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testEntry struct {
+	name     string
+	typeflag byte
+	data     string
+	linkname string
+	mode     int64
+}
+
+func testDir(name string) testEntry {
+	return testEntry{name: name, typeflag: tar.TypeDir, mode: 0755}
+}
+
+func testFile(name, data string) testEntry {
+	return testEntry{name: name, typeflag: tar.TypeReg, data: data, mode: 0644}
+}
+
+func testSymlink(name, linkname string) testEntry {
+	return testEntry{name: name, typeflag: tar.TypeSymlink, linkname: linkname, mode: 0777}
+}
+
+func testHardlink(name, linkname string) testEntry {
+	return testEntry{name: name, typeflag: tar.TypeLink, linkname: linkname, mode: 0644}
+}
+
+func testTar(entries []testEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     e.mode,
+			Size:     int64(len(e.data)),
+			ModTime:  time.Unix(1600000000, 0),
+		}
+		err := tw.WriteHeader(header)
+		if err != nil {
+			panic(err)
+		}
+		_, err = tw.Write([]byte(e.data))
+		if err != nil {
+			panic(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// writeTestImage writes a tarball in the docker save format with one layer per slice of entries
+func writeTestImage(t *testing.T, layers ...[]testEntry) string {
+	dir := t.TempDir()
+	var entries []testEntry
+	manifest := Manifest{Config: "config.json", RepoTags: []string{"test:latest"}}
+	for i, layer := range layers {
+		name := fmt.Sprintf("layer%02d/layer.tar", i)
+		manifest.Layers = append(manifest.Layers, name)
+		entries = append(entries, testFile(name, string(testTar(layer))))
+	}
+	data, err := json.Marshal([]Manifest{manifest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries = append(entries, testFile("manifest.json", string(data)))
+	entries = append(entries, testFile("config.json", `{"config": {"Env": ["PATH=/usr/bin:/bin"]}, "history": []}`))
+	tarball := path.Join(dir, "image.tar")
+	err = os.WriteFile(tarball, testTar(entries), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tarball
+}
+
+// testOCIWriteLayer gzips a layer tarball into the blobs of an oci image layout
+func testOCIWriteLayer(dir string, layerTar string) (OCIDescriptor, string, error) {
+	r, err := os.Open(layerTar)
+	if err != nil {
+		return OCIDescriptor{}, "", err
+	}
+	defer func() { _ = r.Close() }()
+	w, err := OCICreateLayer(dir)
+	if err != nil {
+		return OCIDescriptor{}, "", err
+	}
+	_, err = io.Copy(w, r)
+	if err != nil {
+		_, _, _ = w.Finish()
+		return OCIDescriptor{}, "", err
+	}
+	return w.Finish()
+}
+
+// testOCIWriteImage writes an oci image layout with the given config and layer tarballs
+func testOCIWriteImage(dir string, ref string, sourceConfig []byte, layerTars []string) (OCIDescriptor, error) {
+	var layers []OCIDescriptor
+	var diffIDs []string
+	for _, layerTar := range layerTars {
+		desc, diffID, err := testOCIWriteLayer(dir, layerTar)
+		if err != nil {
+			return OCIDescriptor{}, err
+		}
+		layers = append(layers, desc)
+		diffIDs = append(diffIDs, diffID)
+	}
+	return OCIWriteManifest(dir, ref, sourceConfig, layers, diffIDs, nil)
+}
+
+func readJSON(t *testing.T, file string, val interface{}) []byte {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// testRegistry is an in memory registry implementing the parts of the distribution api used by
+// pull and push, behind a bearer token challenge
+type testRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	types     map[string]string
+	uploads   int
+}
+
+func newTestRegistry(t *testing.T) (*testRegistry, string) {
+	reg := &testRegistry{
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string][]byte),
+		types:     make(map[string]string),
+	}
+	server := httptest.NewServer(reg)
+	t.Cleanup(server.Close)
+	return reg, strings.TrimPrefix(server.URL, "http://")
+}
+
+func (reg *testRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if r.URL.Path == "/token" {
+		if r.URL.Query().Get("scope") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"token": "secret"}`))
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/"), "/")
+	switch {
+	case r.URL.Path == "/v2/":
+		return
+	case len(parts) >= 3 && parts[len(parts)-2] == "manifests":
+		key := strings.Join(parts[:len(parts)-2], "/") + "/" + parts[len(parts)-1]
+		if r.Method == http.MethodPut {
+			data, _ := io.ReadAll(r.Body)
+			reg.manifests[key] = data
+			reg.manifests[strings.Join(parts[:len(parts)-2], "/")+"/"+sha256Digest(data)] = data
+			reg.types[key] = r.Header.Get("Content-Type")
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		data, ok := reg.manifests[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", reg.types[key])
+		_, _ = w.Write(data)
+	case len(parts) >= 3 && parts[len(parts)-2] == "blobs":
+		data, ok := reg.blobs[parts[len(parts)-1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case len(parts) >= 3 && parts[len(parts)-2] == "uploads" && r.Method == http.MethodPost:
+		w.Header().Set("Location", r.URL.Path+"upload-id")
+		w.WriteHeader(http.StatusAccepted)
+	case len(parts) >= 3 && parts[len(parts)-2] == "uploads" && r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		digest := r.URL.Query().Get("digest")
+		if sha256Digest(data) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reg.blobs[digest] = data
+		reg.uploads++
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// testMultiPlatform writes an oci image layout with one image per platform, each with one file named
+// after its architecture
+func testMultiPlatform(t *testing.T, ref string, archs ...string) string {
+	dir := t.TempDir()
+	out := path.Join(dir, "oci")
+	var manifests []OCIDescriptor
+	for _, arch := range archs {
+		layerTar := path.Join(dir, arch+".tar")
+		err := os.WriteFile(layerTar, testTar([]testEntry{testFile(arch, arch)}), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc, diffID, err := testOCIWriteLayer(out, layerTar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest, err := OCIWriteImageManifest(out, []byte(`{"os": "linux", "architecture": "`+arch+`", "config": {}}`), []OCIDescriptor{desc}, []string{diffID}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifests = append(manifests, manifest)
+	}
+	_, err := OCIWriteMultiPlatform(out, ref, manifests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func testPlatformFiles(t *testing.T, archive *Archive) []string {
+	files, _, err := ScanArchive(archive, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.Path)
+	}
+	return paths
+}
+
+func testPackageFiles(files map[string]string, links map[string]string) *Filesystem {
+	var result []*ScanFile
+	for p, content := range files {
+		result = append(result, &ScanFile{Path: p, Mode: 0644, Size: int64(len(content)), Content: []byte(content)})
+	}
+	for p, target := range links {
+		result = append(result, &ScanFile{Path: p, Mode: fs.ModeSymlink | 0777, LinkTarget: target})
+	}
+	return NewFilesystem(result)
+}
@@ -0,0 +1,83 @@
+package lib
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type IterateRound struct {
+	Round   int
+	Added   []string
+	Closure int
+}
+
+// IterateMissing returns the paths a container failed to find that exist in the original image but
+// are not yet kept
+func IterateMissing(filesystem *Filesystem, paths map[string]string, container string, events []TraceEvent) []string {
+	seen := make(map[string]bool)
+	var missing []string
+	for _, event := range events {
+		if event.Container != container {
+			continue
+		}
+		p := CleanPath(event.Path)
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		_, ok := paths[p]
+		if ok {
+			continue
+		}
+		_, _, ok = filesystem.Resolve(p)
+		if !ok {
+			continue
+		}
+		missing = append(missing, p)
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// IterateTrace runs the verification workload against an image under the tracer, returning the
+// container id and every path it failed to find with ENOENT
+func IterateTrace(ctx context.Context, image string, opts VerifyOptions, rbPages int) (string, []TraceEvent, error) {
+	tracer, err := TracerStart(ctx, rbPages)
+	if err != nil {
+		Logger.Println("error:", err)
+		return "", nil, err
+	}
+	var events []TraceEvent
+	var runErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		// defer func() {}()
+		defer wg.Done()
+		runErr = tracer.Run(func(container string, file File) {
+			if file.Errno == ErrnoENOENT {
+				events = append(events, TraceEvent{Container: container, Path: file.File})
+			}
+		})
+	}()
+	id, _, err := VerifyRun(ctx, image, opts, verifySuccess(opts))
+	// give bpftrace a moment to flush events from the end of the run
+	time.Sleep(verifyInterval)
+	tracer.Close()
+	wg.Wait()
+	if id == "" {
+		Logger.Println("error:", err)
+		return "", nil, err
+	}
+	if err != nil {
+		// a failing probe is expected while files are still missing
+		Logger.Println("warning:", err)
+	}
+	if runErr != nil {
+		Logger.Println("error:", runErr)
+		return "", nil, runErr
+	}
+	return id, events, nil
+}
@@ -0,0 +1,31 @@
+package lib
+
+import (
+	"io/fs"
+	"reflect"
+	"testing"
+)
+
+func TestIterateMissing(t *testing.T) {
+	filesystem := NewFilesystem([]*ScanFile{
+		{Path: "/etc/ssl/certs/ca-certificates.crt"},
+		{Path: "/usr/share/zoneinfo/UTC"},
+		{Path: "/etc/localtime", Mode: fs.ModeSymlink | 0777, LinkTarget: "/usr/share/zoneinfo/UTC"},
+		{Path: "/usr/bin/app"},
+	})
+	paths := map[string]string{"/usr/bin/app": "trace"}
+	container := "a"
+	events := []TraceEvent{
+		{Container: container, Path: "/etc/ssl/certs/ca-certificates.crt"},
+		{Container: container, Path: "/etc/ssl/certs/ca-certificates.crt"},
+		{Container: container, Path: "/etc/localtime"},
+		{Container: container, Path: "/usr/bin/app"},
+		{Container: container, Path: "/usr/lib/libnotthere.so"},
+		{Container: "b", Path: "/usr/share/zoneinfo/UTC"},
+	}
+	missing := IterateMissing(filesystem, paths, container, events)
+	expected := []string{"/etc/localtime", "/etc/ssl/certs/ca-certificates.crt"}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Fatal("bad missing", missing)
+	}
+}
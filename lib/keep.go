@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"path"
+	"strings"
+)
+
+type KeepRule struct {
+	Pattern string
+	Exclude bool
+}
+
+// ParseKeepRule returns a rule for keep-list lines that are globs, directories ending in / or exclusions starting with !
+func ParseKeepRule(line string) (KeepRule, bool) {
+	rule := KeepRule{Pattern: line}
+	if strings.HasPrefix(rule.Pattern, "!") {
+		rule.Exclude = true
+		rule.Pattern = rule.Pattern[1:]
+	}
+	if strings.HasSuffix(rule.Pattern, "/") && rule.Pattern != "/" {
+		rule.Pattern = strings.TrimRight(rule.Pattern, "/") + "/**"
+	}
+	if !rule.Exclude && !strings.ContainsAny(rule.Pattern, "*?[") {
+		return KeepRule{}, false
+	}
+	rule.Pattern = "/" + strings.Trim(rule.Pattern, "/")
+	return rule, true
+}
+
+// Match tests a path against the rule, where ** matches zero or more path segments and exclusions without
+// glob characters also match everything below the excluded path
+func (r KeepRule) Match(pth string) bool {
+	pattern := r.Pattern
+	if r.Exclude && !strings.ContainsAny(pattern, "*?[") {
+		pattern += "/**"
+	}
+	return matchSegments(splitPath(pattern), splitPath(CleanPath(pth)))
+}
+
+func splitPath(pth string) []string {
+	pth = strings.Trim(pth, "/")
+	if pth == "" {
+		return nil
+	}
+	return strings.Split(pth, "/")
+}
+
+func matchSegments(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if matchSegments(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	ok, err := path.Match(pattern[0], parts[0])
+	if err != nil || !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], parts[1:])
+}
+
+// CleanPath normalizes paths from layer tarballs, which may contain /./ and trailing slashes on directories
+func CleanPath(pth string) string {
+	pth = strings.ReplaceAll(pth, "/./", "/")
+	if pth != "/" {
+		pth = strings.TrimRight(pth, "/")
+	}
+	return pth
+}
+
+// KeepRulesApply adds every scanned path matching an include rule to paths, then removes every path matching an exclude rule
+func KeepRulesApply(rules []KeepRule, files []*ScanFile, paths map[string]string) {
+	for _, rule := range rules {
+		if rule.Exclude {
+			continue
+		}
+		for _, f := range files {
+			_, ok := paths[CleanPath(f.Path)]
+			if !ok && rule.Match(f.Path) {
+				paths[CleanPath(f.Path)] = "rule " + rule.Pattern
+			}
+		}
+	}
+	for _, rule := range rules {
+		if !rule.Exclude {
+			continue
+		}
+		for p := range paths {
+			if rule.Match(p) {
+				delete(paths, p)
+			}
+		}
+	}
+}
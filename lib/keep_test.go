@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestKeepRuleMatch(t *testing.T) {
+	type testCase struct {
+		line  string
+		path  string
+		match bool
+	}
+	for _, c := range []testCase{
+		{"/usr/share/zoneinfo/**", "/usr/share/zoneinfo", true},
+		{"/usr/share/zoneinfo/**", "/usr/share/zoneinfo/Europe/Berlin", true},
+		{"/usr/share/zoneinfo/**", "/usr/share/zoneinfo.txt", false},
+		{"/usr/share/locale/", "/usr/share/locale/en/LC_MESSAGES/x.mo", true},
+		{"/usr/share/locale/", "/usr/share/locale/", true},
+		{"/usr/lib/*.so", "/usr/lib/libc.so", true},
+		{"/usr/lib/*.so", "/usr/lib/x86_64/libc.so", false},
+		{"/**/plugins/*.so", "/opt/app/plugins/a.so", true},
+		{"/etc/ssl/cert?.pem", "/./etc/ssl/cert1.pem", true},
+		{"!/usr/share/doc", "/usr/share/doc/bash/README", true},
+		{"!/usr/share/doc", "/usr/share/docs", false},
+		{"!/**/*.pyc", "/usr/lib/python3/x.pyc", true},
+	} {
+		rule, ok := ParseKeepRule(c.line)
+		if !ok {
+			t.Errorf("not a rule: %s", c.line)
+			continue
+		}
+		if rule.Match(c.path) != c.match {
+			t.Errorf("%s %s expected match=%v", c.line, c.path, c.match)
+		}
+	}
+	_, ok := ParseKeepRule("/etc/hosts")
+	if ok {
+		t.Error("plain paths are not rules")
+	}
+}
+
+func TestKeepRulesApply(t *testing.T) {
+	var files []*ScanFile
+	for _, p := range []string{"/etc/", "/etc/hosts", "/usr/share/zoneinfo/", "/usr/share/zoneinfo/UTC", "/usr/share/zoneinfo/right/", "/usr/share/zoneinfo/right/UTC"} {
+		files = append(files, &ScanFile{Path: p})
+	}
+	var rules []KeepRule
+	for _, line := range []string{"/usr/share/zoneinfo/", "!/usr/share/zoneinfo/right"} {
+		rule, _ := ParseKeepRule(line)
+		rules = append(rules, rule)
+	}
+	paths := map[string]string{"/etc/hosts": "trace"}
+	KeepRulesApply(rules, files, paths)
+	var result []string
+	for p := range paths {
+		result = append(result, p)
+	}
+	sort.Strings(result)
+	expected := []string{"/etc/hosts", "/usr/share/zoneinfo", "/usr/share/zoneinfo/UTC"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("%v != %v", result, expected)
+	}
+}
+
+func TestTraceKeeperContainers(t *testing.T) {
+	ctx := context.Background()
+	image := &MinifyImage{Archive: &Archive{Config: []byte(`{}`)}}
+	keeper := &TraceKeeper{
+		Events: []TraceEvent{{Container: "abc", Path: "/bin/sh"}, {Path: "/etc/passwd"}},
+		Image:  "oci:/tmp/app",
+	}
+	_, err := keeper.Keep(ctx, image)
+	if err == nil {
+		t.Fatal("traces of containers kept without docker to match them to the image")
+	}
+	keeper.AnyContainer = true
+	paths, err := keeper.Keep(ctx, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, map[string]string{"/bin/sh": "trace", "/etc/passwd": "trace"}) {
+		t.Fatal("bad paths", paths)
+	}
+	keeper = &TraceKeeper{Events: []TraceEvent{{Path: "/etc/passwd"}}, Image: "oci:/tmp/app"}
+	_, err = keeper.Keep(ctx, image)
+	if err != nil {
+		t.Fatal("path lists do not need docker", err)
+	}
+}
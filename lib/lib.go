@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"debug/elf"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -19,12 +20,12 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unicode/utf8"
 
 	"github.com/avast/retry-go"
-	"github.com/docker/docker/client"
 	"github.com/mattn/go-isatty"
 )
 
@@ -36,15 +37,18 @@ func Atoi(x string) int {
 	return y
 }
 
-func DataDir() string {
-	dir := fmt.Sprintf("%s/.docker-trace", os.Getenv("HOME"))
-	if !Exists(dir) {
-		err := os.Mkdir(dir, os.ModePerm)
-		if err != nil {
-			panic(err)
-		}
+// DataDir is ~/.docker-trace, or DOCKER_TRACE_DATA_DIR when set, created when missing
+func DataDir() (string, error) {
+	dir := os.Getenv("DOCKER_TRACE_DATA_DIR")
+	if dir == "" {
+		dir = fmt.Sprintf("%s/.docker-trace", os.Getenv("HOME"))
+	}
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		Logger.Println("error:", err)
+		return "", err
 	}
-	return dir
+	return dir, nil
 }
 
 var Commands = make(map[string]func())
@@ -65,8 +69,13 @@ type DockerfileHistory struct {
 	CreatedBy string `json:"created_by"`
 }
 
+type DockerfileRuntimeConfig struct {
+	Env []string `json:"Env"`
+}
+
 type DockerfileConfig struct {
-	History []DockerfileHistory `json:"history"`
+	History []DockerfileHistory     `json:"history"`
+	Config  DockerfileRuntimeConfig `json:"config"`
 }
 
 func SignalHandler(cancel func()) {
@@ -204,22 +213,24 @@ func FindManifest(manifests []Manifest, name string) (Manifest, error) {
 	if len(manifests) == 1 {
 		return manifests[0], nil
 	}
+	// find by imageID, the config is <id>.json before docker 25 and blobs/sha256/<id> after
 	for _, m := range manifests {
-		// find by imageID
-		if strings.HasPrefix(m.Config, name) {
+		id := strings.TrimSuffix(path.Base(m.Config), ".json")
+		if strings.HasPrefix(id, strings.TrimPrefix(name, "sha256:")) {
 			return m, nil
 		}
-		// find by tag
-		if strings.Contains(name, ":") {
-			for _, tag := range m.RepoTags {
-				if tag == name {
-					return m, nil
-				}
+	}
+	if !strings.Contains(name, ":") {
+		err := fmt.Errorf("name must include a tag or be an imageID, got: %s", name)
+		Logger.Println("error:", err)
+		return Manifest{}, err
+	}
+	// find by tag
+	for _, m := range manifests {
+		for _, tag := range m.RepoTags {
+			if tag == name {
+				return m, nil
 			}
-		} else {
-			err := fmt.Errorf("name must include a tag or be an imageID, got: %s", name)
-			Logger.Println("error:", err)
-			return Manifest{}, err
 		}
 	}
 	err := fmt.Errorf(Pformat(manifests) + "\ntag not found in manifest")
@@ -228,104 +239,238 @@ func FindManifest(manifests []Manifest, name string) (Manifest, error) {
 }
 
 func Scan(ctx context.Context, name string, tarball string, checkData bool) ([]*ScanFile, map[string]int, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv)
+	files, layers, err := scanImageLayers(ctx, name, tarball, checkData)
 	if err != nil {
 		Logger.Println("error:", err)
 		return nil, nil, err
 	}
-	var manifests []Manifest
-	var files []*ScanFile
-	var r io.ReadCloser
-	if tarball != "" {
-		r, err = os.Open(tarball)
-		if err != nil {
-			Logger.Println("error:", err)
-			return nil, nil, err
-		}
-	} else {
-		r, err = cli.ImageSave(ctx, []string{name})
+	// keep only last update to the file, not all updates across all layers
+	return ScanFinal(files), layers, nil
+}
+
+// ScanAllLayers is like Scan, but returns every copy of every path from every layer with its status
+func ScanAllLayers(ctx context.Context, name string, tarball string, checkData bool) ([]*ScanFile, error) {
+	files, _, err := scanImageLayers(ctx, name, tarball, checkData)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return ScanHistory(files), nil
+}
+
+// scanImageLayers streams images in docker through one pass of docker save, since there is nothing to
+// index on disk, and scans tarballs, oci layouts and registry images in parallel
+func scanImageLayers(ctx context.Context, name string, tarball string, checkData bool) ([]*ScanFile, map[string]int, error) {
+	if tarball != "" || !IsDockerRef(name) {
+		archive, closeArchive, err := archiveOpenImage(ctx, name, tarball)
 		if err != nil {
 			Logger.Println("error:", err)
 			return nil, nil, err
 		}
+		defer closeArchive()
+		return ScanArchiveLayers(archive, checkData)
+	}
+	r, err := imageSave(ctx, name)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, nil, err
 	}
 	defer func() { _ = r.Close() }()
-	tr := tar.NewReader(r)
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
+	return ScanStream(r, name, checkData)
+}
+
+// ScanStream scans an image tarball in one pass, like the output of docker save, and returns the files
+// of every layer in layer order
+func ScanStream(r io.Reader, name string, checkData bool) ([]*ScanFile, map[string]int, error) {
+	scanned := make(map[string][]*ScanFile)
+	archive, err := ArchiveStream(r, name, func(layer string, r io.Reader) error {
+		files, err := ScanLayer(layer, r, checkData)
+		if err != nil {
+			return err
 		}
+		scanned[layer] = files
+		return nil
+	})
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, nil, err
+	}
+	//
+	var files []*ScanFile
+	used := make(map[string]bool)
+	for i, layer := range archive.Manifest.Layers {
+		entry, err := archive.Resolve(layer)
 		if err != nil {
 			Logger.Println("error:", err)
 			return nil, nil, err
 		}
-		if header == nil {
-			continue
+		layerFiles, ok := scanned[entry]
+		if !ok {
+			err := fmt.Errorf("layer not found in image tarball: %s", layer)
+			Logger.Println("error:", err)
+			return nil, nil, err
 		}
-		switch header.Typeflag {
-		case tar.TypeReg:
-			if path.Base(header.Name) == "layer.tar" {
-				layerFiles, err := ScanLayer(header.Name, tr, checkData)
-				if err != nil {
-					Logger.Println("error:", err)
-					return nil, nil, err
-				}
-				files = append(files, layerFiles...)
-			} else if header.Name == "manifest.json" {
-				var data bytes.Buffer
-				_, err := io.Copy(&data, tr)
-				if err != nil {
-					Logger.Println("error:", err)
-					return nil, nil, err
-				}
-				err = json.Unmarshal(data.Bytes(), &manifests)
-				if err != nil {
-					Logger.Println("error:", err)
-					return nil, nil, err
-				}
+		for _, f := range layerFiles {
+			// a layer listed twice in the manifest needs its own copies of the files
+			if used[entry] {
+				copied := *f
+				f = &copied
 			}
+			f.LayerIndex = i
+			f.Layer = ""
+			files = append(files, f)
 		}
+		used[entry] = true
 	}
+	return files, archive.Layers, nil
+}
 
-	manifest, err := FindManifest(manifests, name)
+// ScanArchive scans every layer of an indexed image tarball in parallel and returns the final
+// filesystem view
+func ScanArchive(archive *Archive, checkData bool) ([]*ScanFile, map[string]int, error) {
+	files, layers, err := ScanArchiveLayers(archive, checkData)
 	if err != nil {
 		Logger.Println("error:", err)
 		return nil, nil, err
 	}
+	// keep only last update to the file, not all updates across all layers
+	result := ScanFinal(files)
+	return result, layers, nil
+}
 
-	layers := make(map[string]int)
-	for i, layer := range manifest.Layers {
-		layers[layer] = i
+// ScanArchiveLayers scans every layer of an indexed image tarball in parallel and returns the files of
+// every layer in layer order
+func ScanArchiveLayers(archive *Archive, checkData bool) ([]*ScanFile, map[string]int, error) {
+	layerFiles := make([][]*ScanFile, len(archive.Manifest.Layers))
+	errs := make([]error, len(archive.Manifest.Layers))
+	sem := make(chan struct{}, runtime.NumCPU())
+	var wg sync.WaitGroup
+	for i, layer := range archive.Manifest.Layers {
+		wg.Add(1)
+		go func(i int, layer string) {
+			// defer func() {}()
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			r, err := archive.Layer(layer)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer func() { _ = r.Close() }()
+			layerFiles[i], errs[i] = ScanLayer(layer, r, checkData)
+		}(i, layer)
 	}
-
-	for _, f := range files {
-		i, ok := layers[f.Layer]
-		if !ok {
-			err := fmt.Errorf("error: no layer %s", f.Layer)
-			Logger.Println("error:", err)
-			return nil, nil, err
+	wg.Wait()
+	var files []*ScanFile
+	for i := range layerFiles {
+		if errs[i] != nil {
+			Logger.Println("error:", errs[i])
+			return nil, nil, errs[i]
 		}
-		f.LayerIndex = i
-		f.Layer = ""
+		for _, f := range layerFiles[i] {
+			f.LayerIndex = i
+			f.Layer = ""
+		}
+		files = append(files, layerFiles[i]...)
 	}
+	return files, archive.Layers, nil
+}
 
-	sort.Slice(files, func(i, j int) bool { return files[i].LayerIndex < files[j].LayerIndex })
-	sort.SliceStable(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+const (
+	WhiteoutPrefix = ".wh."
+	WhiteoutOpaque = ".wh..wh..opq"
+)
 
-	// keep only last update to the file, not all updates across all layers
+// statuses of each copy of a path, set by ScanHistory
+const (
+	ScanKept        = "kept"        // in the final filesystem
+	ScanOverwritten = "overwritten" // replaced by the same path in a later layer
+	ScanDeleted     = "deleted"     // removed by a whiteout of the path or a parent directory
+	ScanShadowed    = "shadowed"    // hidden by an opaque directory or a parent directory replaced by a file
+	ScanWhiteout    = "whiteout"
+	ScanOpaque      = "opaque"
+)
+
+// ScanFinal applies layers in order to compute the final filesystem, where whiteouts and opaque
+// directories delete paths from lower layers and a non-directory replacing a directory hides its contents
+func ScanFinal(files []*ScanFile) []*ScanFile {
 	var result []*ScanFile
-	var last *ScanFile
-	for _, f := range files {
-		if last != nil && f.Path != last.Path {
-			result = append(result, last)
+	for _, f := range ScanHistory(files) {
+		if f.Status == ScanKept {
+			result = append(result, f)
 		}
-		last = f
 	}
-	if last.Path != result[len(result)-1].Path {
-		result = append(result, last)
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result
+}
+
+// ScanHistory applies layers in order like ScanFinal, setting the status of every file, and returns
+// every file sorted by path then layer
+func ScanHistory(files []*ScanFile) []*ScanFile {
+	sort.SliceStable(files, func(i, j int) bool { return files[i].LayerIndex < files[j].LayerIndex })
+	final := make(map[string]*ScanFile)
+	for start := 0; start < len(files); {
+		end := start
+		for end < len(files) && files[end].LayerIndex == files[start].LayerIndex {
+			end++
+		}
+		layerFiles := files[start:end]
+		start = end
+		deleted := make(map[string]bool)
+		hidden := make(map[string]bool)
+		for _, f := range layerFiles {
+			p := CleanPath(f.Path)
+			if f.Opaque {
+				hidden[p] = true
+			} else if f.Whiteout {
+				deleted[p] = true
+			} else if existing, ok := final[p]; ok && existing.Mode.IsDir() && !f.Mode.IsDir() {
+				hidden[p] = true
+			}
+		}
+		if len(deleted) > 0 || len(hidden) > 0 {
+			for p, f := range final {
+				if deleted[p] {
+					f.Status = ScanDeleted
+					delete(final, p)
+					continue
+				}
+				for dir := path.Dir(p); ; dir = path.Dir(dir) {
+					if deleted[dir] || hidden[dir] {
+						f.Status = ScanShadowed
+						if deleted[dir] {
+							f.Status = ScanDeleted
+						}
+						delete(final, p)
+						break
+					}
+					if dir == "/" {
+						break
+					}
+				}
+			}
+		}
+		for _, f := range layerFiles {
+			p := CleanPath(f.Path)
+			switch {
+			case f.Opaque:
+				f.Status = ScanOpaque
+			case f.Whiteout:
+				f.Status = ScanWhiteout
+			default:
+				existing, ok := final[p]
+				if ok {
+					existing.Status = ScanOverwritten
+				}
+				f.Status = ScanKept
+				final[p] = f
+			}
+		}
 	}
-	return result, layers, nil
+	result := append([]*ScanFile{}, files...)
+	sort.SliceStable(result, func(i, j int) bool { return CleanPath(result[i].Path) < CleanPath(result[j].Path) })
+	return result
 }
 
 type ScanFile struct {
@@ -340,6 +485,12 @@ type ScanFile struct {
 	ContentType string
 	Uid         int
 	Gid         int
+	Elf         *ElfInfo
+	Shebang     string
+	Whiteout    bool
+	Opaque      bool
+	Status      string // set by ScanHistory
+	Content     []byte // only for small config files needed by minify, see ScanContentPath
 }
 
 func ScanLayer(layer string, r io.Reader, checkData bool) ([]*ScanFile, error) {
@@ -357,23 +508,73 @@ func ScanLayer(layer string, r io.Reader, checkData bool) ([]*ScanFile, error) {
 		if header == nil {
 			continue
 		}
+		// whiteouts delete a path, or with the opaque marker all contents of a directory, from lower layers
+		name := path.Base(header.Name)
+		if name == WhiteoutOpaque {
+			result = append(result, &ScanFile{
+				Layer:    layer,
+				Path:     "/" + path.Dir(header.Name) + "/",
+				ModTime:  header.ModTime,
+				Whiteout: true,
+				Opaque:   true,
+			})
+			continue
+		}
+		if strings.HasPrefix(name, WhiteoutPrefix) {
+			result = append(result, &ScanFile{
+				Layer:    layer,
+				Path:     "/" + path.Join(path.Dir(header.Name), strings.TrimPrefix(name, WhiteoutPrefix)),
+				ModTime:  header.ModTime,
+				Whiteout: true,
+			})
+			continue
+		}
 		switch header.Typeflag {
 		case tar.TypeReg:
-			var data bytes.Buffer
+			var head bytes.Buffer
 			contentType := ""
 			hash := ""
+			// read enough to check for elf magic and shebang lines, then stream the rest only when needed
+			_, err := io.CopyN(&head, tr, scanHeadSize)
+			if err != nil && err != io.EOF {
+				Logger.Println("error:", err)
+				return nil, err
+			}
+			err = nil
+			isElf := bytes.HasPrefix(head.Bytes(), []byte(elf.ELFMAG))
+			shebang := ScanShebang(head.Bytes())
+			isContent := ScanContentPath(CleanPath("/" + header.Name))
+			hasher := sha256.New()
+			validator := &scanUTF8{}
+			var sinks []io.Writer
 			if checkData {
-				_, err := io.Copy(&data, tr)
-				if err != nil {
-					Logger.Println("error:", err)
-					return nil, err
+				sinks = append(sinks, hasher, validator)
+			}
+			data := io.TeeReader(io.MultiReader(bytes.NewReader(head.Bytes()), tr), io.MultiWriter(sinks...))
+			var elfInfo *ElfInfo
+			var content []byte
+			switch {
+			case isContent:
+				content, err = io.ReadAll(data)
+				if err == nil && isElf {
+					elfInfo = ScanElf(bytes.NewReader(content))
 				}
+			case isElf:
+				elfInfo, err = scanElfStream(data, header.Size)
+			case checkData:
+				_, err = io.Copy(io.Discard, data)
+			default:
+			}
+			if err != nil {
+				Logger.Println("error:", err)
+				return nil, err
+			}
+			if checkData {
 				contentType = "binary"
-				if utf8.Valid(data.Bytes()) {
+				if validator.Valid() {
 					contentType = "utf8"
 				}
-				sum := sha256.Sum256(data.Bytes())
-				hash = hex.EncodeToString(sum[:])
+				hash = hex.EncodeToString(hasher.Sum(nil))
 			}
 			result = append(result, &ScanFile{
 				Layer:       layer,
@@ -385,6 +586,9 @@ func ScanLayer(layer string, r io.Reader, checkData bool) ([]*ScanFile, error) {
 				ContentType: contentType,
 				Uid:         header.Uid,
 				Gid:         header.Gid,
+				Elf:         elfInfo,
+				Shebang:     shebang,
+				Content:     content,
 			})
 		case tar.TypeSymlink:
 			result = append(result, &ScanFile{
@@ -422,84 +626,93 @@ func ScanLayer(layer string, r io.Reader, checkData bool) ([]*ScanFile, error) {
 	return result, nil
 }
 
-func Dockerfile(ctx context.Context, name string, tarball string) ([]string, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		Logger.Println("error:", err)
-		return nil, err
-	}
-	var manifests []Manifest
-	configs := make(map[string]*DockerfileConfig)
-	var r io.ReadCloser
-	if tarball != "" {
-		r, err = os.Open(tarball)
-		if err != nil {
-			Logger.Println("error:", err)
-			return nil, err
-		}
-	} else {
-		r, err = cli.ImageSave(ctx, []string{name})
+// scanElfMemory is the largest elf file read into memory, larger files are spooled to a temp file
+const scanElfMemory = 4 * 1024 * 1024
+
+// scanElfStream parses the headers of an elf file, reading only the parts it needs from a temp file
+// when the file is large
+func scanElfStream(r io.Reader, size int64) (*ElfInfo, error) {
+	if size <= scanElfMemory {
+		data, err := io.ReadAll(r)
 		if err != nil {
 			Logger.Println("error:", err)
 			return nil, err
 		}
+		return ScanElf(bytes.NewReader(data)), nil
 	}
-	defer func() { _ = r.Close() }()
-	tr := tar.NewReader(r)
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			Logger.Println("error:", err)
-			return nil, err
-		}
-		if header == nil {
-			continue
-		}
-		switch header.Typeflag {
-		case tar.TypeReg:
-			if header.Name == "manifest.json" {
-				var data bytes.Buffer
-				_, err := io.Copy(&data, tr)
-				if err != nil {
-					Logger.Println("error:", err)
-					return nil, err
-				}
-				err = json.Unmarshal(data.Bytes(), &manifests)
-				if err != nil {
-					Logger.Println("error:", err)
-					return nil, err
-				}
-			} else if strings.HasSuffix(header.Name, ".json") {
-				var data bytes.Buffer
-				_, err := io.Copy(&data, tr)
-				if err != nil {
-					Logger.Println("error:", err)
-					return nil, err
-				}
-				config := DockerfileConfig{}
-				err = json.Unmarshal(data.Bytes(), &config)
-				if err != nil {
-					Logger.Println("error:", err)
-					return nil, err
-				}
-				configs[header.Name] = &config
+	f, err := os.CreateTemp("", "docker-trace-elf-")
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	_, err = io.Copy(f, r)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return ScanElf(f), nil
+}
+
+// scanUTF8 checks that written data is valid utf8, holding back a rune split across writes
+type scanUTF8 struct {
+	tail    []byte
+	invalid bool
+}
+
+func (v *scanUTF8) Write(p []byte) (int, error) {
+	if v.invalid {
+		return len(p), nil
+	}
+	data := append(v.tail, p...)
+	n := len(data)
+	for i := n - 1; i >= 0 && i >= n-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				n = i
 			}
-		default:
+			break
 		}
 	}
+	v.invalid = !utf8.Valid(data[:n])
+	v.tail = append([]byte{}, data[n:]...)
+	return len(p), nil
+}
+
+func (v *scanUTF8) Valid() bool {
+	return !v.invalid && len(v.tail) == 0
+}
+
+func ImageConfigRaw(ctx context.Context, name string, tarball string) ([]byte, error) {
+	archive, err := ImageStream(ctx, name, tarball, nil)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return archive.Config, nil
+}
 
-	manifest, err := FindManifest(manifests, name)
+func ImageConfig(ctx context.Context, name string, tarball string) (*DockerfileConfig, error) {
+	data, err := ImageConfigRaw(ctx, name, tarball)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	config := &DockerfileConfig{}
+	err = json.Unmarshal(data, config)
 	if err != nil {
 		Logger.Println("error:", err)
 		return nil, err
 	}
+	return config, nil
+}
 
-	config, ok := configs[manifest.Config]
-	if !ok {
-		err := fmt.Errorf("no such config: %s", manifest.Config)
+func Dockerfile(ctx context.Context, name string, tarball string) ([]string, error) {
+	config, err := ImageConfig(ctx, name, tarball)
+	if err != nil {
 		Logger.Println("error:", err)
 		return nil, err
 	}
@@ -546,6 +759,8 @@ type File struct {
 	File    string
 }
 
+const ErrnoENOENT = "2"
+
 func FilesParseLine(line string) File {
 	parts := strings.Split(line, "\t")
 	file := File{}
@@ -586,7 +801,9 @@ func last(xs []string) string {
 	return xs[len(xs)-1]
 }
 
-func FilesHandleLine(cwds, cgroups map[string]string, line string) {
+// FilesResolveLine tracks container cgroups and process cwds, returning the container id and a file
+// access with an absolute path for every successful or ENOENT access in a container
+func FilesResolveLine(cwds, cgroups map[string]string, line string) (string, File, bool) {
 	file := FilesParseLine(line)
 	if file.Syscall == "cgroup_mkdir" {
 		// track cgroups of docker containers as they start
@@ -597,7 +814,7 @@ func FilesHandleLine(cwds, cgroups map[string]string, line string) {
 		if strings.HasPrefix(part, "docker-") {
 			cgroups[file.Cgroup] = part[7 : 64+7]
 		}
-	} else if cgroups[file.Cgroup] != "" && file.File != "" && file.Errno == "0" {
+	} else if cgroups[file.Cgroup] != "" && file.File != "" && (file.Errno == "0" || file.Errno == ErrnoENOENT) {
 		// pids start at cwd of parent
 		_, ok := cwds[file.Pid]
 		if !ok {
@@ -609,7 +826,7 @@ func FilesHandleLine(cwds, cgroups map[string]string, line string) {
 			}
 		}
 		// update cwd when chdir succeeds
-		if file.Syscall == "chdir" {
+		if file.Syscall == "chdir" && file.Errno == "0" {
 			if file.File[:1] == "/" {
 				cwds[file.Pid] = file.File
 			} else {
@@ -624,8 +841,7 @@ func FilesHandleLine(cwds, cgroups map[string]string, line string) {
 			}
 			file.File = path.Join(cwd, file.File)
 		}
-		//
-		// _, _ = fmt.Fprintln(os.Stderr, file.Pid, file.Ppid, fmt.Sprintf("%-40s", file.File), fmt.Sprintf("%-10s", file.Comm), file.Errno, file.Syscall)
-		fmt.Println(cgroups[file.Cgroup], file.File)
+		return cgroups[file.Cgroup], file, true
 	}
+	return "", file, false
 }
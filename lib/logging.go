@@ -46,10 +46,12 @@ func (l *logger) Fatal(v ...interface{}) {
 	r = append(r, caller())
 	r = append(r, v...)
 	fmt.Fprintln(os.Stderr, r...)
+	RunExitHooks()
 	os.Exit(1)
 }
 
 func (l *logger) Fatalf(format string, v ...interface{}) {
 	fmt.Fprintf(os.Stderr, caller()+" "+format, v...)
+	RunExitHooks()
 	os.Exit(1)
 }
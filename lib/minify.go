@@ -0,0 +1,1040 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/client"
+)
+
+// MinifySource is the image to minify
+type MinifySource interface {
+	// Name is the name of the input image, recorded in provenance and used by verification
+	Name() string
+	// Platforms lists the platforms of a multi platform image, or nothing for a single platform image
+	Platforms(ctx context.Context) ([]string, error)
+	// Open indexes one platform of the image, saving or pulling it to file first when needed
+	Open(ctx context.Context, file string, platform string) (*Archive, error)
+}
+
+// MinifySink receives the minified image as an oci image layout
+type MinifySink interface {
+	Write(ctx context.Context, dir string) error
+}
+
+// MinifyKeeper decides which paths to keep from one platform of the input image, mapping each path
+// to the reason it is kept. minify adds the elf dependencies, script interpreters, links, packages
+// and hard links they need.
+type MinifyKeeper interface {
+	Keep(ctx context.Context, image *MinifyImage) (map[string]string, error)
+}
+
+type MinifyOptions struct {
+	Source MinifySource
+	Keeper MinifyKeeper
+	Sinks  []MinifySink
+	// Ref names the output image in the index of the oci image layout, and in provenance
+	Ref string
+	// OCIDir keeps the oci image layout in this directory, otherwise it is written to a workspace
+	OCIDir string
+	// Platforms to minify, where all means every platform of the source. none means whatever
+	// single image the source resolves to.
+	Platforms          []string
+	Flatten            bool
+	PreserveLayers     bool
+	HardLinksCopy      bool
+	KeepWholePackages  bool
+	KeepPackageDB      bool
+	Config             ConfigOverrides
+	NoProvenance       bool
+	Traces             []ProvenanceTrace // recorded in provenance
+	Profiles           []string          // recorded in provenance
+	DryRun             bool
+	DryRunTop          int
+	Verify             *VerifyOptions
+	Iterate            int
+	BpfRingBufferPages int
+}
+
+type MinifyResult struct {
+	Platforms []string
+	// Reports are set by a dry run, by platform
+	Reports map[string]*Report
+	// PlatformDiffs are set when minifying chosen platforms, by platform
+	PlatformDiffs map[string]*PlatformDiff
+	// Digest is the manifest of the output image, or its index when there are many platforms
+	Digest        string
+	Provenance    *ProvenanceStatement
+	Rounds        []IterateRound
+	PeakDiskBytes int64
+}
+
+// MinifyImage is one platform of the input image with the paths to keep from it
+type MinifyImage struct {
+	Platform     string
+	Archive      *Archive
+	Files        []*ScanFile
+	Filesystem   *Filesystem
+	Config       DockerfileConfig
+	Packages     *PackageDB
+	IncludePaths map[string]string
+	Provenance   ProvenanceImage
+	inTar        string
+	copies       map[string]string
+	rewrites     map[string][]byte
+}
+
+// TraceKeeper keeps traced paths, keep-list rules and files matched by rule profiles
+type TraceKeeper struct {
+	Events []TraceEvent
+	// PlatformEvents are used only for one platform, keyed by a platform like linux/arm64
+	PlatformEvents map[string][]TraceEvent
+	Profiles       []*Profile
+	// Client filters the trace to containers started from Image, or from an image with the same config
+	// or manifest digest when the input is not in docker
+	Client *client.Client
+	Image  string
+	// AnyContainer keeps traces of every container, for inputs whose traces cannot be matched because
+	// docker is not running
+	AnyContainer bool
+}
+
+func (keeper *TraceKeeper) Keep(ctx context.Context, image *MinifyImage) (map[string]string, error) {
+	events := append([]TraceEvent{}, keeper.Events...)
+	if image.Platform != "" {
+		platform, err := ParsePlatform(image.Platform)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		for name, platformEvents := range keeper.PlatformEvents {
+			if PlatformMatch(platform, name) {
+				events = append(events, platformEvents...)
+			}
+		}
+	}
+	events, err := keeper.filter(ctx, image, events)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	//
+	includePaths := make(map[string]string)
+	keep := func(path, reason string) {
+		_, ok := includePaths[path]
+		if !ok {
+			includePaths[path] = reason
+		}
+	}
+	var rules []KeepRule
+	for _, event := range events {
+		path := strings.Trim(event.Path, " ")
+		if event.Container == "" {
+			rule, ok := ParseKeepRule(path)
+			if ok {
+				rules = append(rules, rule)
+				continue
+			}
+		}
+		path = filepath.Clean(path)
+		path = strings.ReplaceAll(path, "/./", "/")
+		if path != "" {
+			keep(path, "trace")
+		}
+	}
+	// exclusions win over traced paths and globs, but not over link targets required by kept paths
+	KeepRulesApply(rules, image.Files, includePaths)
+	Logger.Println("included paths:", len(includePaths), "rules:", len(rules))
+	//
+	// some files must always be included, which files is decided by the rule profiles
+	profileCounts := make(map[string]int)
+	for _, f := range image.Files {
+		reason, ok := ProfilesMatch(keeper.Profiles, f)
+		if ok {
+			keep(CleanPath(f.Path), reason)
+			profileCounts[reason]++
+		}
+	}
+	for reason, count := range profileCounts {
+		Logger.Println("included paths:", count, "by", reason)
+	}
+	return includePaths, nil
+}
+
+// filter drops traces of containers from other images. images in docker are matched by id, other
+// inputs by the digests of their config and manifest, which are the ids docker gives them once pulled.
+func (keeper *TraceKeeper) filter(ctx context.Context, image *MinifyImage, events []TraceEvent) ([]TraceEvent, error) {
+	containers := false
+	for _, event := range events {
+		containers = containers || event.Container != ""
+	}
+	if !containers || keeper.AnyContainer {
+		return events, nil
+	}
+	docker := keeper.Client != nil
+	if docker {
+		_, err := keeper.Client.Ping(ctx)
+		docker = err == nil
+	}
+	if !docker {
+		err := fmt.Errorf("traces of containers cannot be matched to %s without docker, use --trace-any-container to keep them all", keeper.Image)
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	if IsDockerRef(keeper.Image) {
+		return TraceFilterImage(ctx, keeper.Client, keeper.Image, events)
+	}
+	ids := []string{OCIDigest(image.Archive.Config)}
+	if image.Archive.ManifestDigest != "" {
+		ids = append(ids, image.Archive.ManifestDigest)
+	}
+	return TraceFilterImageIDs(ctx, keeper.Client, ids, events)
+}
+
+// MinifyPlatforms resolves platforms, where all means every platform of the source, into the sorted
+// platforms to minify
+func MinifyPlatforms(ctx context.Context, source MinifySource, platforms []string) ([]string, error) {
+	if len(platforms) == 0 {
+		return []string{""}, nil
+	}
+	var result []string
+	for _, platform := range platforms {
+		if platform != "all" {
+			_, err := ParsePlatform(platform)
+			if err != nil {
+				Logger.Println("error:", err)
+				return nil, err
+			}
+			result = append(result, platform)
+			continue
+		}
+		all, err := source.Platforms(ctx)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		if len(all) == 0 {
+			err := fmt.Errorf("platform all needs a multi platform image from a registry or oci layout: %s", source.Name())
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		result = append(result, all...)
+	}
+	sort.Strings(result)
+	var unique []string
+	for i, platform := range result {
+		if i == 0 || platform != result[i-1] {
+			unique = append(unique, platform)
+		}
+	}
+	return unique, nil
+}
+
+// Minify removes every file from an image that the keeper does not keep, and is not needed by a kept
+// file, writing the new image to the sinks
+func Minify(ctx context.Context, opts MinifyOptions) (*MinifyResult, error) {
+	platforms, err := MinifyPlatforms(ctx, opts.Source, opts.Platforms)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	result := &MinifyResult{Platforms: platforms}
+	multi := len(platforms) > 1
+	for _, sink := range opts.Sinks {
+		_, docker := sink.(*DockerSink)
+		if multi && docker {
+			err := fmt.Errorf("docker cannot load a multi platform image, write an oci image layout or push to a registry")
+			Logger.Println("error:", err)
+			return nil, err
+		}
+	}
+	if multi && (opts.Verify != nil || opts.Iterate > 0) {
+		err := fmt.Errorf("verification needs a single platform")
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	// temp files live in a workspace which is removed on return, on fatal errors and on signals
+	ws, err := NewWorkspace("minify")
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	defer func() { _ = ws.Remove() }()
+	// the image is saved or pulled to disk once per platform, then indexed so layers can be read in
+	// parallel without copies. oci layouts are read in place.
+	usagePaths := []string{ws.Dir, opts.OCIDir}
+	for _, sink := range opts.Sinks {
+		archiveSink, ok := sink.(*OCIArchiveSink)
+		if ok {
+			usagePaths = append(usagePaths, archiveSink.File)
+		}
+	}
+	usage := NewDiskUsage(usagePaths...)
+	dir := opts.OCIDir
+	if dir == "" {
+		dir = ws.Dir + "/oci"
+	}
+	//
+	var images []*MinifyImage
+	var manifests []OCIDescriptor
+	platformKept := make(map[string]map[string]bool)
+	platformMissing := make(map[string][]string)
+	for i, platform := range platforms {
+		image, err := minifyPrepare(ctx, opts, fmt.Sprintf("%s/in.%d.tar", ws.Dir, i), platform)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		Logger.Println("saved input container to disk, bytes:", usage.Sample())
+		if platform != "" {
+			platformKept[platform] = PlatformKept(image.Filesystem, image.IncludePaths)
+			platformMissing[platform] = MissingPaths(image.Filesystem, image.IncludePaths)
+		}
+		if opts.DryRun {
+			if result.Reports == nil {
+				result.Reports = make(map[string]*Report)
+			}
+			report := MinifyReport(image.Files, image.IncludePaths, opts.DryRunTop)
+			report.Packages = PackagesReport(image.Packages, image.Filesystem, image.IncludePaths)
+			result.Reports[platform] = report
+			err := minifyRemoveInput(image)
+			if err != nil {
+				Logger.Println("error:", err)
+				return nil, err
+			}
+			continue
+		}
+		// output layers are written straight into the blobs of an oci image layout
+		desc, err := minifyWriteImage(opts, dir, image, !multi)
+		if err != nil {
+			_ = minifyRemoveInput(image)
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		usage.Sample()
+		result.Digest = desc.Digest
+		if !multi && opts.OCIDir != "" {
+			Logger.Println("wrote oci image layout", dir, desc.Digest)
+		}
+		if multi {
+			manifests = append(manifests, desc)
+			err := minifyRemoveInput(image)
+			if err != nil {
+				Logger.Println("error:", err)
+				return nil, err
+			}
+			Logger.Println("minified platform", platform)
+		}
+		images = append(images, image)
+	}
+	// traces are shared by every platform, so paths may exist in only some of them
+	if len(platformKept) > 0 {
+		result.PlatformDiffs = PlatformDiffs(platformKept, platformMissing)
+		for platform, diff := range result.PlatformDiffs {
+			Logger.Println("platform", platform, "traced paths not found:", len(diff.Missing), "kept paths not in other platforms:", len(diff.Only))
+			report, ok := result.Reports[platform]
+			if ok {
+				report.Platform = diff
+			}
+		}
+	}
+	if opts.DryRun {
+		return result, nil
+	}
+	//
+	if multi {
+		desc, err := OCIWriteMultiPlatform(dir, opts.Ref, manifests)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		Logger.Println("wrote multi platform index", desc.Digest, "platforms:", len(manifests))
+		result.Digest = desc.Digest
+	}
+	err = minifySinks(ctx, opts, dir)
+	if err != nil {
+		if !multi {
+			_ = minifyRemoveInput(images[0])
+		}
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	usage.Sample()
+	//
+	if opts.Iterate > 0 {
+		result.Rounds, err = minifyIterate(ctx, opts, dir, images[0], usage, result)
+		if err != nil {
+			_ = minifyRemoveInput(images[0])
+			Logger.Println("error:", err)
+			return nil, err
+		}
+	}
+	if !multi {
+		err := minifyRemoveInput(images[0])
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+	}
+	result.PeakDiskBytes = usage.Peak
+	Logger.Println("peak disk use, bytes:", usage.Peak)
+	//
+	if !opts.NoProvenance {
+		var provenance []ProvenanceImage
+		for _, image := range images {
+			provenance = append(provenance, image.Provenance)
+		}
+		statement := NewProvenanceStatement(opts.Ref, opts.Traces, opts.Profiles, provenance)
+		result.Provenance = &statement
+	}
+	if opts.Verify != nil {
+		err := Verify(ctx, opts.Source.Name(), opts.Ref, *opts.Verify)
+		if err != nil {
+			for _, sink := range opts.Sinks {
+				dockerSink, ok := sink.(*DockerSink)
+				if ok {
+					dockerSink.Remove(ctx)
+				}
+			}
+			Logger.Println("error:", err)
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// minifyIterate traces the verification workload against the output image and keeps files it failed
+// to find, rebuilding the output after each round
+func minifyIterate(ctx context.Context, opts MinifyOptions, dir string, image *MinifyImage, usage *DiskUsage, result *MinifyResult) ([]IterateRound, error) {
+	var verifyOptions VerifyOptions
+	if opts.Verify != nil {
+		verifyOptions = *opts.Verify
+	}
+	var rounds []IterateRound
+	for round := 1; round <= opts.Iterate; round++ {
+		Logger.Println("start iterate round", round)
+		id, events, err := IterateTrace(ctx, opts.Ref, verifyOptions, opts.BpfRingBufferPages)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		added := IterateMissing(image.Filesystem, image.IncludePaths, id, events)
+		if len(added) == 0 {
+			Logger.Println("iterate round", round, "found no new paths")
+			break
+		}
+		reason := fmt.Sprintf("iterate round %d", round)
+		for _, p := range added {
+			image.IncludePaths[p] = reason
+		}
+		count := len(image.IncludePaths)
+		minifyClosure(opts, image)
+		rounds = append(rounds, IterateRound{Round: round, Added: added, Closure: len(image.IncludePaths) - count})
+		desc, err := minifyWriteImage(opts, dir, image, true)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		result.Digest = desc.Digest
+		usage.Sample()
+		err = minifySinks(ctx, opts, dir)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+	}
+	for _, round := range rounds {
+		Logger.Println("iterate round", round.Round, "added paths:", len(round.Added), "closure paths:", round.Closure)
+		for _, p := range round.Added {
+			Logger.Println("iterate round", round.Round, "added:", p)
+		}
+	}
+	return rounds, nil
+}
+
+// minifyPrepare opens and scans one platform of the input image, then decides which paths to keep
+func minifyPrepare(ctx context.Context, opts MinifyOptions, inTar string, platform string) (*MinifyImage, error) {
+	archive, err := opts.Source.Open(ctx, inTar, platform)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	image := &MinifyImage{
+		Platform: platform,
+		Archive:  archive,
+		inTar:    inTar,
+	}
+	err = minifyScan(ctx, opts, image)
+	if err != nil {
+		_ = minifyRemoveInput(image)
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return image, nil
+}
+
+func minifyScan(ctx context.Context, opts MinifyOptions, image *MinifyImage) error {
+	var err error
+	image.Files, _, err = ScanArchive(image.Archive, false)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	Logger.Println("scanned container", image.Platform)
+	image.Filesystem = NewFilesystem(image.Files)
+	image.Packages, err = ReadPackages(image.Filesystem)
+	if err != nil {
+		Logger.Println("warning: cannot read package database:", err)
+		image.Packages = &PackageDB{}
+	}
+	Logger.Println("packages:", len(image.Packages.Packages))
+	err = json.Unmarshal(image.Archive.Config, &image.Config)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	image.IncludePaths, err = opts.Keeper.Keep(ctx, image)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	minifyClosure(opts, image)
+	return nil
+}
+
+func minifyRemoveInput(image *MinifyImage) error {
+	err := image.Archive.Close()
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	err = os.Remove(image.inTar)
+	if err != nil && !os.IsNotExist(err) {
+		Logger.Println("error:", err)
+		return err
+	}
+	return nil
+}
+
+// minifyClosure adds the script interpreters, elf dependencies, symlinks, whole packages, package
+// databases and hard link targets needed by kept paths, setting the hard links to write as copies of
+// their targets and the rewritten package database files
+func minifyClosure(opts MinifyOptions, image *MinifyImage) {
+	includePaths := image.IncludePaths
+	for {
+		minifyLinks(image.Filesystem, image.Files, image.Config.Config.Env, includePaths)
+		if !opts.KeepWholePackages {
+			break
+		}
+		count := PackagesExpand(image.Packages, image.Filesystem, includePaths)
+		Logger.Println("included paths:", count, "by whole packages")
+		if count == 0 {
+			break
+		}
+	}
+	image.rewrites = nil
+	if opts.KeepPackageDB {
+		count := len(includePaths)
+		image.rewrites = PackagesRewrite(image.Packages, image.Filesystem, includePaths)
+		Logger.Println("included paths:", len(includePaths)-count, "by package db, rewritten:", len(image.rewrites))
+	}
+	statuses := make(map[string]int)
+	var rpmPartial []string
+	for _, status := range PackagesReport(image.Packages, image.Filesystem, includePaths) {
+		statuses[status.Status]++
+		if status.Status == PackagePartial {
+			Logger.Println("partially kept package:", status.Name, "kept files:", status.KeptFiles, "of", status.Files)
+			if status.Manager == "rpm" {
+				rpmPartial = append(rpmPartial, status.Name)
+			}
+		}
+	}
+	Logger.Println("packages kept:", statuses[PackageKept], "partial:", statuses[PackagePartial], "removed:", statuses[PackageRemoved])
+	if opts.KeepPackageDB && len(rpmPartial) > 0 {
+		Logger.Println("warning: --keep-package-db cannot rewrite the rpm database, so it is removed unless a trace keeps it, and then still lists every file of these partially kept packages, use --keep-whole-packages to keep them whole:", strings.Join(rpmPartial, " "))
+	}
+	//
+	count := len(includePaths)
+	image.copies = HardLinks(image.Filesystem, includePaths, opts.HardLinksCopy)
+	Logger.Println("included paths:", len(includePaths)-count, "by hard links, hard links copied:", len(image.copies))
+}
+
+// minifyLinks adds the script interpreters, elf dependencies and symlinks needed by kept paths
+func minifyLinks(filesystem *Filesystem, files []*ScanFile, env []string, includePaths map[string]string) {
+	keep := func(path, reason string) {
+		_, ok := includePaths[path]
+		if !ok {
+			includePaths[path] = reason
+		}
+	}
+	count := len(includePaths)
+	for _, missing := range ScriptClosure(filesystem, env, includePaths) {
+		Logger.Println("warning: unresolved script interpreter:", missing)
+	}
+	Logger.Println("included paths:", len(includePaths)-count, "by script interpreters")
+	count = len(includePaths)
+	for _, missing := range ElfClosure(filesystem, env, includePaths) {
+		Logger.Println("warning: unresolved elf dependency:", missing)
+	}
+	Logger.Println("included paths:", len(includePaths)-count, "by elf dependencies")
+	//
+	links := make(map[string]string)
+	for _, f := range files {
+		if f.LinkTarget != "" && !IsHardLink(f) {
+			links[f.Path] = f.LinkTarget
+		}
+	}
+	//
+	// recursively resolve all links
+	for p := range includePaths {
+		last := ""
+		for {
+			if last == p {
+				break // break when no further change
+			}
+			last = p
+			parts := strings.Split(strings.TrimLeft(p, "/"), "/")
+			for i := 0; i <= len(parts); i++ {
+				subPath := "/" + path.Join(parts[:i]...)
+				link, ok := links[subPath]
+				if ok {
+					if link[:1] != "/" {
+						link = path.Join(path.Dir(subPath), link)
+					}
+					keep(subPath, "symlink")
+					keep(link, "symlink")
+					for j := range parts[:i] {
+						parts[j] = ""
+					}
+					parts[0] = link
+				}
+			}
+			p2 := path.Join(parts...)
+			keep(p2, "symlink")
+			p = p2
+		}
+	}
+	Logger.Println("recursively resolved links")
+}
+
+// minifyStamp applies the config overrides to the config of the input image, after the provenance
+// labels so overrides can replace or drop them, returning the config and the manifest annotations
+func minifyStamp(opts MinifyOptions, image *MinifyImage) ([]byte, map[string]string, error) {
+	config := image.Archive.Config
+	var annotations map[string]string
+	if !opts.NoProvenance {
+		image.Provenance = NewProvenanceImage(opts.Source.Name(), image.Archive, image.Files, image.IncludePaths)
+		image.Provenance.Platform = image.Platform
+		annotations = image.Provenance.Annotations()
+		var err error
+		config, err = ConfigApplyOverrides(config, ConfigOverrides{SetLabel: image.Provenance.Labels()})
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, nil, err
+		}
+	}
+	config, err := ConfigApplyOverrides(config, opts.Config)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, nil, err
+	}
+	return config, annotations, nil
+}
+
+// minifyWriteImage writes the output layers, config and manifest of one platform into the oci image
+// layout, returning the manifest descriptor. index also writes the index.json of a single platform
+// image, and a docker manifest.json so that older versions of docker load can read it too.
+func minifyWriteImage(opts MinifyOptions, dir string, image *MinifyImage, index bool) (OCIDescriptor, error) {
+	config, annotations, err := minifyStamp(opts, image)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, err
+	}
+	descs, diffIDs, err := minifyWrite(opts, dir, image)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, err
+	}
+	var desc OCIDescriptor
+	if index {
+		desc, err = OCIWriteManifest(dir, opts.Ref, config, descs, diffIDs, annotations)
+	} else {
+		desc, err = OCIWriteImageManifest(dir, config, descs, diffIDs, annotations)
+	}
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, err
+	}
+	image.Provenance.Digest = desc.Digest
+	return desc, nil
+}
+
+// minifySinks sends the oci image layout to every sink, then removes it unless it was asked for
+func minifySinks(ctx context.Context, opts MinifyOptions, dir string) error {
+	for _, sink := range opts.Sinks {
+		err := sink.Write(ctx, dir)
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+	}
+	if opts.OCIDir == "" {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// minifyWrite writes the output layers holding the kept files as gzipped blobs into an oci image layout,
+// returning their descriptors and diff ids
+func minifyWrite(opts MinifyOptions, dir string, image *MinifyImage) ([]OCIDescriptor, []string, error) {
+	includeFiles := make(map[string]*ScanFile)
+	var last *ScanFile
+	for _, f := range image.Files {
+		f.Path = strings.ReplaceAll(f.Path, "/./", "/")
+		_, ok := image.IncludePaths[strings.TrimRight(f.Path, "/")]
+		if !ok {
+			continue
+		}
+		if last != nil && f.Path != last.Path {
+			includeFiles[last.Path] = last
+		}
+		last = f
+	}
+	if last != nil {
+		includeFiles[last.Path] = last
+	}
+	Logger.Println("included files:", len(includeFiles))
+	//
+	w := &minifyWriter{
+		archive:      image.Archive,
+		dir:          dir,
+		filesystem:   image.Filesystem,
+		includeFiles: includeFiles,
+		copies:       image.copies,
+		rewrites:     image.rewrites,
+	}
+	var descs []OCIDescriptor
+	var diffIDs []string
+	var err error
+	switch {
+	case opts.Flatten:
+		descs, diffIDs, err = w.flatten()
+	case opts.PreserveLayers:
+		descs, diffIDs, err = w.preserveLayers()
+	default:
+		descs, diffIDs, err = w.concat()
+	}
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, nil, err
+	}
+	Logger.Println("finished writing output layers:", len(descs))
+	return descs, diffIDs, nil
+}
+
+// minifyWriter writes kept entries from the layers of an image into output layer blobs
+type minifyWriter struct {
+	archive      *Archive
+	dir          string
+	filesystem   *Filesystem
+	includeFiles map[string]*ScanFile
+	copies       map[string]string
+	rewrites     map[string][]byte
+}
+
+// eachLayer calls fn with the name and contents of every layer of the input image, in order
+func (w *minifyWriter) eachLayer(fn func(layer string, r io.Reader) error) error {
+	for _, layer := range w.archive.Manifest.Layers {
+		r, err := w.archive.Layer(layer)
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		err = fn(layer, r)
+		_ = r.Close()
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		Logger.Println("minified layer", layer)
+	}
+	return nil
+}
+
+func minifyClose(w *OCILayerWriter, tw *tar.Writer) (OCIDescriptor, string, error) {
+	err := tw.Close()
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, "", err
+	}
+	desc, diffID, err := w.Finish()
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, "", err
+	}
+	return desc, diffID, nil
+}
+
+// concat writes kept entries from every layer, in the order layers appear in the input, into one tarball
+func (w *minifyWriter) concat() ([]OCIDescriptor, []string, error) {
+	lw, err := OCICreateLayer(w.dir)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, nil, err
+	}
+	tw := tar.NewWriter(lw)
+	dirs := NewAncestorDirs(w.filesystem)
+	err = w.eachLayer(func(layer string, r io.Reader) error {
+		_, err := w.layer(layer, r, tw, w.includeFiles, dirs)
+		return err
+	})
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, nil, err
+	}
+	desc, diffID, err := minifyClose(lw, tw)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, nil, err
+	}
+	return []OCIDescriptor{desc}, []string{diffID}, nil
+}
+
+// preserveLayers writes one tarball per input layer in parallel, skipping layers with no kept entries
+func (w *minifyWriter) preserveLayers() ([]OCIDescriptor, []string, error) {
+	layers := w.archive.Manifest.Layers
+	descs := make([]OCIDescriptor, len(layers))
+	diffIDs := make([]string, len(layers))
+	errs := make([]error, len(layers))
+	sem := make(chan struct{}, runtime.NumCPU())
+	var wg sync.WaitGroup
+	for i, layer := range layers {
+		wg.Add(1)
+		go func(i int, layer string) {
+			// defer func() {}()
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			descs[i], diffIDs[i], errs[i] = w.preserveLayer(layer)
+		}(i, layer)
+	}
+	wg.Wait()
+	var resultDescs []OCIDescriptor
+	var resultDiffIDs []string
+	for i := range descs {
+		if errs[i] != nil {
+			Logger.Println("error:", errs[i])
+			return nil, nil, errs[i]
+		}
+		if diffIDs[i] != "" {
+			resultDescs = append(resultDescs, descs[i])
+			resultDiffIDs = append(resultDiffIDs, diffIDs[i])
+		}
+	}
+	return resultDescs, resultDiffIDs, nil
+}
+
+func (w *minifyWriter) preserveLayer(layer string) (OCIDescriptor, string, error) {
+	r, err := w.archive.Layer(layer)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, "", err
+	}
+	defer func() { _ = r.Close() }()
+	lw, err := OCICreateLayer(w.dir)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, "", err
+	}
+	tw := tar.NewWriter(lw)
+	count, err := w.layer(layer, r, tw, w.includeFiles, NewAncestorDirs(w.filesystem))
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, "", err
+	}
+	desc, diffID, err := minifyClose(lw, tw)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, "", err
+	}
+	Logger.Println("minified layer", layer)
+	if count == 0 {
+		// every empty layer has the same blob, so another goroutine may have removed it already
+		err := os.Remove(OCIBlobPath(w.dir, desc.Digest))
+		if err != nil && !os.IsNotExist(err) {
+			Logger.Println("error:", err)
+			return OCIDescriptor{}, "", err
+		}
+		return OCIDescriptor{}, "", nil
+	}
+	return desc, diffID, nil
+}
+
+// flatten writes the final filesystem view into one tarball with each path once. directories come
+// first so they exist before their contents, then regular files, then links so their targets exist.
+func (w *minifyWriter) flatten() ([]OCIDescriptor, []string, error) {
+	lw, err := OCICreateLayer(w.dir)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, nil, err
+	}
+	tw := tar.NewWriter(lw)
+	var paths []string
+	regularFiles := make(map[string]*ScanFile)
+	for p, f := range w.includeFiles {
+		paths = append(paths, p)
+		_, copied := w.copies[p]
+		if (f.Mode.IsRegular() && f.LinkTarget == "") || copied {
+			regularFiles[p] = f
+		}
+	}
+	sort.Strings(paths)
+	dirs := NewAncestorDirs(w.filesystem)
+	writeHeader := func(p string) error {
+		err := dirs.Write(tw, p)
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		err = tw.WriteHeader(ScanFileHeader(w.includeFiles[p]))
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		return nil
+	}
+	for _, p := range paths {
+		if w.includeFiles[p].Mode.IsDir() {
+			err := writeHeader(p)
+			if err != nil {
+				Logger.Println("error:", err)
+				return nil, nil, err
+			}
+			dirs.Mark(p)
+		}
+	}
+	err = w.eachLayer(func(layer string, r io.Reader) error {
+		_, err := w.layer(layer, r, tw, regularFiles, dirs)
+		return err
+	})
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, nil, err
+	}
+	for _, p := range paths {
+		_, copied := w.copies[p]
+		if w.includeFiles[p].LinkTarget != "" && !copied {
+			err := writeHeader(p)
+			if err != nil {
+				Logger.Println("error:", err)
+				return nil, nil, err
+			}
+		}
+	}
+	desc, diffID, err := minifyClose(lw, tw)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, nil, err
+	}
+	return []OCIDescriptor{desc}, []string{diffID}, nil
+}
+
+// layer copies the kept entries of one input layer into tw, returning how many were written
+func (w *minifyWriter) layer(layer string, r io.Reader, tw *tar.Writer, includeFiles map[string]*ScanFile, dirs *AncestorDirs) (int, error) {
+	count := 0
+	layerIndex, ok := w.archive.Layers[layer]
+	if !ok {
+		err := fmt.Errorf("layer not found in image: %s", layer)
+		Logger.Println("error:", err)
+		return 0, err
+	}
+	var links []string
+	for link := range w.copies {
+		f, ok := includeFiles[link]
+		if ok && f.LayerIndex == layerIndex {
+			links = append(links, link)
+		}
+	}
+	hardLinks := NewHardLinkBuffer(w.copies, links)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			Logger.Println("error:", err)
+			return 0, err
+		}
+		if header == nil {
+			continue
+		}
+		// only entries from the final view of the image are written, so nothing in the
+		// output needs deleting and whiteouts are dropped
+		if strings.HasPrefix(path.Base(header.Name), WhiteoutPrefix) {
+			continue
+		}
+		pth := strings.ReplaceAll("/"+header.Name, "/./", "/")
+		header, body, err := hardLinks.Entry(CleanPath(pth), header, tr)
+		if err != nil {
+			Logger.Println("error:", err)
+			return 0, err
+		}
+		includeFile, ok := includeFiles[pth]
+		if !ok {
+			continue
+		}
+		if includeFile.LayerIndex != layerIndex {
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeSymlink, tar.TypeDir, tar.TypeLink:
+		default:
+			err := fmt.Errorf("unknown tar type %v in layer %s: %s", header.Typeflag, layer, header.Name)
+			Logger.Println("error:", err)
+			return 0, err
+		}
+		// ancestors are written first so they keep their original ownership and mode
+		err = dirs.Write(tw, pth)
+		if err != nil {
+			Logger.Println("error:", err)
+			return 0, err
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirs.Mark(pth)
+		}
+		// package databases are rewritten to match the kept files
+		content, ok := w.rewrites[CleanPath(pth)]
+		if ok && header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(content))
+			body = bytes.NewReader(content)
+		}
+		err = tw.WriteHeader(header)
+		if err != nil {
+			Logger.Println("error:", err)
+			return 0, err
+		}
+		_, err = io.Copy(tw, body)
+		if err != nil {
+			Logger.Println("error:", err)
+			return 0, err
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,520 @@
+package lib
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	MediaTypeOCIIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaTypeOCILayer    = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeOCILayerGz  = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+type OCIPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type OCIDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *OCIPlatform      `json:"platform,omitempty"`
+}
+
+type OCIManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        OCIDescriptor     `json:"config"`
+	Layers        []OCIDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type OCIIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []OCIDescriptor   `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type digestWriter struct {
+	hash hash.Hash
+	size int64
+}
+
+func newDigestWriter() *digestWriter {
+	return &digestWriter{hash: sha256.New()}
+}
+
+func (w *digestWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	return w.hash.Write(p)
+}
+
+func (w *digestWriter) Digest() string {
+	return "sha256:" + hex.EncodeToString(w.hash.Sum(nil))
+}
+
+// OCIBlobPath is the path of a blob in an oci image layout
+func OCIBlobPath(dir, digest string) string {
+	return path.Join(dir, "blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+// OCIDigest is the digest of a blob, which for an image config is also its id in docker
+func OCIDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// OCIWriteBlob writes data into the blobs of an oci image layout, named by its digest
+func OCIWriteBlob(dir string, mediaType string, data []byte) (OCIDescriptor, error) {
+	desc := OCIDescriptor{
+		MediaType: mediaType,
+		Digest:    OCIDigest(data),
+		Size:      int64(len(data)),
+	}
+	err := os.MkdirAll(path.Join(dir, "blobs", "sha256"), os.ModePerm)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, err
+	}
+	err = os.WriteFile(OCIBlobPath(dir, desc.Digest), data, 0644)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, err
+	}
+	return desc, nil
+}
+
+type OCILayerWriter struct {
+	dir          string
+	file         *os.File
+	gw           *gzip.Writer
+	compressed   *digestWriter
+	uncompressed *digestWriter
+}
+
+// OCICreateLayer starts a gzipped layer blob in an oci image layout. the uncompressed layer tarball is
+// written to it, so no uncompressed copy touches the disk.
+func OCICreateLayer(dir string) (*OCILayerWriter, error) {
+	err := os.MkdirAll(path.Join(dir, "blobs", "sha256"), os.ModePerm)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	file, err := os.CreateTemp(path.Join(dir, "blobs", "sha256"), ".tmp.")
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	w := &OCILayerWriter{
+		dir:          dir,
+		file:         file,
+		compressed:   newDigestWriter(),
+		uncompressed: newDigestWriter(),
+	}
+	w.gw = gzip.NewWriter(io.MultiWriter(file, w.compressed))
+	return w, nil
+}
+
+func (w *OCILayerWriter) Write(p []byte) (int, error) {
+	_, _ = w.uncompressed.Write(p)
+	return w.gw.Write(p)
+}
+
+// Finish names the blob by its digest, returning its descriptor and the digest of the uncompressed
+// tarball used as the diff id in the image config
+func (w *OCILayerWriter) Finish() (OCIDescriptor, string, error) {
+	err := w.gw.Close()
+	if err != nil {
+		_ = w.file.Close()
+		_ = os.Remove(w.file.Name())
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, "", err
+	}
+	err = w.file.Close()
+	if err != nil {
+		_ = os.Remove(w.file.Name())
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, "", err
+	}
+	desc := OCIDescriptor{
+		MediaType: MediaTypeOCILayerGz,
+		Digest:    w.compressed.Digest(),
+		Size:      w.compressed.size,
+	}
+	err = os.Rename(w.file.Name(), OCIBlobPath(w.dir, desc.Digest))
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, "", err
+	}
+	return desc, w.uncompressed.Digest(), nil
+}
+
+// OCIConfig derives a new image config from the source image config, keeping the platform and runtime
+// config and replacing the layers and history
+func OCIConfig(source []byte, diffIDs []string) ([]byte, error) {
+	var src map[string]interface{}
+	err := json.Unmarshal(source, &src)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	config := make(map[string]interface{})
+	for _, key := range []string{"architecture", "os", "os.version", "os.features", "variant", "author", "config"} {
+		val, ok := src[key]
+		if ok {
+			config[key] = val
+		}
+	}
+	created := time.Now().UTC().Format(time.RFC3339)
+	config["created"] = created
+	var history []interface{}
+	for range diffIDs {
+		history = append(history, map[string]interface{}{
+			"created":    created,
+			"created_by": "docker-trace minify",
+		})
+	}
+	config["history"] = history
+	config["rootfs"] = map[string]interface{}{
+		"type":     "layers",
+		"diff_ids": diffIDs,
+	}
+	return json.Marshal(config)
+}
+
+// OCIWriteManifest writes the config, manifest and index of an image whose layer blobs are already in
+// the oci image layout, and a docker manifest.json so that older versions of docker load can read it too
+func OCIWriteManifest(dir string, ref string, sourceConfig []byte, layers []OCIDescriptor, diffIDs []string, annotations map[string]string) (OCIDescriptor, error) {
+	desc, manifest, err := ociWriteImageManifest(dir, sourceConfig, layers, diffIDs, annotations)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, err
+	}
+	desc.Annotations = map[string]string{
+		"io.containerd.image.name":          ref,
+		"org.opencontainers.image.ref.name": ociRefName(ref),
+	}
+	err = OCIWriteIndex(dir, []OCIDescriptor{desc})
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, err
+	}
+	var layerPaths []string
+	for _, layer := range manifest.Layers {
+		layerPaths = append(layerPaths, OCIBlobPath("", layer.Digest))
+	}
+	dockerManifest := []Manifest{{
+		Config:   OCIBlobPath("", manifest.Config.Digest),
+		RepoTags: []string{ref},
+		Layers:   layerPaths,
+	}}
+	data, err := json.Marshal(dockerManifest)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, err
+	}
+	err = os.WriteFile(path.Join(dir, "manifest.json"), data, 0644)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, err
+	}
+	return desc, nil
+}
+
+// OCIWriteImageManifest writes the config and manifest blobs of an image whose layer blobs are already
+// in the oci image layout, returning the manifest descriptor with the platform of the config
+func OCIWriteImageManifest(dir string, sourceConfig []byte, layers []OCIDescriptor, diffIDs []string, annotations map[string]string) (OCIDescriptor, error) {
+	desc, _, err := ociWriteImageManifest(dir, sourceConfig, layers, diffIDs, annotations)
+	return desc, err
+}
+
+func ociWriteImageManifest(dir string, sourceConfig []byte, layers []OCIDescriptor, diffIDs []string, annotations map[string]string) (OCIDescriptor, OCIManifest, error) {
+	manifest := OCIManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Layers:        layers,
+		Annotations:   annotations,
+	}
+	config, err := OCIConfig(sourceConfig, diffIDs)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, OCIManifest{}, err
+	}
+	manifest.Config, err = OCIWriteBlob(dir, MediaTypeOCIConfig, config)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, OCIManifest{}, err
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, OCIManifest{}, err
+	}
+	desc, err := OCIWriteBlob(dir, MediaTypeOCIManifest, data)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, OCIManifest{}, err
+	}
+	var platform OCIPlatform
+	err = json.Unmarshal(config, &platform)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, OCIManifest{}, err
+	}
+	if platform.OS != "" {
+		desc.Platform = &platform
+	}
+	return desc, manifest, nil
+}
+
+// OCIWriteMultiPlatform writes a multi platform image index of already written image manifests, and
+// an index.json naming it. docker load cannot read these, so no manifest.json is written.
+func OCIWriteMultiPlatform(dir string, ref string, manifests []OCIDescriptor) (OCIDescriptor, error) {
+	data, err := json.Marshal(OCIIndex{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIIndex,
+		Manifests:     manifests,
+	})
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, err
+	}
+	desc, err := OCIWriteBlob(dir, MediaTypeOCIIndex, data)
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, err
+	}
+	desc.Annotations = map[string]string{
+		"io.containerd.image.name":          ref,
+		"org.opencontainers.image.ref.name": ociRefName(ref),
+	}
+	err = OCIWriteIndex(dir, []OCIDescriptor{desc})
+	if err != nil {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, err
+	}
+	err = os.Remove(path.Join(dir, "manifest.json"))
+	if err != nil && !os.IsNotExist(err) {
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, err
+	}
+	return desc, nil
+}
+
+// ociRefName is the tag of a reference, which is how oci layouts name their images
+func ociRefName(ref string) string {
+	name := ref
+	if i := strings.LastIndex(name, "/"); i != -1 {
+		name = name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i != -1 {
+		return name[i+1:]
+	}
+	return "latest"
+}
+
+// OCIWriteIndex writes index.json and oci-layout, the entrypoints of an oci image layout
+func OCIWriteIndex(dir string, manifests []OCIDescriptor) error {
+	index := OCIIndex{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIIndex,
+		Manifests:     manifests,
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	err = os.WriteFile(path.Join(dir, "index.json"), data, 0644)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	err = os.WriteFile(path.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	return nil
+}
+
+// OCIWriteArchive tars an oci image layout directory into a single file
+func OCIWriteArchive(dir string, file string) error {
+	w, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	err = OCIWriteArchiveTo(dir, w)
+	if err != nil {
+		_ = w.Close()
+		Logger.Println("error:", err)
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	return nil
+}
+
+// OCIWriteArchiveTo streams an oci image layout directory as a tarball, like into docker load
+func OCIWriteArchiveTo(dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if name == "." || strings.HasPrefix(d.Name(), ".tmp.") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if d.IsDir() {
+			header.Name += "/"
+		}
+		err = tw.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		r, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = r.Close() }()
+		_, err = io.Copy(tw, r)
+		return err
+	})
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	err = tw.Close()
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	return nil
+}
+
+type ConfigOverrides struct {
+	SetEnv    []string
+	DropEnv   []string
+	SetLabel  []string
+	DropLabel []string
+}
+
+// ConfigApplyOverrides changes the env and labels of the runtime config in an image config, leaving every other field as is
+func ConfigApplyOverrides(source []byte, overrides ConfigOverrides) ([]byte, error) {
+	var config map[string]interface{}
+	err := json.Unmarshal(source, &config)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	runtimeConfig, _ := config["config"].(map[string]interface{})
+	if runtimeConfig == nil {
+		runtimeConfig = make(map[string]interface{})
+		config["config"] = runtimeConfig
+	}
+	var env []string
+	envList, _ := runtimeConfig["Env"].([]interface{})
+	for _, kv := range envList {
+		env = append(env, fmt.Sprint(kv))
+	}
+	for _, key := range overrides.DropEnv {
+		var result []string
+		for _, kv := range env {
+			if strings.SplitN(kv, "=", 2)[0] != key {
+				result = append(result, kv)
+			}
+		}
+		env = result
+	}
+	for _, kv := range overrides.SetEnv {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			err := fmt.Errorf("env must be KEY=VALUE, got: %s", kv)
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		replaced := false
+		for i, existing := range env {
+			if strings.SplitN(existing, "=", 2)[0] == parts[0] {
+				env[i] = kv
+				replaced = true
+			}
+		}
+		if !replaced {
+			env = append(env, kv)
+		}
+	}
+	if env != nil || runtimeConfig["Env"] != nil {
+		runtimeConfig["Env"] = env
+	}
+	labels, _ := runtimeConfig["Labels"].(map[string]interface{})
+	for _, pattern := range overrides.DropLabel {
+		for key := range labels {
+			ok, err := path.Match(pattern, key)
+			if err != nil {
+				Logger.Println("error:", err)
+				return nil, err
+			}
+			if ok {
+				delete(labels, key)
+			}
+		}
+	}
+	for _, kv := range overrides.SetLabel {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			err := fmt.Errorf("label must be KEY=VALUE, got: %s", kv)
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		if labels == nil {
+			labels = make(map[string]interface{})
+		}
+		labels[parts[0]] = parts[1]
+	}
+	if labels != nil {
+		runtimeConfig["Labels"] = labels
+	}
+	return json.Marshal(config)
+}
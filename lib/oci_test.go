@@ -0,0 +1,170 @@
+package lib
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestOCIWriteManifest(t *testing.T) {
+	dir := t.TempDir()
+	layer := testTar([]testEntry{testDir("app/"), testFile("app/main", "binary")})
+	layerTar := path.Join(dir, "layer.tar")
+	err := os.WriteFile(layerTar, layer, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := `{
+		"architecture": "amd64",
+		"os": "linux",
+		"config": {"Entrypoint": ["/app/main"], "Env": ["PATH=/bin"], "Labels": {"a": "b"}},
+		"container_config": {"Cmd": ["/bin/sh", "-c", "#(nop) ADD file"]},
+		"history": [{"created_by": "ADD file"}],
+		"rootfs": {"type": "layers", "diff_ids": ["sha256:old"]}
+	}`
+	out := path.Join(dir, "oci")
+	desc, err := testOCIWriteImage(out, "example.com/app:min", []byte(source), []string{layerTar})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index OCIIndex
+	readJSON(t, path.Join(out, "index.json"), &index)
+	if len(index.Manifests) != 1 || index.Manifests[0].Digest != desc.Digest {
+		t.Fatalf("bad index: %s", Pformat(index))
+	}
+	if index.Manifests[0].Annotations["org.opencontainers.image.ref.name"] != "min" || index.Manifests[0].Platform.Architecture != "amd64" {
+		t.Errorf("bad index descriptor: %s", Pformat(index.Manifests[0]))
+	}
+	var manifest OCIManifest
+	data := readJSON(t, OCIBlobPath(out, desc.Digest), &manifest)
+	if sha256Digest(data) != desc.Digest {
+		t.Error("manifest digest mismatch")
+	}
+	var config map[string]interface{}
+	data = readJSON(t, OCIBlobPath(out, manifest.Config.Digest), &config)
+	if sha256Digest(data) != manifest.Config.Digest {
+		t.Error("config digest mismatch")
+	}
+	if _, ok := config["container_config"]; ok {
+		t.Error("container_config should not be carried over")
+	}
+	if !reflect.DeepEqual(config["config"].(map[string]interface{})["Entrypoint"], []interface{}{"/app/main"}) {
+		t.Errorf("runtime config not carried over: %s", Pformat(config))
+	}
+	diffIDs := config["rootfs"].(map[string]interface{})["diff_ids"].([]interface{})
+	if len(manifest.Layers) != 1 || len(diffIDs) != 1 || len(config["history"].([]interface{})) != 1 {
+		t.Fatalf("bad layers: %s %s", Pformat(manifest), Pformat(config))
+	}
+	blob, err := os.ReadFile(OCIBlobPath(out, manifest.Layers[0].Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha256Digest(blob) != manifest.Layers[0].Digest {
+		t.Error("layer digest mismatch")
+	}
+	f, err := os.Open(OCIBlobPath(out, manifest.Layers[0].Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha256Digest(uncompressed) != diffIDs[0] || !reflect.DeepEqual(uncompressed, layer) {
+		t.Error("diff id mismatch")
+	}
+	var dockerManifests []Manifest
+	readJSON(t, path.Join(out, "manifest.json"), &dockerManifests)
+	if len(dockerManifests) != 1 || dockerManifests[0].RepoTags[0] != "example.com/app:min" || dockerManifests[0].Config != OCIBlobPath("", manifest.Config.Digest) {
+		t.Errorf("bad docker manifest: %s", Pformat(dockerManifests))
+	}
+	archive := path.Join(dir, "oci.tar")
+	err = OCIWriteArchive(out, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+	names := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[header.Name] = true
+	}
+	for _, name := range []string{"oci-layout", "index.json", "manifest.json", OCIBlobPath("", desc.Digest)} {
+		if !names[name] {
+			t.Errorf("archive missing %s: %v", name, names)
+		}
+	}
+}
+
+func TestConfigApplyOverrides(t *testing.T) {
+	source := []byte(`{"architecture":"amd64","os":"linux","config":{"Env":["PATH=/bin","DEBUG=1","LANG=C"],"Entrypoint":["/app"],"User":"app","Labels":{"org.opencontainers.image.title":"app","build.commit":"abc","build.date":"today"}}}`)
+	result, err := ConfigApplyOverrides(source, ConfigOverrides{
+		SetEnv:    []string{"LANG=C.UTF-8", "MODE=prod"},
+		DropEnv:   []string{"DEBUG"},
+		SetLabel:  []string{"minified=true"},
+		DropLabel: []string{"build.*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config map[string]interface{}
+	err = json.Unmarshal(result, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config["architecture"] != "amd64" || config["os"] != "linux" {
+		t.Fatal("platform not preserved", config)
+	}
+	runtimeConfig := config["config"].(map[string]interface{})
+	if runtimeConfig["User"] != "app" || !reflect.DeepEqual(runtimeConfig["Entrypoint"], []interface{}{"/app"}) {
+		t.Fatal("runtime config not preserved", runtimeConfig)
+	}
+	env := runtimeConfig["Env"]
+	if !reflect.DeepEqual(env, []interface{}{"PATH=/bin", "LANG=C.UTF-8", "MODE=prod"}) {
+		t.Fatal("bad env", env)
+	}
+	labels := runtimeConfig["Labels"]
+	if !reflect.DeepEqual(labels, map[string]interface{}{"org.opencontainers.image.title": "app", "minified": "true"}) {
+		t.Fatal("bad labels", labels)
+	}
+}
+
+func TestConfigApplyOverridesInvalid(t *testing.T) {
+	_, err := ConfigApplyOverrides([]byte(`{"config":{}}`), ConfigOverrides{SetEnv: []string{"NOVALUE"}})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	result, err := ConfigApplyOverrides([]byte(`{"config":{}}`), ConfigOverrides{SetLabel: []string{"a=b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config map[string]interface{}
+	err = json.Unmarshal(result, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config["config"], map[string]interface{}{"Labels": map[string]interface{}{"a": "b"}}) {
+		t.Fatal("bad config", config)
+	}
+}
@@ -0,0 +1,487 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	dpkgStatus   = "/var/lib/dpkg/status"
+	dpkgInfo     = "/var/lib/dpkg/info/"
+	dpkgStatusD  = "/var/lib/dpkg/status.d/"
+	apkInstalled = "/lib/apk/db/installed"
+)
+
+var rpmDatabases = []string{
+	"/var/lib/rpm/rpmdb.sqlite",
+	"/usr/lib/sysimage/rpm/rpmdb.sqlite",
+}
+
+// PackageDBPath is true for the files of dpkg, apk and rpm databases, whose content lib.ScanLayer keeps
+func PackageDBPath(pth string) bool {
+	return pth == dpkgStatus ||
+		pth == apkInstalled ||
+		Contains(rpmDatabases, pth) ||
+		(strings.HasPrefix(pth, dpkgStatusD) && !strings.Contains(strings.TrimPrefix(pth, dpkgStatusD), "/")) ||
+		(strings.HasPrefix(pth, dpkgInfo) && (strings.HasSuffix(pth, ".list") || strings.HasSuffix(pth, ".md5sums")))
+}
+
+type Package struct {
+	Manager string
+	Name    string
+	Version string
+	Arch    string
+	Files   []string
+	// DBFiles are the files of the package database that belong to this package, like dpkg info files
+	DBFiles []string
+}
+
+// PackageDB holds the installed packages of an image and which package owns each path
+type PackageDB struct {
+	Packages []*Package
+	// Databases are the database files read, which are rewritten by PackagesRewrite
+	Databases []string
+	owners    map[string]*Package
+}
+
+type PackageStatus struct {
+	Manager   string `json:"manager"`
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Status    string `json:"status"`
+	KeptFiles int    `json:"kept_files"`
+	Files     int    `json:"files"`
+}
+
+const (
+	PackageKept    = "kept"
+	PackagePartial = "partial"
+	PackageRemoved = "removed"
+)
+
+// packagePath is the path of a packaged file in the final filesystem, resolving symlinks in its parent
+// directories like /bin on merged /usr systems, but not in the last component
+func packagePath(filesystem *Filesystem, pth string) string {
+	pth = CleanPath(pth)
+	if pth == "/" {
+		return pth
+	}
+	dir, _, _ := filesystem.Resolve(path.Dir(pth))
+	return path.Join(dir, path.Base(pth))
+}
+
+// stanzas splits dpkg and apk databases into blocks of lines separated by empty lines
+func stanzas(data []byte) [][]string {
+	var result [][]string
+	var stanza []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(stanza) > 0 {
+				result = append(result, stanza)
+			}
+			stanza = nil
+			continue
+		}
+		stanza = append(stanza, line)
+	}
+	if len(stanza) > 0 {
+		result = append(result, stanza)
+	}
+	return result
+}
+
+// dpkgField reads a field from a dpkg stanza
+func dpkgField(stanza []string, name string) string {
+	for _, line := range stanza {
+		if strings.HasPrefix(line, name+":") {
+			return strings.TrimSpace(strings.TrimPrefix(line, name+":"))
+		}
+	}
+	return ""
+}
+
+// dpkgMd5sumsPaths reads the paths of a dpkg md5sums file, which are relative to /
+func dpkgMd5sumsPaths(data []byte) []string {
+	var result []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(line, "  ", 2)
+		if len(fields) == 2 {
+			result = append(result, "/"+fields[1])
+		}
+	}
+	return result
+}
+
+func readDpkg(filesystem *Filesystem) []*Package {
+	var result []*Package
+	f, ok := filesystem.Files[dpkgStatus]
+	if ok {
+		for _, stanza := range stanzas(f.Content) {
+			if !strings.HasSuffix(dpkgField(stanza, "Status"), " installed") {
+				continue
+			}
+			pkg := &Package{
+				Manager: "dpkg",
+				Name:    dpkgField(stanza, "Package"),
+				Version: dpkgField(stanza, "Version"),
+				Arch:    dpkgField(stanza, "Architecture"),
+			}
+			// multi arch packages have their architecture in the name of their info files
+			for _, name := range []string{pkg.Name, pkg.Name + ":" + pkg.Arch} {
+				list, ok := filesystem.Files[dpkgInfo+name+".list"]
+				if !ok {
+					continue
+				}
+				for _, line := range strings.Split(string(list.Content), "\n") {
+					if line != "" && line != "/." {
+						pkg.Files = append(pkg.Files, line)
+					}
+				}
+				for p := range filesystem.Files {
+					if strings.HasPrefix(p, dpkgInfo+name+".") && !strings.Contains(strings.TrimPrefix(p, dpkgInfo+name+"."), ".") {
+						pkg.DBFiles = append(pkg.DBFiles, p)
+					}
+				}
+			}
+			sort.Strings(pkg.DBFiles)
+			result = append(result, pkg)
+		}
+	}
+	// distroless images have one status file per package, with the file list only in md5sums
+	for p, f := range filesystem.Files {
+		if !strings.HasPrefix(p, dpkgStatusD) || strings.HasSuffix(p, ".md5sums") || f.Mode.IsDir() {
+			continue
+		}
+		for _, stanza := range stanzas(f.Content) {
+			pkg := &Package{
+				Manager: "dpkg",
+				Name:    dpkgField(stanza, "Package"),
+				Version: dpkgField(stanza, "Version"),
+				Arch:    dpkgField(stanza, "Architecture"),
+				DBFiles: []string{p},
+			}
+			md5sums, ok := filesystem.Files[p+".md5sums"]
+			if ok {
+				pkg.Files = dpkgMd5sumsPaths(md5sums.Content)
+				pkg.DBFiles = append(pkg.DBFiles, p+".md5sums")
+			}
+			result = append(result, pkg)
+		}
+	}
+	return result
+}
+
+func readApk(filesystem *Filesystem) []*Package {
+	f, ok := filesystem.Files[apkInstalled]
+	if !ok {
+		return nil
+	}
+	var result []*Package
+	for _, stanza := range stanzas(f.Content) {
+		pkg := &Package{Manager: "apk"}
+		dir := "/"
+		for _, line := range stanza {
+			if len(line) < 2 || line[1] != ':' {
+				continue
+			}
+			value := line[2:]
+			switch line[0] {
+			case 'P':
+				pkg.Name = value
+			case 'V':
+				pkg.Version = value
+			case 'A':
+				pkg.Arch = value
+			case 'F':
+				dir = "/" + value
+				pkg.Files = append(pkg.Files, dir)
+			case 'R':
+				pkg.Files = append(pkg.Files, path.Join(dir, value))
+			}
+		}
+		if pkg.Name != "" {
+			result = append(result, pkg)
+		}
+	}
+	return result
+}
+
+// ReadPackages reads the dpkg, apk and rpm databases from the final view of an image, scanned with the
+// content of package database files
+func ReadPackages(filesystem *Filesystem) (*PackageDB, error) {
+	db := &PackageDB{owners: make(map[string]*Package)}
+	db.Packages = append(db.Packages, readDpkg(filesystem)...)
+	db.Packages = append(db.Packages, readApk(filesystem)...)
+	for _, p := range append([]string{dpkgStatus, apkInstalled}, rpmDatabases...) {
+		_, ok := filesystem.Files[p]
+		if ok {
+			db.Databases = append(db.Databases, p)
+		}
+	}
+	for p := range filesystem.Files {
+		if strings.HasPrefix(p, dpkgStatusD) && !strings.HasSuffix(p, ".md5sums") {
+			db.Databases = append(db.Databases, p)
+		}
+	}
+	for _, p := range rpmDatabases {
+		f, ok := filesystem.Files[p]
+		if !ok {
+			continue
+		}
+		packages, err := readRpm(f.Content)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		db.Packages = append(db.Packages, packages...)
+		break // both paths are the same database when /var/lib/rpm is a symlink
+	}
+	sort.SliceStable(db.Packages, func(i, j int) bool { return db.Packages[i].Name < db.Packages[j].Name })
+	sort.Strings(db.Databases)
+	for _, pkg := range db.Packages {
+		for _, p := range pkg.Files {
+			db.owners[packagePath(filesystem, p)] = pkg
+		}
+	}
+	return db, nil
+}
+
+// Owner is the package that installed a path of the final filesystem
+func (db *PackageDB) Owner(pth string) (*Package, bool) {
+	pkg, ok := db.owners[CleanPath(pth)]
+	return pkg, ok
+}
+
+// packageFiles are the paths of a package which exist in the image and are not directories. paths
+// listed as parents of other paths are directories to the package, even when the image has a symlink
+// there, like /lib on merged /usr systems.
+func packageFiles(filesystem *Filesystem, pkg *Package) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, p := range pkg.Files {
+		seen[path.Dir(CleanPath(p))] = true
+	}
+	for _, p := range pkg.Files {
+		if seen[CleanPath(p)] {
+			continue
+		}
+		p = packagePath(filesystem, p)
+		f, ok := filesystem.Files[p]
+		if !ok || f.Mode.IsDir() || seen[p] {
+			continue
+		}
+		seen[p] = true
+		result = append(result, p)
+	}
+	return result
+}
+
+func packageStatus(filesystem *Filesystem, pkg *Package, includePaths map[string]string) PackageStatus {
+	status := PackageStatus{Manager: pkg.Manager, Name: pkg.Name, Version: pkg.Version}
+	for _, p := range packageFiles(filesystem, pkg) {
+		status.Files++
+		_, ok := includePaths[p]
+		if ok {
+			status.KeptFiles++
+		}
+	}
+	switch {
+	case status.KeptFiles == status.Files:
+		status.Status = PackageKept
+	case status.KeptFiles == 0:
+		status.Status = PackageRemoved
+	default:
+		status.Status = PackagePartial
+	}
+	return status
+}
+
+// PackagesReport describes whether each package survived minification fully, partially or not at all.
+// packages with no files in the image, like meta packages, are kept.
+func PackagesReport(db *PackageDB, filesystem *Filesystem, includePaths map[string]string) []PackageStatus {
+	var result []PackageStatus
+	for _, pkg := range db.Packages {
+		result = append(result, packageStatus(filesystem, pkg, includePaths))
+	}
+	return result
+}
+
+// PackagesExpand keeps every file of packages which are partially kept, returning how many paths were added
+func PackagesExpand(db *PackageDB, filesystem *Filesystem, includePaths map[string]string) int {
+	count := 0
+	for _, pkg := range db.Packages {
+		if packageStatus(filesystem, pkg, includePaths).Status != PackagePartial {
+			continue
+		}
+		for _, p := range packageFiles(filesystem, pkg) {
+			_, ok := includePaths[p]
+			if !ok {
+				includePaths[p] = "package " + pkg.Name
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// packageKeep is true for packaged paths which remain, either kept files or directories holding them
+func packageKeep(filesystem *Filesystem, includePaths map[string]string, keptDirs map[string]bool, pth string) bool {
+	pth = packagePath(filesystem, pth)
+	_, ok := includePaths[pth]
+	return ok || keptDirs[pth]
+}
+
+func packageKeptDirs(filesystem *Filesystem, pkg *Package, includePaths map[string]string) map[string]bool {
+	dirs := make(map[string]bool)
+	for _, p := range packageFiles(filesystem, pkg) {
+		_, ok := includePaths[p]
+		if !ok {
+			continue
+		}
+		for dir := path.Dir(p); !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	return dirs
+}
+
+// rewriteLines keeps the lines of a file list for which keep is true
+func rewriteLines(data []byte, keep func(line string) bool) []byte {
+	var buf bytes.Buffer
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line != "" && keep(strings.TrimSuffix(line, "\n")) {
+			buf.WriteString(line)
+		}
+	}
+	return buf.Bytes()
+}
+
+// PackagesRewrite keeps the package databases in the image, rewritten so removed packages are dropped and
+// partially kept packages list only their remaining files. it returns the new content of rewritten
+// files. rpm databases cannot be rewritten, so they are only kept when already kept.
+func PackagesRewrite(db *PackageDB, filesystem *Filesystem, includePaths map[string]string) map[string][]byte {
+	rewrites := make(map[string][]byte)
+	keep := func(pth string) {
+		_, ok := includePaths[pth]
+		if !ok {
+			includePaths[pth] = "package db"
+		}
+	}
+	removed := make(map[*Package]bool)
+	keptDirs := make(map[*Package]map[string]bool)
+	for _, pkg := range db.Packages {
+		removed[pkg] = packageStatus(filesystem, pkg, includePaths).Status == PackageRemoved
+		keptDirs[pkg] = packageKeptDirs(filesystem, pkg, includePaths)
+	}
+	remains := func(pkg *Package, line string) bool {
+		return packageKeep(filesystem, includePaths, keptDirs[pkg], line)
+	}
+	for _, pkg := range db.Packages {
+		if pkg.Manager != "dpkg" || removed[pkg] {
+			continue
+		}
+		for _, p := range pkg.DBFiles {
+			keep(p)
+			f := filesystem.Files[p]
+			switch {
+			case strings.HasSuffix(p, ".list"):
+				rewrites[p] = rewriteLines(f.Content, func(line string) bool {
+					return line == "/." || remains(pkg, line)
+				})
+			case strings.HasSuffix(p, ".md5sums"):
+				rewrites[p] = rewriteLines(f.Content, func(line string) bool {
+					fields := strings.SplitN(line, "  ", 2)
+					return len(fields) == 2 && remains(pkg, "/"+fields[1])
+				})
+			}
+		}
+	}
+	dpkgRemoved := make(map[string]bool)
+	apkRemoved := make(map[string]*Package)
+	apkKept := make(map[string]*Package)
+	for _, pkg := range db.Packages {
+		switch {
+		case pkg.Manager == "dpkg" && removed[pkg]:
+			dpkgRemoved[pkg.Name] = true
+		case pkg.Manager == "apk" && removed[pkg]:
+			apkRemoved[pkg.Name] = pkg
+		case pkg.Manager == "apk":
+			apkKept[pkg.Name] = pkg
+		}
+	}
+	for _, p := range db.Databases {
+		f := filesystem.Files[p]
+		switch {
+		case p == dpkgStatus:
+			keep(p)
+			var buf bytes.Buffer
+			for _, stanza := range stanzas(f.Content) {
+				if dpkgRemoved[dpkgField(stanza, "Package")] && strings.HasSuffix(dpkgField(stanza, "Status"), " installed") {
+					continue
+				}
+				buf.WriteString(strings.Join(stanza, "\n") + "\n\n")
+			}
+			rewrites[p] = buf.Bytes()
+		case p == apkInstalled:
+			keep(p)
+			var buf bytes.Buffer
+			for _, stanza := range stanzas(f.Content) {
+				name := ""
+				for _, line := range stanza {
+					if strings.HasPrefix(line, "P:") {
+						name = line[2:]
+					}
+				}
+				if apkRemoved[name] != nil {
+					continue
+				}
+				pkg := apkKept[name]
+				dir := "/"
+				keepFile := true
+				for _, line := range stanza {
+					if pkg != nil && len(line) > 2 && line[1] == ':' {
+						switch line[0] {
+						case 'F':
+							dir = "/" + line[2:]
+							keepFile = true
+							if !remains(pkg, dir) {
+								keepFile = false
+								continue
+							}
+						case 'M':
+							if !keepFile {
+								continue
+							}
+						case 'R':
+							keepFile = remains(pkg, path.Join(dir, line[2:]))
+							if !keepFile {
+								continue
+							}
+						case 'a', 'Z':
+							if !keepFile {
+								continue
+							}
+						}
+					}
+					buf.WriteString(line + "\n")
+				}
+				buf.WriteString("\n")
+			}
+			rewrites[p] = buf.Bytes()
+		case strings.HasPrefix(p, dpkgStatusD):
+			// kept with the package in the loop above
+		default:
+			_, ok := includePaths[p]
+			if !ok {
+				Logger.Println("warning: the rpm database cannot be rewritten, it is removed:", p)
+			}
+		}
+	}
+	return rewrites
+}
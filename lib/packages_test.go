@@ -0,0 +1,280 @@
+package lib
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testPackageStatuses(statuses []PackageStatus) map[string]string {
+	result := make(map[string]string)
+	for _, status := range statuses {
+		result[status.Name] = status.Status
+	}
+	return result
+}
+
+func TestPackagesDpkg(t *testing.T) {
+	filesystem := testPackageFiles(map[string]string{
+		dpkgStatus: "Package: curl\nStatus: install ok installed\nVersion: 7.88\nArchitecture: amd64\n\n" +
+			"Package: libc6\nStatus: install ok installed\nMulti-Arch: same\nVersion: 2.36\nArchitecture: amd64\nDescription: libc\n more\n\n" +
+			"Package: vim\nStatus: install ok installed\nVersion: 9.0\nArchitecture: amd64\n\n" +
+			"Package: gone\nStatus: deinstall ok config-files\nVersion: 1.0\n",
+		dpkgInfo + "curl.list":          "/.\n/usr\n/usr/bin\n/usr/bin/curl\n/usr/share/doc/curl/copyright\n",
+		dpkgInfo + "curl.md5sums":       "aaa  usr/bin/curl\nbbb  usr/share/doc/curl/copyright\n",
+		dpkgInfo + "curl.postinst":      "",
+		dpkgInfo + "libc6:amd64.list":   "/.\n/lib\n/lib/libc.so.6\n",
+		dpkgInfo + "vim.list":           "/.\n/usr/bin/vim\n",
+		"/usr/bin/curl":                 "curl",
+		"/usr/share/doc/curl/copyright": "mit",
+		"/usr/lib/libc.so.6":            "libc",
+		"/usr/bin/vim":                  "vim",
+	}, map[string]string{"/lib": "usr/lib"})
+	db, err := ReadPackages(filesystem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Packages) != 3 {
+		t.Fatal("bad packages", Pformat(db.Packages))
+	}
+	pkg, ok := db.Owner("/usr/lib/libc.so.6")
+	if !ok || pkg.Name != "libc6" || pkg.Version != "2.36" {
+		t.Fatal("bad owner through merged /usr", Pformat(pkg))
+	}
+	includePaths := map[string]string{"/usr/bin/curl": "trace", "/usr/lib/libc.so.6": "elf"}
+	statuses := testPackageStatuses(PackagesReport(db, filesystem, includePaths))
+	if !reflect.DeepEqual(statuses, map[string]string{"curl": PackagePartial, "libc6": PackageKept, "vim": PackageRemoved}) {
+		t.Fatal("bad statuses", statuses)
+	}
+	//
+	rewrites := PackagesRewrite(db, filesystem, includePaths)
+	status := string(rewrites[dpkgStatus])
+	if strings.Contains(status, "Package: vim") || !strings.Contains(status, "Package: gone") || !strings.Contains(status, "Description: libc\n more\n") {
+		t.Fatal("bad status", status)
+	}
+	if string(rewrites[dpkgInfo+"curl.list"]) != "/.\n/usr\n/usr/bin\n/usr/bin/curl\n" {
+		t.Fatal("bad list", string(rewrites[dpkgInfo+"curl.list"]))
+	}
+	if string(rewrites[dpkgInfo+"curl.md5sums"]) != "aaa  usr/bin/curl\n" {
+		t.Fatal("bad md5sums", string(rewrites[dpkgInfo+"curl.md5sums"]))
+	}
+	for _, p := range []string{dpkgStatus, dpkgInfo + "curl.list", dpkgInfo + "curl.postinst", dpkgInfo + "libc6:amd64.list"} {
+		if includePaths[p] != "package db" {
+			t.Fatal("package db file not kept", p)
+		}
+	}
+	_, ok = includePaths[dpkgInfo+"vim.list"]
+	if ok {
+		t.Fatal("removed package info kept")
+	}
+	//
+	includePaths = map[string]string{"/usr/bin/curl": "trace"}
+	count := PackagesExpand(db, filesystem, includePaths)
+	if count != 1 || includePaths["/usr/share/doc/curl/copyright"] != "package curl" {
+		t.Fatal("bad expand", includePaths)
+	}
+}
+
+func TestPackagesDpkgDistroless(t *testing.T) {
+	filesystem := testPackageFiles(map[string]string{
+		dpkgStatusD + "base-files":         "Package: base-files\nVersion: 12\nArchitecture: amd64\n",
+		dpkgStatusD + "base-files.md5sums": "aaa  etc/os-release\nbbb  etc/issue\n",
+		"/etc/os-release":                  "debian",
+		"/etc/issue":                       "debian",
+	}, nil)
+	db, err := ReadPackages(filesystem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	includePaths := map[string]string{"/etc/os-release": "trace"}
+	statuses := PackagesReport(db, filesystem, includePaths)
+	if len(statuses) != 1 || statuses[0].Status != PackagePartial || statuses[0].KeptFiles != 1 || statuses[0].Files != 2 {
+		t.Fatal("bad statuses", statuses)
+	}
+	rewrites := PackagesRewrite(db, filesystem, includePaths)
+	if string(rewrites[dpkgStatusD+"base-files.md5sums"]) != "aaa  etc/os-release\n" || includePaths[dpkgStatusD+"base-files"] != "package db" {
+		t.Fatal("bad rewrite", rewrites, includePaths)
+	}
+}
+
+func TestPackagesApk(t *testing.T) {
+	filesystem := testPackageFiles(map[string]string{
+		apkInstalled: "C:Q1abc\nP:musl\nV:1.2.4-r1\nA:x86_64\nF:lib\nR:ld-musl-x86_64.so.1\na:0:0:755\nZ:Q1aaa\nR:libc.musl-x86_64.so.1\nZ:Q1bbb\n\n" +
+			"C:Q1def\nP:busybox\nV:1.36.1-r2\nA:x86_64\nF:bin\nR:busybox\nZ:Q1ccc\nF:etc\nR:securetty\nZ:Q1ddd\n\n" +
+			"C:Q1ghi\nP:zlib\nV:1.3-r0\nA:x86_64\nF:lib\nR:libz.so.1\nZ:Q1eee\n\n",
+		"/lib/ld-musl-x86_64.so.1":   "musl",
+		"/lib/libc.musl-x86_64.so.1": "musl",
+		"/bin/busybox":               "busybox",
+		"/etc/securetty":             "tty",
+		"/lib/libz.so.1":             "zlib",
+	}, nil)
+	db, err := ReadPackages(filesystem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	includePaths := map[string]string{"/bin/busybox": "trace", "/lib/ld-musl-x86_64.so.1": "elf", "/lib/libc.musl-x86_64.so.1": "symlink"}
+	statuses := testPackageStatuses(PackagesReport(db, filesystem, includePaths))
+	if !reflect.DeepEqual(statuses, map[string]string{"busybox": PackagePartial, "musl": PackageKept, "zlib": PackageRemoved}) {
+		t.Fatal("bad statuses", statuses)
+	}
+	rewrites := PackagesRewrite(db, filesystem, includePaths)
+	expected := "C:Q1abc\nP:musl\nV:1.2.4-r1\nA:x86_64\nF:lib\nR:ld-musl-x86_64.so.1\na:0:0:755\nZ:Q1aaa\nR:libc.musl-x86_64.so.1\nZ:Q1bbb\n\n" +
+		"C:Q1def\nP:busybox\nV:1.36.1-r2\nA:x86_64\nF:bin\nR:busybox\nZ:Q1ccc\n\n"
+	if string(rewrites[apkInstalled]) != expected {
+		t.Fatal("bad installed", string(rewrites[apkInstalled]))
+	}
+}
+
+// testSqlite writes a database with one page holding the schema and one page holding the rows of a
+// table with an integer primary key and a blob
+func testSqlite(table string, blobs [][]byte) []byte {
+	const size = 4096
+	data := make([]byte, 2*size)
+	copy(data, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(data[16:], size)
+	data[56] = 1
+	record := func(columns ...interface{}) []byte {
+		var header, body []byte
+		for _, column := range columns {
+			switch v := column.(type) {
+			case nil:
+				header = append(header, 0)
+			case int:
+				header = append(header, 1)
+				body = append(body, byte(v))
+			case string:
+				header = append(header, byte(13+2*len(v)))
+				body = append(body, v...)
+			case []byte:
+				header = append(header, 0x80|byte((12+2*len(v))>>7), byte((12+2*len(v))&0x7f))
+				body = append(body, v...)
+			}
+		}
+		return append(append([]byte{byte(len(header) + 1)}, header...), body...)
+	}
+	leaf := func(page []byte, offset int, records [][]byte) {
+		page[offset] = 0x0d
+		binary.BigEndian.PutUint16(page[offset+3:], uint16(len(records)))
+		end := len(page)
+		for i, r := range records {
+			cell := append([]byte{0x80 | byte(len(r)>>7), byte(len(r) & 0x7f), byte(i + 1)}, r...)
+			end -= len(cell)
+			copy(page[end:], cell)
+			binary.BigEndian.PutUint16(page[offset+8+2*i:], uint16(end))
+		}
+	}
+	leaf(data[:size], 100, [][]byte{record("table", table, table, 2, "CREATE TABLE "+table)})
+	var rows [][]byte
+	for _, blob := range blobs {
+		rows = append(rows, record(nil, blob))
+	}
+	leaf(data[size:], 0, rows)
+	return data
+}
+
+func testRpmHeader(name, version, release string, dirs []string, files []string, indexes []int) []byte {
+	var entries, store []byte
+	add := func(tag, kind, count int, value []byte) {
+		for kind == rpmTypeInt32 && len(store)%4 != 0 {
+			store = append(store, 0)
+		}
+		entry := make([]byte, 16)
+		binary.BigEndian.PutUint32(entry[0:], uint32(tag))
+		binary.BigEndian.PutUint32(entry[4:], uint32(kind))
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(store)))
+		binary.BigEndian.PutUint32(entry[12:], uint32(count))
+		entries = append(entries, entry...)
+		store = append(store, value...)
+	}
+	strs := func(xs []string) []byte { return []byte(strings.Join(xs, "\x00") + "\x00") }
+	add(rpmTagName, rpmTypeString, 1, strs([]string{name}))
+	add(rpmTagVersion, rpmTypeString, 1, strs([]string{version}))
+	add(rpmTagRelease, rpmTypeString, 1, strs([]string{release}))
+	add(rpmTagBasenames, rpmTypeStringArray, len(files), strs(files))
+	add(rpmTagDirNames, rpmTypeStringArray, len(dirs), strs(dirs))
+	var ints []byte
+	for _, i := range indexes {
+		ints = binary.BigEndian.AppendUint32(ints, uint32(i))
+	}
+	add(rpmTagDirIndexes, rpmTypeInt32, len(indexes), ints)
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:], uint32(len(entries)/16))
+	binary.BigEndian.PutUint32(header[4:], uint32(len(store)))
+	return append(append(header, entries...), store...)
+}
+
+func TestPackagesRpm(t *testing.T) {
+	db := testSqlite("Packages", [][]byte{
+		testRpmHeader("bash", "5.2.15", "3.el9", []string{"/usr/bin/", "/etc/"}, []string{"bash", "sh", "bashrc"}, []int{0, 0, 1}),
+		testRpmHeader("gpg-pubkey", "1", "1", nil, nil, nil),
+	})
+	filesystem := testPackageFiles(map[string]string{
+		"/var/lib/rpm/rpmdb.sqlite": string(db),
+		"/usr/bin/bash":             "bash",
+		"/etc/bashrc":               "rc",
+	}, map[string]string{"/usr/bin/sh": "bash"})
+	packages, err := ReadPackages(filesystem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packages.Packages) != 1 {
+		t.Fatal("bad packages", Pformat(packages.Packages))
+	}
+	pkg := packages.Packages[0]
+	if pkg.Name != "bash" || pkg.Version != "5.2.15-3.el9" || !reflect.DeepEqual(pkg.Files, []string{"/usr/bin/bash", "/usr/bin/sh", "/etc/bashrc"}) {
+		t.Fatal("bad package", Pformat(pkg))
+	}
+	includePaths := map[string]string{"/usr/bin/sh": "trace", "/usr/bin/bash": "symlink"}
+	statuses := PackagesReport(packages, filesystem, includePaths)
+	if len(statuses) != 1 || statuses[0].Status != PackagePartial || statuses[0].KeptFiles != 2 || statuses[0].Files != 3 {
+		t.Fatal("bad statuses", statuses)
+	}
+	rewrites := PackagesRewrite(packages, filesystem, includePaths)
+	_, ok := includePaths["/var/lib/rpm/rpmdb.sqlite"]
+	if len(rewrites) != 0 || ok {
+		t.Fatal("rpm database cannot be rewritten")
+	}
+}
+
+func TestPackagesRpmCorrupt(t *testing.T) {
+	const size = 4096
+	db := testSqlite("Packages", [][]byte{
+		testRpmHeader("bash", "5.2.15", "3.el9", []string{"/usr/bin/"}, []string{"bash"}, []int{0}),
+	})
+	corrupt := func(fn func(data []byte)) []byte {
+		data := append([]byte{}, db...)
+		fn(data)
+		return data
+	}
+	for name, data := range map[string][]byte{
+		"cell count":   corrupt(func(data []byte) { binary.BigEndian.PutUint16(data[size+3:], 0xffff) }),
+		"cell pointer": corrupt(func(data []byte) { binary.BigEndian.PutUint16(data[size+8:], 0xffff) }),
+		"cell size": corrupt(func(data []byte) {
+			cell := size + int(binary.BigEndian.Uint16(data[size+8:]))
+			copy(data[cell:], []byte{0xff, 0xff, 0xff, 0x7f})
+		}),
+	} {
+		_, err := readRpm(data)
+		if err == nil {
+			t.Fatal("corrupt database was read", name)
+		}
+	}
+	// any corrupt byte may fail to read, but must not panic
+	for i := range db {
+		_, _ = readRpm(corrupt(func(data []byte) { data[i] ^= 0xff }))
+	}
+}
+
+func TestPackagesScanContent(t *testing.T) {
+	for _, p := range []string{dpkgStatus, dpkgInfo + "curl.list", dpkgInfo + "libc6:amd64.md5sums", dpkgStatusD + "base", apkInstalled, "/var/lib/rpm/rpmdb.sqlite"} {
+		if !ScanContentPath(p) {
+			t.Fatal("package database content not scanned", p)
+		}
+	}
+	for _, p := range []string{dpkgInfo + "curl.postinst", "/usr/bin/curl", dpkgStatusD + "a/b"} {
+		if ScanContentPath(p) {
+			t.Fatal("content scanned", p)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// PlatformString formats a platform like linux/arm64/v8
+func PlatformString(p OCIPlatform) string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// ParsePlatform parses os/arch or os/arch/variant
+func ParsePlatform(s string) (OCIPlatform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		err := fmt.Errorf("platform must look like os/arch or os/arch/variant, got: %s", s)
+		Logger.Println("error:", err)
+		return OCIPlatform{}, err
+	}
+	p := OCIPlatform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// PlatformMatch is true when p is the platform named by s. a variant is only compared when s has one.
+func PlatformMatch(p OCIPlatform, s string) bool {
+	want, err := ParsePlatform(s)
+	if err != nil {
+		return false
+	}
+	return p.OS == want.OS && p.Architecture == want.Architecture && (want.Variant == "" || p.Variant == want.Variant)
+}
+
+// ociPlatforms are the manifests of a multi platform index that are images, skipping attestation
+// manifests which have an unknown platform
+func ociPlatforms(descs []OCIDescriptor) []OCIDescriptor {
+	var result []OCIDescriptor
+	for _, desc := range descs {
+		if desc.Platform == nil || desc.Platform.OS == "unknown" {
+			continue
+		}
+		result = append(result, desc)
+	}
+	return result
+}
+
+// ociFindPlatform chooses a manifest from a multi platform index. an empty platform prefers this
+// machine, then the first image.
+func ociFindPlatform(descs []OCIDescriptor, platform string) (OCIDescriptor, error) {
+	candidates := ociPlatforms(descs)
+	if platform != "" {
+		for _, desc := range candidates {
+			if PlatformMatch(*desc.Platform, platform) {
+				return desc, nil
+			}
+		}
+		err := fmt.Errorf("platform %s not found in image index", platform)
+		Logger.Println("error:", err)
+		return OCIDescriptor{}, err
+	}
+	for _, desc := range candidates {
+		if desc.Platform.OS == "linux" && desc.Platform.Architecture == runtime.GOARCH {
+			return desc, nil
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates[0], nil
+	}
+	if len(descs) > 0 {
+		return descs[0], nil
+	}
+	err := fmt.Errorf("empty index in image tarball")
+	Logger.Println("error:", err)
+	return OCIDescriptor{}, err
+}
+
+// ImagePlatforms lists the platforms of a multi platform image from a registry or oci layout. it
+// returns nothing for single platform images and images in docker, which are saved for one platform.
+func ImagePlatforms(ctx context.Context, name string) ([]string, error) {
+	var mediaType string
+	var data []byte
+	switch {
+	case strings.HasPrefix(name, RefRegistry):
+		ref, err := ParseRegistryRef(name)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		reg := NewRegistry(ref)
+		err = reg.Login(ctx, "pull")
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		mediaType, data, err = reg.Manifest(ctx, ref.Reference)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+	case strings.HasPrefix(name, RefOCI):
+		dir, refName := ParseOCIRef(name)
+		indexData, err := os.ReadFile(path.Join(dir, "index.json"))
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		var index OCIIndex
+		err = json.Unmarshal(indexData, &index)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		desc, err := ociFindDescriptor(index.Manifests, refName)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		mediaType = desc.MediaType
+		data, err = os.ReadFile(OCIBlobPath(dir, desc.Digest))
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	if mediaType != MediaTypeOCIIndex && mediaType != MediaTypeDockerManifestList {
+		return nil, nil
+	}
+	var index OCIIndex
+	err := json.Unmarshal(data, &index)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	var result []string
+	for _, desc := range ociPlatforms(index.Manifests) {
+		result = append(result, PlatformString(*desc.Platform))
+	}
+	return result, nil
+}
+
+// PlatformDiff is how the kept paths of one platform differ from the trace and from the other
+// platforms being minified
+type PlatformDiff struct {
+	// Missing are traced paths not in this platform, like paths of the architecture the trace came from
+	Missing []string `json:"missing"`
+	// Only are kept paths in this platform which another platform does not keep
+	Only []string `json:"only"`
+}
+
+// PlatformKept are the kept paths which exist in the filesystem of a platform, as absolute paths since
+// the symlink closure also keeps paths without a leading slash
+func PlatformKept(filesystem *Filesystem, includePaths map[string]string) map[string]bool {
+	kept := make(map[string]bool)
+	for p := range includePaths {
+		_, _, ok := filesystem.Resolve(p)
+		if ok {
+			kept[CleanPath("/"+strings.TrimLeft(p, "/"))] = true
+		}
+	}
+	return kept
+}
+
+// PlatformDiffs compares the kept paths of every platform with each other, given the traced paths
+// missing from each platform
+func PlatformDiffs(kept map[string]map[string]bool, missing map[string][]string) map[string]*PlatformDiff {
+	result := make(map[string]*PlatformDiff)
+	for platform, paths := range kept {
+		diff := &PlatformDiff{Missing: missing[platform]}
+		for p := range paths {
+			for other, otherPaths := range kept {
+				if other != platform && !otherPaths[p] {
+					diff.Only = append(diff.Only, p)
+					break
+				}
+			}
+		}
+		sort.Strings(diff.Only)
+		result[platform] = diff
+	}
+	return result
+}
+
+// Write prints the traced paths missing from the platform and the kept paths only in it
+func (diff *PlatformDiff) Write(w io.Writer) {
+	fmt.Fprintln(w, "platform-missing-path")
+	for _, p := range diff.Missing {
+		fmt.Fprintln(w, p)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "platform-only-path")
+	for _, p := range diff.Only {
+		fmt.Fprintln(w, p)
+	}
+}
@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestParsePlatform(t *testing.T) {
+	p, err := ParsePlatform("linux/arm64/v8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, OCIPlatform{OS: "linux", Architecture: "arm64", Variant: "v8"}) || PlatformString(p) != "linux/arm64/v8" {
+		t.Fatal("bad platform", p)
+	}
+	if !PlatformMatch(p, "linux/arm64") || PlatformMatch(p, "linux/arm64/v7") || PlatformMatch(p, "linux/amd64") {
+		t.Fatal("bad match")
+	}
+	for _, s := range []string{"linux", "linux/", "a/b/c/d"} {
+		_, err := ParsePlatform(s)
+		if err == nil {
+			t.Fatal("expected error", s)
+		}
+	}
+}
+
+func TestMultiPlatformOCIDir(t *testing.T) {
+	ctx := context.Background()
+	out := testMultiPlatform(t, "example.com/app:min", "amd64", "arm64")
+	if Exists(path.Join(out, "manifest.json")) {
+		t.Fatal("multi platform layouts cannot have a docker manifest.json")
+	}
+	platforms, err := ImagePlatforms(ctx, "oci:"+out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(platforms, []string{"linux/amd64", "linux/arm64"}) {
+		t.Fatal("bad platforms", platforms)
+	}
+	for _, arch := range []string{"amd64", "arm64"} {
+		archive, err := ImageOpen(ctx, "oci:"+out, "", "linux/"+arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths := testPlatformFiles(t, archive)
+		_ = archive.Close()
+		if !reflect.DeepEqual(paths, []string{"/" + arch}) {
+			t.Fatal("bad files", arch, paths)
+		}
+	}
+	_, err = ImageOpen(ctx, "oci:"+out, "", "linux/s390x")
+	if err == nil {
+		t.Fatal("expected missing platform to fail")
+	}
+}
+
+func TestMultiPlatformRegistry(t *testing.T) {
+	reg, host := newTestRegistry(t)
+	ctx := context.Background()
+	out := testMultiPlatform(t, host+"/app:min", "amd64", "arm64")
+	name := "registry://" + host + "/app:min"
+	err := RegistryPush(ctx, out, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.types["app/min"] != MediaTypeOCIIndex {
+		t.Fatal("expected an index to be pushed", reg.types["app/min"])
+	}
+	platforms, err := ImagePlatforms(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(platforms, []string{"linux/amd64", "linux/arm64"}) {
+		t.Fatal("bad platforms", platforms)
+	}
+	archive, err := ImageOpen(ctx, name, path.Join(t.TempDir(), "pulled.tar"), "linux/arm64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = archive.Close() }()
+	paths := testPlatformFiles(t, archive)
+	if !reflect.DeepEqual(paths, []string{"/arm64"}) {
+		t.Fatal("bad files", paths)
+	}
+}
+
+func TestImageOpenPlatformMismatch(t *testing.T) {
+	dir := t.TempDir()
+	layerTar := path.Join(dir, "layer.tar")
+	err := os.WriteFile(layerTar, testTar([]testEntry{testFile("a", "a")}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := path.Join(dir, "oci")
+	_, err = testOCIWriteImage(out, "example.com/app:min", []byte(`{"os": "linux", "architecture": "amd64", "config": {}}`), []string{layerTar})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := ImageOpen(context.Background(), "oci:"+out, "", "linux/amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = archive.Close()
+	_, err = ImageOpen(context.Background(), "oci:"+out, "", "linux/arm64")
+	if err == nil {
+		t.Fatal("expected platform mismatch to fail")
+	}
+}
+
+func TestMinifyPlatformDiff(t *testing.T) {
+	t.Setenv("DOCKER_TRACE_DATA_DIR", t.TempDir())
+	ctx := context.Background()
+	out := testMultiPlatform(t, "example.com/app:min", "amd64", "arm64")
+	opts := MinifyOptions{
+		Source:    ImageSource{Image: "oci:" + out},
+		Keeper:    &TraceKeeper{Events: []TraceEvent{{Path: "/amd64"}, {Path: "/arm64"}}},
+		Platforms: []string{"all"},
+		DryRun:    true,
+	}
+	result, err := Minify(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arch := range []string{"amd64", "arm64"} {
+		other := map[string]string{"amd64": "/arm64", "arm64": "/amd64"}[arch]
+		diff := result.PlatformDiffs["linux/"+arch]
+		if diff == nil || !reflect.DeepEqual(diff.Missing, []string{other}) || !reflect.DeepEqual(diff.Only, []string{"/" + arch}) {
+			t.Fatal("bad diff", arch, Pformat(result.PlatformDiffs))
+		}
+		if result.Reports["linux/"+arch].Platform != diff {
+			t.Fatal("diff not in report", arch)
+		}
+	}
+	// a trace from another architecture is the difference of a single platform
+	opts.Keeper = &TraceKeeper{Events: []TraceEvent{{Path: "/amd64"}}}
+	opts.Platforms = []string{"linux/arm64"}
+	result, err = Minify(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := result.PlatformDiffs["linux/arm64"]
+	if diff == nil || !reflect.DeepEqual(diff.Missing, []string{"/amd64"}) || len(diff.Only) != 0 {
+		t.Fatal("bad diff", Pformat(result.PlatformDiffs))
+	}
+}
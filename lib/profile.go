@@ -0,0 +1,245 @@
+package lib
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type ProfileRule struct {
+	Path   string `yaml:"path"`
+	Type   string `yaml:"type,omitempty"`
+	Reason string `yaml:"reason,omitempty"`
+}
+
+type Profile struct {
+	Name  string        `yaml:"name"`
+	Rules []ProfileRule `yaml:"rules"`
+}
+
+// used when no --profile is given, these match the files minify always kept before profiles existed
+var DefaultProfiles = []string{"root-links", "ld-so", "shells"}
+
+func libGlobs(reason string, names ...string) []ProfileRule {
+	var rules []ProfileRule
+	for _, name := range names {
+		rules = append(rules, ProfileRule{Path: "/**/lib*/**/" + name, Reason: reason})
+	}
+	return rules
+}
+
+func pathRules(reason string, paths ...string) []ProfileRule {
+	var rules []ProfileRule
+	for _, p := range paths {
+		rules = append(rules, ProfileRule{Path: p, Reason: reason})
+	}
+	return rules
+}
+
+func concatRules(ruless ...[]ProfileRule) []ProfileRule {
+	var result []ProfileRule
+	for _, rules := range ruless {
+		result = append(result, rules...)
+	}
+	return result
+}
+
+var Profiles = map[string]*Profile{
+	"root-links": {Rules: []ProfileRule{
+		{Path: "/*", Type: "symlink", Reason: "symlink at root, like /lib -> usr/lib on merged-usr distros"},
+		{Path: "/*", Type: "link", Reason: "hard link at root"},
+	}},
+	"ld-so": {Rules: libGlobs("dynamic linker", "ld-*.so*")},
+	"shells": {Rules: pathRules("shell commonly used by entrypoints",
+		"/**/bin/bash",
+		"/**/bin/sh",
+		"/**/bin/env",
+	)},
+	"glibc-core": {Rules: concatRules(
+		libGlobs("glibc",
+			"ld-linux*.so*",
+			"libc.so*",
+			"libc-*.so",
+			"libm.so*",
+			"libm-*.so",
+			"libdl.so*",
+			"libdl-*.so",
+			"libpthread.so*",
+			"libpthread-*.so",
+			"librt.so*",
+			"librt-*.so",
+			"libresolv.so*",
+			"libresolv-*.so",
+			"libutil.so*",
+			"libutil-*.so",
+		),
+		pathRules("glibc dynamic linker config",
+			"/etc/ld.so.cache",
+			"/etc/ld.so.conf",
+			"/etc/ld.so.conf.d/**",
+		),
+	)},
+	"musl-core": {Rules: concatRules(
+		pathRules("musl",
+			"/lib/ld-musl-*.so*",
+			"/lib/libc.musl-*.so*",
+			"/usr/lib/libc.musl-*.so*",
+		),
+		pathRules("musl dynamic linker config",
+			"/etc/ld-musl-*.path",
+		),
+	)},
+	"ca-certificates": {Rules: pathRules("tls trust store",
+		"/etc/ssl/**",
+		"/etc/pki/**",
+		"/etc/ca-certificates/**",
+		"/etc/ca-certificates.conf",
+		"/usr/share/ca-certificates/**",
+		"/usr/local/share/ca-certificates/**",
+		"/usr/lib/ssl/**",
+	)},
+	"nss": {Rules: concatRules(
+		pathRules("name service switch",
+			"/etc/nsswitch.conf",
+			"/etc/passwd",
+			"/etc/group",
+			"/etc/hosts",
+			"/etc/host.conf",
+			"/etc/resolv.conf",
+			"/etc/gai.conf",
+			"/etc/services",
+			"/etc/protocols",
+		),
+		libGlobs("name service switch modules", "libnss_*.so*"),
+	)},
+	"python": {Rules: concatRules(
+		pathRules("python runtime",
+			"/usr/bin/python3*",
+			"/usr/local/bin/python3*",
+			"/usr/lib/python3*/**",
+			"/usr/lib64/python3*/**",
+			"/usr/local/lib/python3*/**",
+		),
+		libGlobs("python runtime", "libpython3*.so*"),
+	)},
+	"node": {Rules: concatRules(
+		pathRules("node runtime",
+			"/usr/bin/node",
+			"/usr/bin/nodejs",
+			"/usr/local/bin/node",
+			"/usr/share/nodejs/**",
+		),
+		libGlobs("node runtime", "libnode.so*"),
+	)},
+	"jvm": {Rules: pathRules("jvm runtime",
+		"/usr/lib/jvm/**",
+		"/opt/java/**",
+		"/usr/local/openjdk*/**",
+		"/etc/java*/**",
+	)},
+	"tzdata": {Rules: pathRules("timezone data",
+		"/usr/share/zoneinfo/**",
+		"/etc/localtime",
+		"/etc/timezone",
+	)},
+}
+
+func init() {
+	for name, profile := range Profiles {
+		profile.Name = name
+	}
+}
+
+func ProfileNames() []string {
+	var names []string
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadProfile returns a built-in profile, a yaml profile from a path, or a yaml profile named DataDir()/profiles/<name>.yaml
+func LoadProfile(name string) (*Profile, error) {
+	profile, ok := Profiles[name]
+	if ok {
+		return profile, nil
+	}
+	file := name
+	if !strings.HasSuffix(name, ".yaml") && !strings.HasSuffix(name, ".yml") {
+		dataDir, err := DataDir()
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		file = path.Join(dataDir, "profiles", name+".yaml")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		err := fmt.Errorf("no such profile %s, built-in profiles are: %s: %w", name, strings.Join(ProfileNames(), ", "), err)
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	profile = &Profile{}
+	err = yaml.Unmarshal(data, profile)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	if profile.Name == "" {
+		profile.Name = strings.TrimSuffix(strings.TrimSuffix(path.Base(name), ".yaml"), ".yml")
+	}
+	for _, rule := range profile.Rules {
+		switch rule.Type {
+		case "", "file", "dir", "symlink", "link":
+		default:
+			err := fmt.Errorf("profile %s has rule %s with unknown type %s, expected one of file, dir, symlink, link", profile.Name, rule.Path, rule.Type)
+			Logger.Println("error:", err)
+			return nil, err
+		}
+	}
+	return profile, nil
+}
+
+func (r ProfileRule) Match(f *ScanFile) bool {
+	switch r.Type {
+	case "file":
+		if !f.Mode.IsRegular() || f.LinkTarget != "" {
+			return false
+		}
+	case "dir":
+		if !f.Mode.IsDir() {
+			return false
+		}
+	case "symlink":
+		if f.Mode&fs.ModeSymlink == 0 {
+			return false
+		}
+	case "link":
+		if f.Mode&fs.ModeSymlink != 0 || f.LinkTarget == "" {
+			return false
+		}
+	}
+	return KeepRule{Pattern: r.Path}.Match(f.Path)
+}
+
+// ProfilesMatch returns why a file is kept by the first matching profile rule
+func ProfilesMatch(profiles []*Profile, f *ScanFile) (string, bool) {
+	for _, profile := range profiles {
+		for _, rule := range profile.Rules {
+			if rule.Match(f) {
+				reason := "profile " + profile.Name
+				if rule.Reason != "" {
+					reason += ": " + rule.Reason
+				}
+				return reason, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestProfilesMatchDefaults(t *testing.T) {
+	var profiles []*Profile
+	for _, name := range DefaultProfiles {
+		profile, err := LoadProfile(name)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		profiles = append(profiles, profile)
+	}
+	type testCase struct {
+		file  *ScanFile
+		match bool
+	}
+	for _, c := range []testCase{
+		{&ScanFile{Path: "/lib", Mode: fs.ModeSymlink | 0777, LinkTarget: "usr/lib"}, true},
+		{&ScanFile{Path: "/init", Mode: 0755, LinkTarget: "/usr/bin/tini"}, true},
+		{&ScanFile{Path: "/etc/", Mode: fs.ModeDir | 0755}, false},
+		{&ScanFile{Path: "/init.sh", Mode: 0755}, false},
+		{&ScanFile{Path: "/lib64/ld-linux-x86-64.so.2", Mode: 0755}, true},
+		{&ScanFile{Path: "/lib/ld-musl-x86_64.so.1", Mode: 0755}, true},
+		{&ScanFile{Path: "/usr/bin/bash", Mode: 0755}, true},
+		{&ScanFile{Path: "/bin/sh", Mode: fs.ModeSymlink | 0777, LinkTarget: "dash"}, true},
+		{&ScanFile{Path: "/usr/bin/zsh", Mode: 0755}, false},
+	} {
+		_, ok := ProfilesMatch(profiles, c.file)
+		if ok != c.match {
+			t.Errorf("%s expected match=%v", c.file.Path, c.match)
+		}
+	}
+}
+
+func TestLoadProfileYaml(t *testing.T) {
+	dir, err := os.MkdirTemp("", "docker-trace-test.")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	data := `
+rules:
+  - path: /opt/app/plugins/**
+    reason: plugins are loaded by name at runtime
+  - path: /opt/app/config
+    type: dir
+`
+	err = os.WriteFile(path.Join(dir, "app.yaml"), []byte(data), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	profile, err := LoadProfile(path.Join(dir, "app.yaml"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	reason, ok := ProfilesMatch([]*Profile{profile}, &ScanFile{Path: "/opt/app/plugins/x.so"})
+	if !ok || reason != "profile app: plugins are loaded by name at runtime" {
+		t.Errorf("unexpected reason: %s", reason)
+	}
+	_, ok = ProfilesMatch([]*Profile{profile}, &ScanFile{Path: "/opt/app/config"})
+	if ok {
+		t.Error("type dir should not match a regular file")
+	}
+}
@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+const (
+	ProvenancePredicateType = "https://github.com/nathants/docker-trace/provenance/v1"
+	provenancePrefix        = "io.github.nathants.docker-trace."
+)
+
+// Version is set at build time with -ldflags "-X github.com/nathants/docker-trace/lib.Version=..."
+var Version = ""
+
+// DockerTraceVersion is the version set at build time, or the module version from go install
+func DockerTraceVersion() string {
+	if Version != "" {
+		return Version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+type ProvenanceTrace struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// ProvenanceImage links one minified image to the image it came from and the keep list that
+// produced it
+type ProvenanceImage struct {
+	Platform       string `json:"platform,omitempty"`
+	Digest         string `json:"digest,omitempty"`
+	SourceName     string `json:"source_name"`
+	SourceID       string `json:"source_id"`
+	SourceDigest   string `json:"source_digest,omitempty"`
+	KeepListSHA256 string `json:"keep_list_sha256"`
+	KeptFiles      int    `json:"kept_files"`
+	KeptBytes      int64  `json:"kept_bytes"`
+	RemovedFiles   int    `json:"removed_files"`
+	RemovedBytes   int64  `json:"removed_bytes"`
+}
+
+type ProvenancePredicate struct {
+	Version  string            `json:"version"`
+	Traces   []ProvenanceTrace `json:"traces"`
+	Profiles []string          `json:"profiles"`
+	Images   []ProvenanceImage `json:"images"`
+}
+
+type ProvenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// ProvenanceStatement is an in-toto statement about minified images
+type ProvenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []ProvenanceSubject `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     ProvenancePredicate `json:"predicate"`
+}
+
+// KeepListDigest hashes the sorted paths kept from an image
+func KeepListDigest(includePaths map[string]string) string {
+	var paths []string
+	for p := range includePaths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	hash := sha256.New()
+	for _, p := range paths {
+		_, _ = hash.Write([]byte(p + "\n"))
+	}
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil))
+}
+
+// NewProvenanceImage describes the source and keep list of an image about to be written
+func NewProvenanceImage(sourceName string, archive *Archive, files []*ScanFile, includePaths map[string]string) ProvenanceImage {
+	total := MinifyReport(files, includePaths, 0).Total
+	return ProvenanceImage{
+		SourceName:     sourceName,
+		SourceID:       fmt.Sprintf("sha256:%x", sha256.Sum256(archive.Config)),
+		SourceDigest:   archive.ManifestDigest,
+		KeepListSHA256: KeepListDigest(includePaths),
+		KeptFiles:      total.KeptFiles,
+		KeptBytes:      total.KeptBytes,
+		RemovedFiles:   total.RemovedFiles,
+		RemovedBytes:   total.RemovedBytes,
+	}
+}
+
+// Annotations are the manifest annotations stamped on a minified image, using the standard base
+// image annotations for the source
+func (img ProvenanceImage) Annotations() map[string]string {
+	annotations := map[string]string{
+		"org.opencontainers.image.base.name": img.SourceName,
+		provenancePrefix + "version":         DockerTraceVersion(),
+		provenancePrefix + "source.id":       img.SourceID,
+		provenancePrefix + "keep-list":       img.KeepListSHA256,
+		provenancePrefix + "kept-files":      fmt.Sprint(img.KeptFiles),
+		provenancePrefix + "kept-bytes":      fmt.Sprint(img.KeptBytes),
+		provenancePrefix + "removed-files":   fmt.Sprint(img.RemovedFiles),
+		provenancePrefix + "removed-bytes":   fmt.Sprint(img.RemovedBytes),
+	}
+	if img.SourceDigest != "" {
+		annotations["org.opencontainers.image.base.digest"] = img.SourceDigest
+	}
+	return annotations
+}
+
+// Labels are the annotations as KEY=VALUE config labels, which docker shows for loaded images
+func (img ProvenanceImage) Labels() []string {
+	var labels []string
+	for k, v := range img.Annotations() {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// NewProvenanceStatement builds the in-toto statement for minified images, whose digests are set,
+// published under ref
+func NewProvenanceStatement(ref string, traces []ProvenanceTrace, profiles []string, images []ProvenanceImage) ProvenanceStatement {
+	statement := ProvenanceStatement{
+		Type:          "https://in-toto.io/Statement/v1",
+		PredicateType: ProvenancePredicateType,
+		Predicate: ProvenancePredicate{
+			Version:  DockerTraceVersion(),
+			Traces:   traces,
+			Profiles: profiles,
+			Images:   images,
+		},
+	}
+	for _, img := range images {
+		statement.Subject = append(statement.Subject, ProvenanceSubject{
+			Name:   ref,
+			Digest: map[string]string{"sha256": strings.TrimPrefix(img.Digest, "sha256:")},
+		})
+	}
+	return statement
+}
+
+// Marshal formats the statement as indented json
+func (statement ProvenanceStatement) Marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestProvenanceKeepListDigest(t *testing.T) {
+	a := KeepListDigest(map[string]string{"/a": "", "/b": "", "/c": ""})
+	b := KeepListDigest(map[string]string{"/c": "", "/a": "", "/b": ""})
+	if a != b || !strings.HasPrefix(a, "sha256:") {
+		t.Fatal("keep list digest depends on order", a, b)
+	}
+	if a == KeepListDigest(map[string]string{"/a": "", "/b": ""}) {
+		t.Fatal("keep list digest ignores paths")
+	}
+}
+
+func TestProvenanceImage(t *testing.T) {
+	archive := &Archive{Config: []byte(`{"config": {}}`), ManifestDigest: "sha256:abc"}
+	files := []*ScanFile{
+		{LayerIndex: 0, Layer: "layer0", Path: "/bin/app", Size: 10},
+		{LayerIndex: 0, Layer: "layer0", Path: "/bin/unused", Size: 20},
+	}
+	img := NewProvenanceImage("app:latest", archive, files, map[string]string{"/bin/app": ""})
+	if img.KeptFiles != 1 || img.KeptBytes != 10 || img.RemovedFiles != 1 || img.RemovedBytes != 20 {
+		t.Fatal("bad totals", Pformat(img))
+	}
+	annotations := img.Annotations()
+	if annotations["org.opencontainers.image.base.name"] != "app:latest" || annotations["org.opencontainers.image.base.digest"] != "sha256:abc" {
+		t.Fatal("bad base annotations", Pformat(annotations))
+	}
+	if annotations["io.github.nathants.docker-trace.keep-list"] != img.KeepListSHA256 || annotations["io.github.nathants.docker-trace.removed-bytes"] != "20" {
+		t.Fatal("bad annotations", Pformat(annotations))
+	}
+	labels := img.Labels()
+	if len(labels) != len(annotations) || labels[0] != "io.github.nathants.docker-trace.keep-list="+img.KeepListSHA256 {
+		t.Fatal("bad labels", labels)
+	}
+	img.SourceDigest = ""
+	_, ok := img.Annotations()["org.opencontainers.image.base.digest"]
+	if ok {
+		t.Fatal("base digest annotation without a source digest")
+	}
+}
+
+func TestProvenanceDockerManifestDigest(t *testing.T) {
+	dir := t.TempDir()
+	layerTar := path.Join(dir, "layer.tar")
+	err := os.WriteFile(layerTar, testTar([]testEntry{testFile("a", "a")}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// docker 25+ saves the oci image layout along with manifest.json, which has no manifest digest
+	out := path.Join(dir, "oci")
+	desc, err := testOCIWriteImage(out, "example.com/app:min", []byte(`{"config": {}}`), []string{layerTar})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarball := path.Join(dir, "image.tar")
+	err = OCIWriteArchive(out, tarball)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := ArchiveOpen(tarball, "example.com/app:min")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = archive.Close() }()
+	if archive.ManifestDigest != "" {
+		t.Fatal("expected manifest.json to be read", archive.ManifestDigest)
+	}
+	if archive.manifestDigest() != desc.Digest {
+		t.Fatal("bad manifest digest", archive.manifestDigest(), desc.Digest)
+	}
+}
+
+func TestProvenanceStatement(t *testing.T) {
+	images := []ProvenanceImage{
+		{Platform: "linux/amd64", Digest: "sha256:aaa"},
+		{Platform: "linux/arm64", Digest: "sha256:bbb"},
+	}
+	traces := []ProvenanceTrace{{Path: "trace.txt", SHA256: "sha256:ccc"}}
+	data, err := NewProvenanceStatement("app:min", traces, []string{"python"}, images).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statement ProvenanceStatement
+	err = json.Unmarshal(data, &statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statement.Type != "https://in-toto.io/Statement/v1" || statement.PredicateType != ProvenancePredicateType {
+		t.Fatal("bad statement", string(data))
+	}
+	if len(statement.Subject) != 2 || statement.Subject[1].Name != "app:min" || statement.Subject[1].Digest["sha256"] != "bbb" {
+		t.Fatal("bad subjects", string(data))
+	}
+	if len(statement.Predicate.Images) != 2 || statement.Predicate.Traces[0].Path != "trace.txt" || statement.Predicate.Profiles[0] != "python" {
+		t.Fatal("bad predicate", string(data))
+	}
+}
@@ -0,0 +1,549 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	RefRegistry = "registry://"
+	RefOCI      = "oci:"
+
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+var registryAccept = strings.Join([]string{
+	MediaTypeOCIIndex,
+	MediaTypeOCIManifest,
+	MediaTypeDockerManifestList,
+	MediaTypeDockerManifest,
+}, ", ")
+
+// IsDockerRef is true for images that live in the docker daemon, rather than a registry or oci layout
+func IsDockerRef(name string) bool {
+	return !strings.HasPrefix(name, RefRegistry) && !strings.HasPrefix(name, RefOCI)
+}
+
+// ParseOCIRef splits oci:<dir> or oci:<dir>:<ref> into the layout directory and image ref name
+func ParseOCIRef(name string) (string, string) {
+	rest := strings.TrimPrefix(name, RefOCI)
+	i := strings.LastIndex(rest, ":")
+	if i != -1 && !strings.Contains(rest[i+1:], "/") {
+		return rest[:i], rest[i+1:]
+	}
+	return rest, ""
+}
+
+type RegistryRef struct {
+	Host       string
+	Repository string
+	Reference  string
+}
+
+// ParseRegistryRef parses registry://host/repo:tag or registry://host/repo@sha256:digest
+func ParseRegistryRef(name string) (RegistryRef, error) {
+	rest := strings.TrimPrefix(name, RefRegistry)
+	parts := strings.SplitN(rest, "/", 2)
+	if !strings.HasPrefix(name, RefRegistry) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		err := fmt.Errorf("registry reference must look like registry://host/repo:tag, got: %s", name)
+		Logger.Println("error:", err)
+		return RegistryRef{}, err
+	}
+	ref := RegistryRef{Host: parts[0], Repository: parts[1], Reference: "latest"}
+	if i := strings.Index(ref.Repository, "@"); i != -1 {
+		ref.Reference = ref.Repository[i+1:]
+		ref.Repository = ref.Repository[:i]
+	} else if i := strings.LastIndex(ref.Repository, ":"); i != -1 {
+		ref.Reference = ref.Repository[i+1:]
+		ref.Repository = ref.Repository[:i]
+	}
+	return ref, nil
+}
+
+// Name is the reference without the registry:// scheme, as used in image name annotations
+func (ref RegistryRef) Name() string {
+	if strings.HasPrefix(ref.Reference, "sha256:") {
+		return ref.Host + "/" + ref.Repository + "@" + ref.Reference
+	}
+	return ref.Host + "/" + ref.Repository + ":" + ref.Reference
+}
+
+// Registry is a minimal client of the oci distribution api for one repository. Plain http is used for
+// localhost, otherwise https. Credentials come from DOCKER_TRACE_REGISTRY_USER and
+// DOCKER_TRACE_REGISTRY_PASSWORD, and are exchanged for a bearer token when the registry asks for one.
+type Registry struct {
+	Ref    RegistryRef
+	client *http.Client
+	base   string
+	auth   string
+}
+
+func NewRegistry(ref RegistryRef) *Registry {
+	scheme := "https"
+	host := strings.Split(ref.Host, ":")[0]
+	if host == "localhost" || strings.HasPrefix(host, "127.") {
+		scheme = "http"
+	}
+	return &Registry{
+		Ref:    ref,
+		client: &http.Client{Timeout: 1 * time.Hour},
+		base:   scheme + "://" + ref.Host,
+	}
+}
+
+// Login checks the registry api version endpoint and answers its auth challenge for the given
+// actions on the repository, like "pull" or "pull,push"
+func (reg *Registry) Login(ctx context.Context, actions string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reg.base+"/v2/", nil)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	resp, err := reg.client.Do(req)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		err := fmt.Errorf("registry %s returned status %d", reg.base, resp.StatusCode)
+		Logger.Println("error:", err)
+		return err
+	}
+	user := os.Getenv("DOCKER_TRACE_REGISTRY_USER")
+	password := os.Getenv("DOCKER_TRACE_REGISTRY_PASSWORD")
+	scheme, params := registryChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch strings.ToLower(scheme) {
+	case "basic":
+		req.SetBasicAuth(user, password)
+		reg.auth = req.Header.Get("Authorization")
+		return nil
+	case "bearer":
+		u, err := url.Parse(params["realm"])
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		query := u.Query()
+		if params["service"] != "" {
+			query.Set("service", params["service"])
+		}
+		query.Set("scope", "repository:"+reg.Ref.Repository+":"+actions)
+		u.RawQuery = query.Encode()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := reg.client.Do(req)
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if resp.StatusCode != http.StatusOK {
+			err := fmt.Errorf("registry token endpoint %s returned status %d", u.Host, resp.StatusCode)
+			Logger.Println("error:", err)
+			return err
+		}
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&token)
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		reg.auth = "Bearer " + token.Token
+		return nil
+	default:
+		err := fmt.Errorf("registry %s asked for unsupported auth: %s", reg.base, scheme)
+		Logger.Println("error:", err)
+		return err
+	}
+}
+
+// registryChallenge parses a WWW-Authenticate header like: Bearer realm="...",service="..."
+func registryChallenge(header string) (string, map[string]string) {
+	params := make(map[string]string)
+	scheme, rest, _ := strings.Cut(header, " ")
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return scheme, params
+}
+
+func (reg *Registry) do(ctx context.Context, method string, target string, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(reg.base)
+	if err != nil {
+		return nil, err
+	}
+	u, err = u.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if reg.auth != "" {
+		req.Header.Set("Authorization", reg.auth)
+	}
+	return reg.client.Do(req)
+}
+
+// expect drains and closes a response, returning an error unless it has one of the wanted statuses
+func (reg *Registry) expect(resp *http.Response, statuses ...int) error {
+	defer func() { _ = resp.Body.Close() }()
+	for _, status := range statuses {
+		if resp.StatusCode == status {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			return nil
+		}
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("registry %s %s returned status %d: %s", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, strings.TrimSpace(string(data)))
+}
+
+// Manifest fetches a manifest or index by tag or digest, returning its media type and content
+func (reg *Registry) Manifest(ctx context.Context, reference string) (string, []byte, error) {
+	resp, err := reg.do(ctx, http.MethodGet, "/v2/"+reg.Ref.Repository+"/manifests/"+reference, http.Header{"Accept": {registryAccept}}, nil, 0)
+	if err != nil {
+		Logger.Println("error:", err)
+		return "", nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := reg.expect(resp, http.StatusOK)
+		Logger.Println("error:", err)
+		return "", nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		Logger.Println("error:", err)
+		return "", nil, err
+	}
+	mediaType := strings.Split(resp.Header.Get("Content-Type"), ";")[0]
+	var manifest struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(data, &manifest) == nil && manifest.MediaType != "" {
+		mediaType = manifest.MediaType
+	}
+	return mediaType, data, nil
+}
+
+// Blob fetches a blob by digest. The caller closes the reader.
+func (reg *Registry) Blob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	resp, err := reg.do(ctx, http.MethodGet, "/v2/"+reg.Ref.Repository+"/blobs/"+digest, nil, nil, 0)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := reg.expect(resp, http.StatusOK)
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// PushBlob uploads a blob unless the repository already has it
+func (reg *Registry) PushBlob(ctx context.Context, desc OCIDescriptor, r io.Reader) error {
+	resp, err := reg.do(ctx, http.MethodHead, "/v2/"+reg.Ref.Repository+"/blobs/"+desc.Digest, nil, nil, 0)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	resp, err = reg.do(ctx, http.MethodPost, "/v2/"+reg.Ref.Repository+"/blobs/uploads/", nil, nil, 0)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	location := resp.Header.Get("Location")
+	err = reg.expect(resp, http.StatusAccepted)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	query := u.Query()
+	query.Set("digest", desc.Digest)
+	u.RawQuery = query.Encode()
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err = reg.do(ctx, http.MethodPut, u.String(), header, r, desc.Size)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	err = reg.expect(resp, http.StatusCreated)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	return nil
+}
+
+// PushManifest uploads a manifest under a tag or digest
+func (reg *Registry) PushManifest(ctx context.Context, reference string, mediaType string, data []byte) error {
+	header := http.Header{"Content-Type": {mediaType}}
+	resp, err := reg.do(ctx, http.MethodPut, "/v2/"+reg.Ref.Repository+"/manifests/"+reference, header, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	err = reg.expect(resp, http.StatusCreated)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	return nil
+}
+
+// RegistryPull writes an oci image layout tarball of a registry image to file, choosing the platform
+// from multi platform indexes, defaulting to the platform of this machine
+func RegistryPull(ctx context.Context, name string, file string, platform string) error {
+	ref, err := ParseRegistryRef(name)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	reg := NewRegistry(ref)
+	err = reg.Login(ctx, "pull")
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	mediaType, data, err := reg.Manifest(ctx, ref.Reference)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	if mediaType == MediaTypeOCIIndex || mediaType == MediaTypeDockerManifestList {
+		var index OCIIndex
+		err = json.Unmarshal(data, &index)
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		desc, err := ociFindPlatform(index.Manifests, platform)
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		mediaType, data, err = reg.Manifest(ctx, desc.Digest)
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+	}
+	var manifest OCIManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	//
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	tw := tar.NewWriter(f)
+	writeFile := func(name string, data []byte) error {
+		err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(data))})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	}
+	desc := OCIDescriptor{
+		MediaType:   mediaType,
+		Digest:      fmt.Sprintf("sha256:%x", sha256.Sum256(data)),
+		Size:        int64(len(data)),
+		Annotations: map[string]string{"io.containerd.image.name": ref.Name()},
+	}
+	index, err := json.Marshal(OCIIndex{SchemaVersion: 2, MediaType: MediaTypeOCIIndex, Manifests: []OCIDescriptor{desc}})
+	if err == nil {
+		err = writeFile("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`))
+	}
+	if err == nil {
+		err = writeFile("index.json", index)
+	}
+	if err == nil {
+		err = writeFile(OCIBlobPath("", desc.Digest), data)
+	}
+	for _, blob := range append([]OCIDescriptor{manifest.Config}, manifest.Layers...) {
+		if err != nil {
+			break
+		}
+		err = reg.pullBlob(ctx, tw, blob)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		_ = f.Close()
+		Logger.Println("error:", err)
+		return err
+	}
+	return f.Close()
+}
+
+// pullBlob streams a blob into a tarball, checking its size and digest
+func (reg *Registry) pullBlob(ctx context.Context, tw *tar.Writer, desc OCIDescriptor) error {
+	r, err := reg.Blob(ctx, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = r.Close() }()
+	err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: OCIBlobPath("", desc.Digest), Mode: 0644, Size: desc.Size})
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tw, hash), io.LimitReader(r, desc.Size))
+	if err != nil {
+		return err
+	}
+	digest := fmt.Sprintf("sha256:%x", hash.Sum(nil))
+	if n != desc.Size || digest != desc.Digest {
+		return fmt.Errorf("blob from registry does not match its descriptor: %s", desc.Digest)
+	}
+	return nil
+}
+
+// RegistryPush uploads the only image of an oci image layout directory to a registry reference. a
+// multi platform index is pushed after the manifests of each of its platforms.
+func RegistryPush(ctx context.Context, dir string, name string) error {
+	ref, err := ParseRegistryRef(name)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	data, err := os.ReadFile(path.Join(dir, "index.json"))
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	var index OCIIndex
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	if len(index.Manifests) != 1 {
+		err := fmt.Errorf("expected one image in oci layout %s, found %d", dir, len(index.Manifests))
+		Logger.Println("error:", err)
+		return err
+	}
+	desc := index.Manifests[0]
+	reg := NewRegistry(ref)
+	err = reg.Login(ctx, "pull,push")
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	if desc.MediaType == MediaTypeOCIIndex {
+		data, err := os.ReadFile(OCIBlobPath(dir, desc.Digest))
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		var platforms OCIIndex
+		err = json.Unmarshal(data, &platforms)
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		for _, manifest := range platforms.Manifests {
+			err := reg.pushImage(ctx, dir, manifest, manifest.Digest)
+			if err != nil {
+				Logger.Println("error:", err)
+				return err
+			}
+		}
+		err = reg.PushManifest(ctx, ref.Reference, desc.MediaType, data)
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		return nil
+	}
+	err = reg.pushImage(ctx, dir, desc, ref.Reference)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	return nil
+}
+
+// pushImage uploads the blobs of an image manifest from an oci image layout, then the manifest under
+// a tag or digest
+func (reg *Registry) pushImage(ctx context.Context, dir string, desc OCIDescriptor, reference string) error {
+	data, err := os.ReadFile(OCIBlobPath(dir, desc.Digest))
+	if err != nil {
+		return err
+	}
+	var manifest OCIManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return err
+	}
+	for _, blob := range append(manifest.Layers, manifest.Config) {
+		f, err := os.Open(OCIBlobPath(dir, blob.Digest))
+		if err != nil {
+			return err
+		}
+		err = reg.PushBlob(ctx, blob, f)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return reg.PushManifest(ctx, reference, desc.MediaType, data)
+}
@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestParseRegistryRef(t *testing.T) {
+	for name, expected := range map[string]RegistryRef{
+		"registry://localhost:5000/app":                 {Host: "localhost:5000", Repository: "app", Reference: "latest"},
+		"registry://ghcr.io/org/app:v1":                 {Host: "ghcr.io", Repository: "org/app", Reference: "v1"},
+		"registry://ghcr.io/org/app@sha256:abc":         {Host: "ghcr.io", Repository: "org/app", Reference: "sha256:abc"},
+		"registry://localhost:5000/deep/org/app:latest": {Host: "localhost:5000", Repository: "deep/org/app", Reference: "latest"},
+	} {
+		ref, err := ParseRegistryRef(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ref, expected) {
+			t.Fatal("bad ref", name, ref)
+		}
+	}
+	for _, name := range []string{"localhost:5000/app", "registry://app", "registry:///app"} {
+		_, err := ParseRegistryRef(name)
+		if err == nil {
+			t.Fatal("expected error", name)
+		}
+	}
+	for name, expected := range map[string][2]string{
+		"oci:/tmp/out":    {"/tmp/out", ""},
+		"oci:/tmp/out:v1": {"/tmp/out", "v1"},
+		"oci:a:b/c":       {"a:b/c", ""},
+	} {
+		dir, ref := ParseOCIRef(name)
+		if dir != expected[0] || ref != expected[1] {
+			t.Fatal("bad oci ref", name, dir, ref)
+		}
+	}
+}
+
+func TestRegistryPushPull(t *testing.T) {
+	reg, host := newTestRegistry(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	layer := testTar([]testEntry{testDir("app/"), testFile("app/main", "binary")})
+	layerTar := path.Join(dir, "layer.tar")
+	err := os.WriteFile(layerTar, layer, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := path.Join(dir, "oci")
+	name := "registry://" + host + "/org/app:min"
+	_, err = testOCIWriteImage(out, host+"/org/app:min", []byte(`{"os": "linux", "config": {"Env": ["A=1"]}}`), []string{layerTar})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RegistryPush(ctx, out, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.uploads != 2 {
+		t.Fatal("expected config and layer uploads", reg.uploads)
+	}
+	// blobs already in the registry are not uploaded again
+	err = RegistryPush(ctx, out, "registry://"+host+"/org/app:again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.uploads != 2 {
+		t.Fatal("expected no uploads", reg.uploads)
+	}
+	//
+	tarball := path.Join(dir, "pulled.tar")
+	archive, err := ImageOpen(ctx, name, tarball, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = archive.Close() }()
+	var config DockerfileConfig
+	err = json.Unmarshal(archive.Config, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Config.Env, []string{"A=1"}) {
+		t.Fatal("bad config", string(archive.Config))
+	}
+	files, _, err := ScanArchive(archive, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[1].Path != "/app/main" || files[1].Size != 6 {
+		t.Fatal("bad files", Pformat(files))
+	}
+	//
+	_, err = ImageOpen(ctx, "registry://"+host+"/org/missing:latest", path.Join(dir, "missing.tar"), "")
+	if err == nil {
+		t.Fatal("expected missing image to fail")
+	}
+}
+
+func TestRegistryPullIndex(t *testing.T) {
+	reg, host := newTestRegistry(t)
+	ctx := context.Background()
+	blob := func(data []byte, mediaType string) OCIDescriptor {
+		digest := sha256Digest(data)
+		reg.blobs[digest] = data
+		return OCIDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(data))}
+	}
+	manifest := func(config string, layer []byte, arch string) OCIDescriptor {
+		data, err := json.Marshal(OCIManifest{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeOCIManifest,
+			Config:        blob([]byte(config), MediaTypeOCIConfig),
+			Layers:        []OCIDescriptor{blob(layer, MediaTypeOCILayer)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := OCIDescriptor{MediaType: MediaTypeOCIManifest, Digest: sha256Digest(data), Size: int64(len(data))}
+		desc.Platform = &OCIPlatform{OS: "linux", Architecture: arch}
+		reg.manifests["app/"+desc.Digest] = data
+		reg.types["app/"+desc.Digest] = MediaTypeOCIManifest
+		return desc
+	}
+	other := manifest(`{"other": true}`, testTar([]testEntry{testFile("other", "x")}), "other")
+	native := manifest(`{"native": true}`, testTar([]testEntry{testFile("native", "x")}), runtime.GOARCH)
+	data, err := json.Marshal(OCIIndex{SchemaVersion: 2, MediaType: MediaTypeOCIIndex, Manifests: []OCIDescriptor{other, native}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.manifests["app/latest"] = data
+	reg.types["app/latest"] = MediaTypeOCIIndex
+	//
+	archive, err := ImageOpen(ctx, "registry://"+host+"/app", path.Join(t.TempDir(), "pulled.tar"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = archive.Close() }()
+	if string(archive.Config) != `{"native": true}` {
+		t.Fatal("bad platform", string(archive.Config))
+	}
+}
+
+func TestImageOpenOCIDir(t *testing.T) {
+	dir := t.TempDir()
+	layer := testTar([]testEntry{testFile("a", "a")})
+	layerTar := path.Join(dir, "layer.tar")
+	err := os.WriteFile(layerTar, layer, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := path.Join(dir, "oci")
+	_, err = testOCIWriteImage(out, "example.com/app:min", []byte(`{"config": {}}`), []string{layerTar})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"oci:" + out, "oci:" + out + ":min"} {
+		archive, err := ImageOpen(context.Background(), name, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, _, err := ScanArchive(archive, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || files[0].Path != "/a" {
+			t.Fatal("bad files", Pformat(files))
+		}
+		_ = archive.Close()
+	}
+}
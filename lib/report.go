@@ -0,0 +1,193 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+type ReportGroup struct {
+	Name         string `json:"name"`
+	KeptFiles    int    `json:"kept_files"`
+	KeptBytes    int64  `json:"kept_bytes"`
+	RemovedFiles int    `json:"removed_files"`
+	RemovedBytes int64  `json:"removed_bytes"`
+}
+
+type ReportFile struct {
+	Path   string `json:"path"`
+	Layer  int    `json:"layer"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type Report struct {
+	Total          ReportGroup     `json:"total"`
+	Layers         []ReportGroup   `json:"layers"`
+	Dirs           []ReportGroup   `json:"dirs"`
+	Rules          map[string]int  `json:"rules"`
+	LargestRemoved []ReportFile    `json:"largest_removed"`
+	MissingPaths   []string        `json:"missing_paths"`
+	Packages       []PackageStatus `json:"packages"`
+	Kept           []ReportFile    `json:"kept"`
+	// Platform is set when minifying chosen platforms
+	Platform *PlatformDiff `json:"platform,omitempty"`
+}
+
+// ReportRule reduces the reason a path was kept to the rule that kept it, dropping per file detail
+func ReportRule(reason string) string {
+	switch {
+	case strings.HasPrefix(reason, "profile "):
+		return strings.SplitN(reason, ":", 2)[0]
+	case strings.HasPrefix(reason, "elf "):
+		return "elf"
+	case strings.HasPrefix(reason, "script "):
+		return "script"
+	case strings.HasPrefix(reason, "iterate "):
+		return "iterate"
+	default:
+		return reason
+	}
+}
+
+func reportAdd(group *ReportGroup, f *ScanFile, kept bool) {
+	if kept {
+		group.KeptFiles++
+		group.KeptBytes += f.Size
+	} else {
+		group.RemovedFiles++
+		group.RemovedBytes += f.Size
+	}
+}
+
+// MinifyReport describes what minify keeps and removes from the final filesystem of an image, given the
+// kept paths and their reasons
+func MinifyReport(files []*ScanFile, includePaths map[string]string, top int) *Report {
+	report := &Report{
+		Total: ReportGroup{Name: "total"},
+		Rules: make(map[string]int),
+	}
+	layers := make(map[int]*ReportGroup)
+	dirs := make(map[string]*ReportGroup)
+	var removed []ReportFile
+	for _, f := range files {
+		p := CleanPath(f.Path)
+		reason, kept := includePaths[p]
+		layer, ok := layers[f.LayerIndex]
+		if !ok {
+			layer = &ReportGroup{Name: fmt.Sprint(f.LayerIndex)}
+			layers[f.LayerIndex] = layer
+		}
+		dirName := "/"
+		parts := splitPath(p)
+		if len(parts) > 1 {
+			dirName = "/" + parts[0]
+		}
+		dir, ok := dirs[dirName]
+		if !ok {
+			dir = &ReportGroup{Name: dirName}
+			dirs[dirName] = dir
+		}
+		reportAdd(&report.Total, f, kept)
+		reportAdd(layer, f, kept)
+		reportAdd(dir, f, kept)
+		file := ReportFile{Path: p, Layer: f.LayerIndex, Size: f.Size, Reason: reason}
+		if kept {
+			report.Rules[ReportRule(reason)]++
+			report.Kept = append(report.Kept, file)
+		} else {
+			removed = append(removed, file)
+		}
+	}
+	for _, layer := range layers {
+		report.Layers = append(report.Layers, *layer)
+	}
+	sort.Slice(report.Layers, func(i, j int) bool { return Atoi(report.Layers[i].Name) < Atoi(report.Layers[j].Name) })
+	for _, dir := range dirs {
+		report.Dirs = append(report.Dirs, *dir)
+	}
+	sort.Slice(report.Dirs, func(i, j int) bool { return report.Dirs[i].Name < report.Dirs[j].Name })
+	sort.SliceStable(removed, func(i, j int) bool { return removed[i].Size > removed[j].Size })
+	if len(removed) > top {
+		removed = removed[:top]
+	}
+	report.LargestRemoved = removed
+	//
+	report.MissingPaths = MissingPaths(NewFilesystem(files), includePaths)
+	return report
+}
+
+// MissingPaths are the traced paths which do not exist in the image. they were probably created at
+// runtime, or the trace came from another image or platform.
+func MissingPaths(filesystem *Filesystem, includePaths map[string]string) []string {
+	var result []string
+	for p, reason := range includePaths {
+		if reason != "trace" && !strings.HasPrefix(reason, "rule ") {
+			continue
+		}
+		_, _, ok := filesystem.Resolve(p)
+		if !ok {
+			result = append(result, p)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Write prints the report as tab separated sections
+func (report *Report) Write(w io.Writer) {
+	groups := func(title string, groups []ReportGroup) {
+		fmt.Fprintln(w, title+"\tkept-files\tkept-bytes\tremoved-files\tremoved-bytes")
+		for _, group := range groups {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", group.Name, group.KeptFiles, group.KeptBytes, group.RemovedFiles, group.RemovedBytes)
+		}
+		fmt.Fprintln(w)
+	}
+	groups("total", []ReportGroup{report.Total})
+	groups("layer", report.Layers)
+	groups("dir", report.Dirs)
+	//
+	var rules []string
+	for rule := range report.Rules {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	fmt.Fprintln(w, "rule\tkept-files")
+	for _, rule := range rules {
+		fmt.Fprintf(w, "%s\t%d\n", rule, report.Rules[rule])
+	}
+	fmt.Fprintln(w)
+	//
+	fmt.Fprintln(w, "largest-removed\tlayer\tsize")
+	for _, f := range report.LargestRemoved {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", f.Path, f.Layer, f.Size)
+	}
+	fmt.Fprintln(w)
+	//
+	fmt.Fprintln(w, "missing-path")
+	for _, p := range report.MissingPaths {
+		fmt.Fprintln(w, p)
+	}
+	fmt.Fprintln(w)
+	//
+	// traced paths missing from the platform are the missing paths above
+	if report.Platform != nil {
+		fmt.Fprintln(w, "platform-only-path")
+		for _, p := range report.Platform.Only {
+			fmt.Fprintln(w, p)
+		}
+		fmt.Fprintln(w)
+	}
+	//
+	fmt.Fprintln(w, "package\tmanager\tversion\tstatus\tkept-files\tfiles")
+	for _, status := range report.Packages {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\n", status.Name, status.Manager, status.Version, status.Status, status.KeptFiles, status.Files)
+	}
+	fmt.Fprintln(w)
+	//
+	fmt.Fprintln(w, "kept\tlayer\tsize\treason")
+	for _, f := range report.Kept {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", f.Path, f.Layer, f.Size, f.Reason)
+	}
+}
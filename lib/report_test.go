@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"bytes"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMinifyReport(t *testing.T) {
+	files := []*ScanFile{
+		{Path: "/bin", LayerIndex: 0, Mode: fs.ModeSymlink | 0777, LinkTarget: "usr/bin"},
+		{Path: "/usr/bin/curl", LayerIndex: 0, Size: 100},
+		{Path: "/usr/lib/libc.so.6", LayerIndex: 0, Size: 1000},
+		{Path: "/usr/share/doc/big.txt", LayerIndex: 0, Size: 5000},
+		{Path: "/usr/share/doc/small.txt", LayerIndex: 0, Size: 10},
+		{Path: "/app/main", LayerIndex: 1, Size: 200},
+		{Path: "/app/test.db", LayerIndex: 1, Size: 3000},
+	}
+	includePaths := map[string]string{
+		"/bin":               "symlink",
+		"/usr/bin/curl":      "trace",
+		"/usr/lib/libc.so.6": "elf dependency of /usr/bin/curl",
+		"/app/main":          "profile shells: shell",
+		"/tmp/created.pid":   "trace",
+	}
+	report := MinifyReport(files, includePaths, 2)
+	if report.Total != (ReportGroup{Name: "total", KeptFiles: 4, KeptBytes: 1300, RemovedFiles: 3, RemovedBytes: 8010}) {
+		t.Fatal("bad total", report.Total)
+	}
+	expectedLayers := []ReportGroup{
+		{Name: "0", KeptFiles: 3, KeptBytes: 1100, RemovedFiles: 2, RemovedBytes: 5010},
+		{Name: "1", KeptFiles: 1, KeptBytes: 200, RemovedFiles: 1, RemovedBytes: 3000},
+	}
+	if !reflect.DeepEqual(report.Layers, expectedLayers) {
+		t.Fatal("bad layers", report.Layers)
+	}
+	expectedDirs := []ReportGroup{
+		{Name: "/", KeptFiles: 1},
+		{Name: "/app", KeptFiles: 1, KeptBytes: 200, RemovedFiles: 1, RemovedBytes: 3000},
+		{Name: "/usr", KeptFiles: 2, KeptBytes: 1100, RemovedFiles: 2, RemovedBytes: 5010},
+	}
+	if !reflect.DeepEqual(report.Dirs, expectedDirs) {
+		t.Fatal("bad dirs", report.Dirs)
+	}
+	expectedRules := map[string]int{"symlink": 1, "trace": 1, "elf": 1, "profile shells": 1}
+	if !reflect.DeepEqual(report.Rules, expectedRules) {
+		t.Fatal("bad rules", report.Rules)
+	}
+	if len(report.LargestRemoved) != 2 || report.LargestRemoved[0].Path != "/usr/share/doc/big.txt" || report.LargestRemoved[1].Path != "/app/test.db" {
+		t.Fatal("bad largest removed", report.LargestRemoved)
+	}
+	if !reflect.DeepEqual(report.MissingPaths, []string{"/tmp/created.pid"}) {
+		t.Fatal("bad missing paths", report.MissingPaths)
+	}
+	var buf bytes.Buffer
+	report.Write(&buf)
+	if !strings.Contains(buf.String(), "/usr/lib/libc.so.6\t0\t1000\telf dependency of /usr/bin/curl\n") {
+		t.Fatal("bad text report", buf.String())
+	}
+}
@@ -0,0 +1,410 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	rpmTagName       = 1000
+	rpmTagVersion    = 1001
+	rpmTagRelease    = 1002
+	rpmTagArch       = 1022
+	rpmTagDirIndexes = 1116
+	rpmTagBasenames  = 1117
+	rpmTagDirNames   = 1118
+	//
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+)
+
+// sqliteDB reads the rows of tables in an sqlite database file held in memory, which is enough to read
+// the rpm database without cgo or a new dependency
+type sqliteDB struct {
+	data   []byte
+	size   int
+	usable int
+}
+
+func newSqliteDB(data []byte) (*sqliteDB, error) {
+	if len(data) < 100 || string(data[:16]) != "SQLite format 3\x00" {
+		err := fmt.Errorf("not an sqlite database")
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(data[16:18]))
+	if size == 1 {
+		size = 65536
+	}
+	db := &sqliteDB{data: data, size: size, usable: size - int(data[20])}
+	if size < 512 || db.usable < 480 || data[56] > 1 {
+		err := fmt.Errorf("unsupported sqlite database, page size %d, text encoding %d", size, data[56])
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return db, nil
+}
+
+func (db *sqliteDB) page(n int) ([]byte, error) {
+	start := (n - 1) * db.size
+	if n < 1 || start+db.size > len(db.data) {
+		err := fmt.Errorf("sqlite page out of range: %d", n)
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return db.data[start : start+db.size], nil
+}
+
+func sqliteVarint(b []byte) (int64, int) {
+	var v int64
+	for i := 0; i < 9 && i < len(b); i++ {
+		if i == 8 {
+			return v<<8 | int64(b[i]), 9
+		}
+		v = v<<7 | int64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return v, len(b)
+}
+
+// rows calls fn with the record of every row in the table b-tree rooted at page root
+func (db *sqliteDB) rows(root int, fn func(record []byte) error) error {
+	return db.walk(root, 0, fn)
+}
+
+func (db *sqliteDB) walk(n int, depth int, fn func(record []byte) error) error {
+	if depth > 64 {
+		err := fmt.Errorf("sqlite b-tree too deep")
+		Logger.Println("error:", err)
+		return err
+	}
+	page, err := db.page(n)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	offset := 0
+	if n == 1 {
+		offset = 100
+	}
+	header := page[offset:]
+	cells := int(binary.BigEndian.Uint16(header[3:5]))
+	// a corrupt database must fail to read, not panic, so every pointer is checked against the page
+	bad := func(what string) error {
+		err := fmt.Errorf("bad sqlite %s on page %d", what, n)
+		Logger.Println("error:", err)
+		return err
+	}
+	switch header[0] {
+	case 0x05: // interior table page
+		if 12+2*cells > len(header) {
+			return bad("cell count")
+		}
+		for i := 0; i < cells; i++ {
+			cell := int(binary.BigEndian.Uint16(header[12+2*i:]))
+			if cell+4 > len(page) {
+				return bad("cell pointer")
+			}
+			err := db.walk(int(binary.BigEndian.Uint32(page[cell:])), depth+1, fn)
+			if err != nil {
+				Logger.Println("error:", err)
+				return err
+			}
+		}
+		return db.walk(int(binary.BigEndian.Uint32(header[8:12])), depth+1, fn)
+	case 0x0d: // leaf table page
+		if 8+2*cells > len(header) {
+			return bad("cell count")
+		}
+		for i := 0; i < cells; i++ {
+			cell := int(binary.BigEndian.Uint16(header[8+2*i:]))
+			if cell >= len(page) {
+				return bad("cell pointer")
+			}
+			record, err := db.payload(page, cell)
+			if err != nil {
+				Logger.Println("error:", err)
+				return err
+			}
+			err = fn(record)
+			if err != nil {
+				Logger.Println("error:", err)
+				return err
+			}
+		}
+		return nil
+	default:
+		err := fmt.Errorf("unsupported sqlite page type %d on page %d", header[0], n)
+		Logger.Println("error:", err)
+		return err
+	}
+}
+
+// payload reads the record of a leaf table cell, following overflow pages
+func (db *sqliteDB) payload(page []byte, cell int) ([]byte, error) {
+	bad := func(what string) ([]byte, error) {
+		err := fmt.Errorf("bad sqlite %s", what)
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	size, n := sqliteVarint(page[cell:])
+	cell += n
+	if size < 0 || size > int64(len(db.data)) || cell >= len(page) {
+		return bad("cell size")
+	}
+	_, n = sqliteVarint(page[cell:])
+	cell += n
+	u := db.usable
+	x := u - 35
+	local := int(size)
+	if local > x {
+		m := ((u-12)*32/255 - 23)
+		local = m + (int(size)-m)%(u-4)
+		if local > x {
+			local = m
+		}
+	}
+	if cell+local > len(page) {
+		return bad("cell out of range")
+	}
+	record := append([]byte{}, page[cell:cell+local]...)
+	if local == int(size) {
+		return record, nil
+	}
+	if cell+local+4 > len(page) {
+		return bad("overflow pointer")
+	}
+	next := int(binary.BigEndian.Uint32(page[cell+local:]))
+	for len(record) < int(size) {
+		overflow, err := db.page(next)
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		chunk := overflow[4:u]
+		if remaining := int(size) - len(record); len(chunk) > remaining {
+			chunk = chunk[:remaining]
+		}
+		record = append(record, chunk...)
+		next = int(binary.BigEndian.Uint32(overflow))
+	}
+	return record, nil
+}
+
+// sqliteColumns decodes a record into its columns, as int64, []byte for blobs and text, or nil
+func sqliteColumns(record []byte) ([]interface{}, error) {
+	headerSize, n := sqliteVarint(record)
+	if headerSize < 0 || int(headerSize) > len(record) {
+		err := fmt.Errorf("bad sqlite record")
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	var columns []interface{}
+	body := int(headerSize)
+	for i := n; i < int(headerSize); {
+		serial, n := sqliteVarint(record[i:])
+		i += n
+		var size int
+		switch {
+		case serial < 0:
+			err := fmt.Errorf("bad sqlite serial type %d", serial)
+			Logger.Println("error:", err)
+			return nil, err
+		case serial == 0 || serial == 8 || serial == 9:
+			size = 0
+		case serial <= 4:
+			size = int(serial)
+		case serial == 5:
+			size = 6
+		case serial == 6 || serial == 7:
+			size = 8
+		case serial >= 12:
+			size = int(serial-12) / 2
+		default:
+			err := fmt.Errorf("bad sqlite serial type %d", serial)
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		if body+size > len(record) {
+			err := fmt.Errorf("bad sqlite record")
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		value := record[body : body+size]
+		body += size
+		switch {
+		case serial == 0:
+			columns = append(columns, nil)
+		case serial == 8 || serial == 9:
+			columns = append(columns, serial-8)
+		case serial <= 6:
+			v := int64(int8(value[0]))
+			for _, b := range value[1:] {
+				v = v<<8 | int64(b)
+			}
+			columns = append(columns, v)
+		case serial == 7:
+			columns = append(columns, nil) // floats are not needed
+		default:
+			columns = append(columns, value)
+		}
+	}
+	return columns, nil
+}
+
+// table finds the root page of a table in the sqlite schema
+func (db *sqliteDB) table(name string) (int, error) {
+	root := 0
+	err := db.rows(1, func(record []byte) error {
+		columns, err := sqliteColumns(record)
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		if len(columns) < 4 {
+			return nil
+		}
+		kind, _ := columns[0].([]byte)
+		tableName, _ := columns[1].([]byte)
+		page, _ := columns[3].(int64)
+		if string(kind) == "table" && string(tableName) == name {
+			root = int(page)
+		}
+		return nil
+	})
+	if err != nil {
+		Logger.Println("error:", err)
+		return 0, err
+	}
+	if root == 0 {
+		err := fmt.Errorf("sqlite table not found: %s", name)
+		Logger.Println("error:", err)
+		return 0, err
+	}
+	return root, nil
+}
+
+// rpmHeader parses an rpm header blob as stored in the rpm database, without the lead and magic
+func rpmHeader(blob []byte) (*Package, error) {
+	if len(blob) < 8 {
+		err := fmt.Errorf("bad rpm header")
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	count := int(binary.BigEndian.Uint32(blob[0:4]))
+	size := int(binary.BigEndian.Uint32(blob[4:8]))
+	store := 8 + count*16
+	if count < 0 || size < 0 || store+size > len(blob) {
+		err := fmt.Errorf("bad rpm header")
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	data := blob[store : store+size]
+	strs := make(map[int][]string)
+	ints := make(map[int][]int)
+	for i := 0; i < count; i++ {
+		entry := blob[8+i*16:]
+		tag := int(binary.BigEndian.Uint32(entry[0:4]))
+		kind := int(binary.BigEndian.Uint32(entry[4:8]))
+		offset := int(binary.BigEndian.Uint32(entry[8:12]))
+		n := int(binary.BigEndian.Uint32(entry[12:16]))
+		if offset < 0 || offset > len(data) {
+			continue
+		}
+		switch kind {
+		case rpmTypeString, rpmTypeStringArray, rpmTypeI18NString:
+			if kind == rpmTypeString {
+				n = 1
+			}
+			rest := data[offset:]
+			for j := 0; j < n; j++ {
+				end := bytes.IndexByte(rest, 0)
+				if end < 0 {
+					break
+				}
+				strs[tag] = append(strs[tag], string(rest[:end]))
+				rest = rest[end+1:]
+			}
+		case rpmTypeInt32:
+			for j := 0; j < n && offset+4*j+4 <= len(data); j++ {
+				ints[tag] = append(ints[tag], int(binary.BigEndian.Uint32(data[offset+4*j:])))
+			}
+		}
+	}
+	first := func(tag int) string {
+		if len(strs[tag]) == 0 {
+			return ""
+		}
+		return strs[tag][0]
+	}
+	pkg := &Package{
+		Manager: "rpm",
+		Name:    first(rpmTagName),
+		Version: first(rpmTagVersion),
+		Arch:    first(rpmTagArch),
+	}
+	if release := first(rpmTagRelease); release != "" {
+		pkg.Version += "-" + release
+	}
+	dirs := strs[rpmTagDirNames]
+	for i, base := range strs[rpmTagBasenames] {
+		if i >= len(ints[rpmTagDirIndexes]) || ints[rpmTagDirIndexes][i] >= len(dirs) {
+			break
+		}
+		pkg.Files = append(pkg.Files, path.Join(dirs[ints[rpmTagDirIndexes][i]], base))
+	}
+	if pkg.Name == "" || strings.HasPrefix(pkg.Name, "gpg-pubkey") {
+		return nil, nil
+	}
+	return pkg, nil
+}
+
+// readRpm reads the packages in an rpm sqlite database
+func readRpm(data []byte) ([]*Package, error) {
+	db, err := newSqliteDB(data)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	root, err := db.table("Packages")
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	var result []*Package
+	err = db.rows(root, func(record []byte) error {
+		columns, err := sqliteColumns(record)
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		if len(columns) < 2 {
+			return nil
+		}
+		blob, ok := columns[1].([]byte)
+		if !ok {
+			return nil
+		}
+		pkg, err := rpmHeader(blob)
+		if err != nil {
+			Logger.Println("error:", err)
+			return err
+		}
+		if pkg != nil {
+			result = append(result, pkg)
+		}
+		return nil
+	})
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return result, nil
+}
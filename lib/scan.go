@@ -0,0 +1,326 @@
+package lib
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ScanFormatTable  = "table"
+	ScanFormatJSON   = "json"
+	ScanFormatNDJSON = "ndjson"
+	ScanFormatCSV    = "csv"
+	ScanFormatTree   = "tree"
+)
+
+var ScanFormats = []string{ScanFormatTable, ScanFormatJSON, ScanFormatNDJSON, ScanFormatCSV, ScanFormatTree}
+
+// ScanFields are the fields scan can print, in the order of the table columns
+var ScanFields = []string{
+	"path",
+	"layer",
+	"size",
+	"mode",
+	"link-target",
+	"sha256",
+	"content-type",
+	"mode-symbolic",
+	"mode-octal",
+	"mtime",
+	"uid",
+	"gid",
+}
+
+// ScanTableFields are the default table columns, which scan has always printed
+var ScanTableFields = []string{"path", "layer", "size", "mode", "link-target", "sha256", "content-type"}
+
+// ParseScanFields reads a comma separated field list. empty means the default fields of the format:
+// the original columns for table, only names for tree, and every field otherwise. the status field is
+// only set when scanning all layers, and is a default field then.
+func ParseScanFields(fields string, format string, allLayers bool) ([]string, error) {
+	valid := ScanFields
+	if allLayers {
+		valid = append(append([]string{}, ScanFields...), "status")
+	}
+	if fields == "" {
+		switch {
+		case format == ScanFormatTable && allLayers:
+			return append(append([]string{}, ScanTableFields...), "status"), nil
+		case format == ScanFormatTable:
+			return ScanTableFields, nil
+		case format == ScanFormatTree && allLayers:
+			return []string{"layer", "size", "status"}, nil
+		case format == ScanFormatTree:
+			return nil, nil
+		default:
+			return valid, nil
+		}
+	}
+	var result []string
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.TrimSpace(field)
+		if !Contains(valid, field) {
+			err := fmt.Errorf("unknown field %s, expected one of: %s", field, strings.Join(valid, ","))
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		result = append(result, field)
+	}
+	return result, nil
+}
+
+// ScanModeOctal formats permission, setuid, setgid and sticky bits like chmod
+func ScanModeOctal(mode fs.FileMode) string {
+	bits := mode.Perm()
+	if mode&fs.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%04o", uint32(bits))
+}
+
+// ScanModeSymbolic formats a mode like ls -l
+func ScanModeSymbolic(mode fs.FileMode) string {
+	kind := byte('-')
+	switch {
+	case mode&fs.ModeDir != 0:
+		kind = 'd'
+	case mode&fs.ModeSymlink != 0:
+		kind = 'l'
+	case mode&fs.ModeNamedPipe != 0:
+		kind = 'p'
+	case mode&fs.ModeSocket != 0:
+		kind = 's'
+	case mode&fs.ModeCharDevice != 0:
+		kind = 'c'
+	case mode&fs.ModeDevice != 0:
+		kind = 'b'
+	default:
+	}
+	buf := []byte{kind}
+	for i, c := range "rwxrwxrwx" {
+		if mode&(1<<uint(8-i)) != 0 {
+			buf = append(buf, byte(c))
+		} else {
+			buf = append(buf, '-')
+		}
+	}
+	special := func(i int, set bool, c byte) {
+		if !set {
+			return
+		}
+		if buf[i] == 'x' {
+			buf[i] = c
+		} else {
+			buf[i] = c - 'a' + 'A'
+		}
+	}
+	special(3, mode&fs.ModeSetuid != 0, 's')
+	special(6, mode&fs.ModeSetgid != 0, 's')
+	special(9, mode&fs.ModeSticky != 0, 't')
+	return string(buf)
+}
+
+// ScanFieldValue is a field of a file, as a string or a number, or nil for unknown fields which
+// ScanWrite rejects
+func ScanFieldValue(f *ScanFile, field string) interface{} {
+	switch field {
+	case "path":
+		return f.Path
+	case "layer":
+		return f.LayerIndex
+	case "size":
+		return f.Size
+	case "mode":
+		return f.Mode.String()
+	case "link-target":
+		return f.LinkTarget
+	case "sha256":
+		return f.Hash
+	case "content-type":
+		return f.ContentType
+	case "mode-symbolic":
+		return ScanModeSymbolic(f.Mode)
+	case "mode-octal":
+		return ScanModeOctal(f.Mode)
+	case "mtime":
+		if f.ModTime.IsZero() {
+			return ""
+		}
+		return f.ModTime.UTC().Format(time.RFC3339Nano)
+	case "uid":
+		return f.Uid
+	case "gid":
+		return f.Gid
+	case "status":
+		return f.Status
+	default:
+		return nil
+	}
+}
+
+// ScanWrite prints scanned files as a table with - for empty values, a json array, ndjson, csv with a
+// header row, or a tree of names with the fields of each file. json keys are field names with _
+// instead of -.
+func ScanWrite(w io.Writer, files []*ScanFile, format string, fields []string) error {
+	for _, field := range fields {
+		if !Contains(ScanFields, field) && field != "status" {
+			err := fmt.Errorf("unknown field %s, expected one of: %s", field, strings.Join(ScanFields, ","))
+			Logger.Println("error:", err)
+			return err
+		}
+	}
+	var err error
+	switch format {
+	case ScanFormatTable:
+		for _, f := range files {
+			var vals []string
+			for _, field := range fields {
+				val := fmt.Sprint(ScanFieldValue(f, field))
+				if val == "" {
+					val = "-"
+				}
+				vals = append(vals, val)
+			}
+			_, err = fmt.Fprintln(w, strings.Join(vals, "\t"))
+			if err != nil {
+				break
+			}
+		}
+	case ScanFormatJSON, ScanFormatNDJSON:
+		err = scanWriteJSON(w, files, format, fields)
+	case ScanFormatCSV:
+		cw := csv.NewWriter(w)
+		_ = cw.Write(fields)
+		for _, f := range files {
+			var vals []string
+			for _, field := range fields {
+				vals = append(vals, fmt.Sprint(ScanFieldValue(f, field)))
+			}
+			_ = cw.Write(vals)
+		}
+		cw.Flush()
+		err = cw.Error()
+	case ScanFormatTree:
+		err = scanWriteTree(w, files, fields)
+	default:
+		err = fmt.Errorf("unknown format %s, expected one of: %s", format, strings.Join(ScanFormats, ","))
+	}
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	return nil
+}
+
+// scanWriteJSON writes objects with keys in field order, which encoding/json would sort
+func scanWriteJSON(w io.Writer, files []*ScanFile, format string, fields []string) error {
+	if format == ScanFormatJSON {
+		_, err := fmt.Fprintln(w, "[")
+		if err != nil {
+			return err
+		}
+	}
+	for i, f := range files {
+		var pairs []string
+		for _, field := range fields {
+			key, err := json.Marshal(strings.ReplaceAll(field, "-", "_"))
+			if err != nil {
+				return err
+			}
+			val, err := json.Marshal(ScanFieldValue(f, field))
+			if err != nil {
+				return err
+			}
+			pairs = append(pairs, string(key)+": "+string(val))
+		}
+		line := "{" + strings.Join(pairs, ", ") + "}"
+		if format == ScanFormatJSON {
+			line = "  " + line
+			if i < len(files)-1 {
+				line += ","
+			}
+		}
+		_, err := fmt.Fprintln(w, line)
+		if err != nil {
+			return err
+		}
+	}
+	if format == ScanFormatJSON {
+		_, err := fmt.Fprintln(w, "]")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type scanTreeNode struct {
+	files    []*ScanFile
+	children map[string]*scanTreeNode
+}
+
+// scanWriteTree draws paths like the tree command, adding parent directories missing from the layers,
+// with the fields of every copy of a path when scanning all layers
+func scanWriteTree(w io.Writer, files []*ScanFile, fields []string) error {
+	root := &scanTreeNode{children: make(map[string]*scanTreeNode)}
+	for _, f := range files {
+		node := root
+		for _, part := range splitPath(CleanPath(f.Path)) {
+			child, ok := node.children[part]
+			if !ok {
+				child = &scanTreeNode{children: make(map[string]*scanTreeNode)}
+				node.children[part] = child
+			}
+			node = child
+		}
+		node.files = append(node.files, f)
+	}
+	var lines []string
+	var walk func(node *scanTreeNode, name string, prefix string, childPrefix string)
+	walk = func(node *scanTreeNode, name string, prefix string, childPrefix string) {
+		line := prefix + name
+		if len(node.files) > 0 && node.files[len(node.files)-1].LinkTarget != "" {
+			line += " -> " + node.files[len(node.files)-1].LinkTarget
+		}
+		for _, f := range node.files {
+			var vals []string
+			for _, field := range fields {
+				if field == "path" || field == "link-target" {
+					continue
+				}
+				vals = append(vals, fmt.Sprintf("%s=%v", field, ScanFieldValue(f, field)))
+			}
+			if len(vals) > 0 {
+				line += " [" + strings.Join(vals, " ") + "]"
+			}
+		}
+		lines = append(lines, line)
+		var names []string
+		for name := range node.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for i, name := range names {
+			if i == len(names)-1 {
+				walk(node.children[name], name, childPrefix+"└── ", childPrefix+"    ")
+			} else {
+				walk(node.children[name], name, childPrefix+"├── ", childPrefix+"│   ")
+			}
+		}
+	}
+	walk(root, "/", "", "")
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
@@ -0,0 +1,266 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scanPaths(t *testing.T, tarball string) map[string]int {
+	files, _, err := Scan(context.Background(), "test:latest", tarball, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]int)
+	for _, f := range files {
+		result[f.Path] = f.LayerIndex
+	}
+	return result
+}
+
+func TestScanWhiteouts(t *testing.T) {
+	tarball := writeTestImage(t,
+		[]testEntry{
+			testDir("etc/"),
+			testFile("etc/a", "a0"),
+			testFile("etc/b", "b0"),
+			testDir("opt/"),
+			testDir("opt/x/"),
+			testFile("opt/x/1", "1"),
+			testFile("opt/x/2", "2"),
+			testDir("srv/"),
+			testDir("srv/data/"),
+			testFile("srv/data/1", "1"),
+		},
+		[]testEntry{
+			testFile("etc/.wh.a", ""),
+			testDir("opt/x/"),
+			testFile("opt/x/.wh..wh..opq", ""),
+			testFile("opt/x/3", "3"),
+			testFile(".wh.srv", ""),
+		},
+		[]testEntry{
+			testFile("etc/a", "a2"),
+			testFile("srv", "now a file"),
+		},
+	)
+	expected := map[string]int{
+		"/etc/":    0,
+		"/etc/a":   2,
+		"/etc/b":   0,
+		"/opt/":    0,
+		"/opt/x/":  1,
+		"/opt/x/3": 1,
+		"/srv":     2,
+	}
+	result := scanPaths(t, tarball)
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("\n%s\n!=\n%s", Pformat(result), Pformat(expected))
+	}
+}
+
+func TestScanReplaceDirectoryWithFile(t *testing.T) {
+	tarball := writeTestImage(t,
+		[]testEntry{
+			testDir("app/"),
+			testDir("app/lib/"),
+			testFile("app/lib/x.so", "x"),
+		},
+		[]testEntry{
+			testSymlink("app/lib", "/usr/lib"),
+		},
+		[]testEntry{
+			testFile("app/.wh.lib", ""),
+			testDir("app/lib/"),
+			testFile("app/lib/y.so", "y"),
+		},
+	)
+	expected := map[string]int{
+		"/app/":         0,
+		"/app/lib/":     2,
+		"/app/lib/y.so": 2,
+	}
+	result := scanPaths(t, tarball)
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("\n%s\n!=\n%s", Pformat(result), Pformat(expected))
+	}
+}
+
+func TestScanAllLayers(t *testing.T) {
+	tarball := writeTestImage(t,
+		[]testEntry{
+			testDir("etc/"),
+			testFile("etc/a", "a0"),
+			testDir("opt/"),
+			testDir("opt/x/"),
+			testFile("opt/x/1", "1"),
+			testDir("srv/"),
+			testFile("srv/1", "1"),
+			testDir("app/"),
+			testDir("app/lib/"),
+			testFile("app/lib/x.so", "x"),
+		},
+		[]testEntry{
+			testFile("etc/a", "a1"),
+			testFile("etc/.wh.a", ""),
+			testFile("opt/x/.wh..wh..opq", ""),
+			testFile(".wh.srv", ""),
+		},
+		[]testEntry{
+			testFile("etc/a", "a2"),
+			testFile("srv", "now a file"),
+			testFile("app/lib", "lib"),
+		},
+	)
+	files, err := ScanAllLayers(context.Background(), "test:latest", tarball, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []string
+	for _, f := range files {
+		result = append(result, fmt.Sprintf("%s %d %d %s", f.Path, f.LayerIndex, f.Size, f.Status))
+	}
+	expected := []string{
+		"/app/ 0 0 kept",
+		"/app/lib/ 0 0 overwritten",
+		"/app/lib 2 3 kept",
+		"/app/lib/x.so 0 1 shadowed",
+		"/etc/ 0 0 kept",
+		"/etc/a 0 2 deleted",
+		"/etc/a 1 2 overwritten",
+		"/etc/a 1 0 whiteout",
+		"/etc/a 2 2 kept",
+		"/opt/ 0 0 kept",
+		"/opt/x/ 0 0 kept",
+		"/opt/x/ 1 0 opaque",
+		"/opt/x/1 0 1 shadowed",
+		"/srv/ 0 0 deleted",
+		"/srv 1 0 whiteout",
+		"/srv 2 10 kept",
+		"/srv/1 0 1 deleted",
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("\n%s\n!=\n%s", Pformat(result), Pformat(expected))
+	}
+	final := scanPaths(t, tarball)
+	if len(final) != 7 || final["/etc/a"] != 2 || final["/srv"] != 2 {
+		t.Fatal("bad final", final)
+	}
+}
+
+func testScanWriteFiles() []*ScanFile {
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	return []*ScanFile{
+		{Path: "/etc/hosts", Mode: 0644, Size: 9, ModTime: mtime, Hash: "abc", Uid: 0, Gid: 0},
+		{Path: "/lib", Mode: fs.ModeSymlink | 0777, LinkTarget: "usr/lib", ModTime: mtime},
+		{Path: "/usr/bin/su", LayerIndex: 1, Mode: fs.ModeSetuid | 0755, Size: 3, ModTime: mtime, Uid: 1000, Gid: 100},
+	}
+}
+
+func TestScanWriteFormats(t *testing.T) {
+	files := testScanWriteFiles()
+	fields, err := ParseScanFields("path,mode-symbolic,mode-octal,mtime,uid,link-target", ScanFormatTable, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		format   string
+		expected string
+	}{
+		{ScanFormatTable, "/etc/hosts\t-rw-r--r--\t0644\t2024-01-02T03:04:05Z\t0\t-\n" +
+			"/lib\tlrwxrwxrwx\t0777\t2024-01-02T03:04:05Z\t0\tusr/lib\n" +
+			"/usr/bin/su\t-rwsr-xr-x\t4755\t2024-01-02T03:04:05Z\t1000\t-\n"},
+		{ScanFormatCSV, "path,mode-symbolic,mode-octal,mtime,uid,link-target\n" +
+			"/etc/hosts,-rw-r--r--,0644,2024-01-02T03:04:05Z,0,\n" +
+			"/lib,lrwxrwxrwx,0777,2024-01-02T03:04:05Z,0,usr/lib\n" +
+			"/usr/bin/su,-rwsr-xr-x,4755,2024-01-02T03:04:05Z,1000,\n"},
+		{ScanFormatNDJSON, `{"path": "/etc/hosts", "mode_symbolic": "-rw-r--r--", "mode_octal": "0644", "mtime": "2024-01-02T03:04:05Z", "uid": 0, "link_target": ""}` + "\n" +
+			`{"path": "/lib", "mode_symbolic": "lrwxrwxrwx", "mode_octal": "0777", "mtime": "2024-01-02T03:04:05Z", "uid": 0, "link_target": "usr/lib"}` + "\n" +
+			`{"path": "/usr/bin/su", "mode_symbolic": "-rwsr-xr-x", "mode_octal": "4755", "mtime": "2024-01-02T03:04:05Z", "uid": 1000, "link_target": ""}` + "\n"},
+	} {
+		var buf bytes.Buffer
+		err := ScanWrite(&buf, files, test.format, fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.expected {
+			t.Fatalf("%s\n%s\n!=\n%s", test.format, buf.String(), test.expected)
+		}
+	}
+	var buf bytes.Buffer
+	err = ScanWrite(&buf, files, ScanFormatJSON, ScanFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vals []map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 3 || vals[2]["gid"] != float64(100) || vals[0]["sha256"] != "abc" || len(vals[0]) != len(ScanFields) {
+		t.Fatal("bad json", vals)
+	}
+	if ScanModeSymbolic(fs.ModeDir|fs.ModeSticky|0777) != "drwxrwxrwt" || ScanModeSymbolic(fs.ModeSetgid|0644) != "-rw-r-Sr--" {
+		t.Fatal("bad symbolic mode")
+	}
+	_, err = ParseScanFields("path,status", ScanFormatTable, false)
+	if err == nil {
+		t.Fatal("expected unknown field to fail")
+	}
+	err = ScanWrite(&buf, files, ScanFormatCSV, []string{"path", "bad"})
+	if err == nil {
+		t.Fatal("expected unknown field to fail")
+	}
+}
+
+func TestScanWriteTableDefault(t *testing.T) {
+	fields, err := ParseScanFields("", ScanFormatTable, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = ScanWrite(&buf, testScanWriteFiles(), ScanFormatTable, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "/etc/hosts\t0\t9\t-rw-r--r--\t-\tabc\t-\n" +
+		"/lib\t0\t0\tLrwxrwxrwx\tusr/lib\t-\t-\n" +
+		"/usr/bin/su\t1\t3\turwxr-xr-x\t-\t-\t-\n"
+	if buf.String() != expected {
+		t.Fatalf("\n%s\n!=\n%s", buf.String(), expected)
+	}
+	fields, err = ParseScanFields("", ScanFormatCSV, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != len(ScanFields)+1 || fields[len(fields)-1] != "status" {
+		t.Fatal("bad csv fields", fields)
+	}
+}
+
+func TestScanWriteTree(t *testing.T) {
+	var buf bytes.Buffer
+	err := ScanWrite(&buf, testScanWriteFiles(), ScanFormatTree, []string{"size"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{
+		"/",
+		"├── etc",
+		"│   └── hosts [size=9]",
+		"├── lib -> usr/lib [size=0]",
+		"└── usr",
+		"    └── bin",
+		"        └── su [size=3]",
+		"",
+	}, "\n")
+	if buf.String() != expected {
+		t.Fatalf("\n%s\n!=\n%s", buf.String(), expected)
+	}
+}
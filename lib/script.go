@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// the kernel only reads this much of a file when looking for a shebang line
+const scanHeadSize = 256
+
+// ScanShebang returns the text after #! on the first line of a script
+func ScanShebang(head []byte) string {
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return ""
+	}
+	line := bytes.SplitN(head[2:], []byte("\n"), 2)[0]
+	return strings.TrimSpace(string(line))
+}
+
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// ParseShebang splits a shebang line into its interpreter and, for env, the command env runs
+func ParseShebang(shebang string) (string, string) {
+	parts := strings.Fields(shebang)
+	if len(parts) == 0 {
+		return "", ""
+	}
+	interpreter := parts[0]
+	if path.Base(interpreter) != "env" {
+		return interpreter, ""
+	}
+	for _, part := range parts[1:] {
+		if strings.HasPrefix(part, "-") || strings.Contains(part, "=") {
+			continue
+		}
+		return interpreter, part
+	}
+	return interpreter, ""
+}
+
+// ScriptClosure adds the interpreters of every kept script to paths, resolving env commands through
+// the PATH in the image env, and returns a description of every interpreter that could not be found
+func ScriptClosure(filesystem *Filesystem, env []string, paths map[string]string) []string {
+	searchPath := defaultPath
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			searchPath = strings.TrimPrefix(kv, "PATH=")
+		}
+	}
+	var queue []string
+	for p := range paths {
+		queue = append(queue, p)
+	}
+	sort.Strings(queue)
+	var missing []string
+	done := make(map[string]bool)
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		final, _, ok := filesystem.Resolve(current)
+		if !ok || done[final] {
+			continue
+		}
+		done[final] = true
+		f := filesystem.Files[final]
+		if f.Shebang == "" {
+			continue
+		}
+		add := func(p, reason string) {
+			_, ok := paths[p]
+			if !ok {
+				paths[p] = reason
+			}
+			queue = append(queue, p)
+		}
+		interpreter, command := ParseShebang(f.Shebang)
+		_, ok = filesystem.Lookup(interpreter)
+		if !ok {
+			missing = append(missing, fmt.Sprintf("%s needs interpreter %s", current, interpreter))
+			continue
+		}
+		add(interpreter, "script interpreter of "+current)
+		if command == "" {
+			continue
+		}
+		found := false
+		for _, dir := range strings.Split(searchPath, ":") {
+			candidate := path.Join("/", dir, command)
+			if strings.Contains(command, "/") {
+				candidate = path.Join("/", command)
+			}
+			g, ok := filesystem.Lookup(candidate)
+			if ok && !g.Mode.IsDir() {
+				add(candidate, "script interpreter of "+current+" via "+interpreter)
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, fmt.Sprintf("%s needs %s %s, not found in PATH=%s", current, interpreter, command, searchPath))
+		}
+	}
+	return missing
+}
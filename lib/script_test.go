@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"io/fs"
+	"reflect"
+	"testing"
+)
+
+func TestScanShebang(t *testing.T) {
+	type testCase struct {
+		head        string
+		shebang     string
+		interpreter string
+		command     string
+	}
+	for _, c := range []testCase{
+		{"#!/bin/sh -e\necho hi\n", "/bin/sh -e", "/bin/sh", ""},
+		{"#!/usr/bin/env python3\nprint(1)\n", "/usr/bin/env python3", "/usr/bin/env", "python3"},
+		{"#! /usr/bin/env -S node --max-old-space-size=64\n", "/usr/bin/env -S node --max-old-space-size=64", "/usr/bin/env", "node"},
+		{"#!/usr/bin/env LANG=C perl\n", "/usr/bin/env LANG=C perl", "/usr/bin/env", "perl"},
+		{"\x7fELF", "", "", ""},
+	} {
+		shebang := ScanShebang([]byte(c.head))
+		interpreter, command := ParseShebang(shebang)
+		if shebang != c.shebang || interpreter != c.interpreter || command != c.command {
+			t.Errorf("%q: %q %q %q", c.head, shebang, interpreter, command)
+		}
+	}
+}
+
+func TestScriptClosure(t *testing.T) {
+	filesystem := NewFilesystem([]*ScanFile{
+		{Path: "/app/run.sh", Shebang: "/bin/sh -e"},
+		{Path: "/app/main.py", Shebang: "/usr/bin/env python3"},
+		{Path: "/app/broken.rb", Shebang: "/usr/bin/env ruby"},
+		{Path: "/bin", Mode: fs.ModeSymlink | 0777, LinkTarget: "usr/bin"},
+		{Path: "/usr/bin/sh", Mode: fs.ModeSymlink | 0777, LinkTarget: "dash"},
+		{Path: "/usr/bin/dash"},
+		{Path: "/usr/bin/env"},
+		{Path: "/usr/bin/python3"},
+		{Path: "/opt/python/bin/python3"},
+	})
+	paths := map[string]string{"/app/run.sh": "trace", "/app/main.py": "trace", "/app/broken.rb": "trace"}
+	missing := ScriptClosure(filesystem, []string{"PATH=/opt/python/bin:/usr/bin"}, paths)
+	expected := map[string]string{
+		"/app/run.sh":             "trace",
+		"/app/main.py":            "trace",
+		"/app/broken.rb":          "trace",
+		"/bin/sh":                 "script interpreter of /app/run.sh",
+		"/usr/bin/env":            "script interpreter of /app/broken.rb",
+		"/opt/python/bin/python3": "script interpreter of /app/main.py via /usr/bin/env",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("%s", Pformat(paths))
+	}
+	if !reflect.DeepEqual(missing, []string{"/app/broken.rb needs /usr/bin/env ruby, not found in PATH=/opt/python/bin:/usr/bin"}) {
+		t.Errorf("%v", missing)
+	}
+}
@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// ImageSource reads an image from docker, a registry:// reference or an oci: image layout
+type ImageSource struct {
+	Image string
+}
+
+func (source ImageSource) Name() string {
+	return source.Image
+}
+
+func (source ImageSource) Platforms(ctx context.Context) ([]string, error) {
+	return ImagePlatforms(ctx, source.Image)
+}
+
+func (source ImageSource) Open(ctx context.Context, file string, platform string) (*Archive, error) {
+	return ImageOpen(ctx, source.Image, file, platform)
+}
+
+// DockerSink streams the image layout into docker load, without writing an archive to disk
+type DockerSink struct {
+	Client *client.Client
+	Name   string
+}
+
+func (sink *DockerSink) Write(ctx context.Context, dir string) error {
+	r, w := io.Pipe()
+	go func() {
+		// defer func() {}()
+		w.CloseWithError(OCIWriteArchiveTo(dir, w))
+	}()
+	defer func() { _ = r.Close() }()
+	out, err := sink.Client.ImageLoad(ctx, r, true)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	defer func() { _ = out.Body.Close() }()
+	//
+	scanner := bufio.NewScanner(out.Body)
+	loaded := false
+	for scanner.Scan() {
+		val := make(map[string]interface{})
+		err := json.Unmarshal(scanner.Bytes(), &val)
+		if err != nil {
+			continue
+		}
+		if val["error"] != nil {
+			err := fmt.Errorf("failed to load %s: %v", sink.Name, val["error"])
+			Logger.Println("error:", err)
+			return err
+		}
+		stream, _ := val["stream"].(string)
+		Logger.Println(strings.Trim(stream, "\n"))
+		if strings.HasPrefix(stream, "Loaded image") {
+			loaded = true
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	if !loaded {
+		err := fmt.Errorf("failed to load %s", sink.Name)
+		Logger.Println("error:", err)
+		return err
+	}
+	Logger.Println("loaded minified image")
+	return nil
+}
+
+// Remove deletes the loaded image, after it failed verification
+func (sink *DockerSink) Remove(ctx context.Context) {
+	_, err := sink.Client.ImageRemove(ctx, sink.Name, types.ImageRemoveOptions{})
+	if err != nil {
+		Logger.Println("error:", err)
+		return
+	}
+	Logger.Println("removed", sink.Name, "after failed verification")
+}
+
+// RegistrySink pushes the image layout to a registry:// reference, without docker
+type RegistrySink struct {
+	Name string
+}
+
+func (sink *RegistrySink) Write(ctx context.Context, dir string) error {
+	err := RegistryPush(ctx, dir, sink.Name)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	Logger.Println("pushed minified image", sink.Name)
+	return nil
+}
+
+// OCIArchiveSink writes the image layout to a tarball, loadable with docker load
+type OCIArchiveSink struct {
+	File string
+}
+
+func (sink *OCIArchiveSink) Write(ctx context.Context, dir string) error {
+	err := OCIWriteArchive(dir, sink.File)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	Logger.Println("wrote oci archive", sink.File)
+	return nil
+}
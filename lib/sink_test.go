@@ -0,0 +1,308 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+type testKeeper map[string]string
+
+func (keeper testKeeper) Keep(ctx context.Context, image *MinifyImage) (map[string]string, error) {
+	if keeper == nil {
+		return nil, fmt.Errorf("keeper failed")
+	}
+	includePaths := make(map[string]string)
+	for p, reason := range keeper {
+		includePaths[p] = reason
+	}
+	return includePaths, nil
+}
+
+type testSink struct {
+	dirs []string
+}
+
+func (sink *testSink) Write(ctx context.Context, dir string) error {
+	sink.dirs = append(sink.dirs, dir)
+	return nil
+}
+
+func testMinifySource(t *testing.T) MinifySource {
+	return testMinifyLayers(t, []testEntry{
+		testDir("app"),
+		testFile("app/run", "run"),
+		testFile("app/data", "data"),
+		testDir("etc"),
+		testFile("etc/unused", "unused"),
+	})
+}
+
+// testMinifyLayers writes an oci image layout with one layer per slice of entries
+func testMinifyLayers(t *testing.T, layers ...[]testEntry) MinifySource {
+	dir := t.TempDir()
+	var layerTars []string
+	for i, layer := range layers {
+		layerTar := path.Join(dir, fmt.Sprintf("layer%02d.tar", i))
+		err := os.WriteFile(layerTar, testTar(layer), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layerTars = append(layerTars, layerTar)
+	}
+	out := path.Join(dir, "oci")
+	_, err := testOCIWriteImage(out, "example.com/app:latest", []byte(`{"os": "linux", "architecture": "amd64", "config": {}}`), layerTars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ImageSource{Image: "oci:" + out}
+}
+
+// testMinifyOutput reads the layers of the single image in an oci image layout, checking that each blob
+// matches its digest and each diff id in the config matches its uncompressed layer. regular files are
+// returned as path=content and everything else as the path alone, in the order written.
+func testMinifyOutput(t *testing.T, dir string) [][]string {
+	var index OCIIndex
+	readJSON(t, path.Join(dir, "index.json"), &index)
+	if len(index.Manifests) != 1 {
+		t.Fatal("bad index", index)
+	}
+	var manifest OCIManifest
+	readJSON(t, OCIBlobPath(dir, index.Manifests[0].Digest), &manifest)
+	var config struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	readJSON(t, OCIBlobPath(dir, manifest.Config.Digest), &config)
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		t.Fatal("bad diff ids", config.RootFS.DiffIDs, manifest.Layers)
+	}
+	var result [][]string
+	for i, desc := range manifest.Layers {
+		data, err := os.ReadFile(OCIBlobPath(dir, desc.Digest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sha256Digest(data) != desc.Digest || int64(len(data)) != desc.Size {
+			t.Fatal("bad blob", desc)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		layerData, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sha256Digest(layerData) != config.RootFS.DiffIDs[i] {
+			t.Fatal("bad diff id", i, config.RootFS.DiffIDs[i])
+		}
+		var entries []string
+		tr := tar.NewReader(bytes.NewReader(layerData))
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Typeflag != tar.TypeReg {
+				entries = append(entries, header.Name)
+				continue
+			}
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, header.Name+"="+string(content))
+		}
+		result = append(result, entries)
+	}
+	return result
+}
+
+func TestMinifyOCI(t *testing.T) {
+	t.Setenv("DOCKER_TRACE_DATA_DIR", t.TempDir())
+	ctx := context.Background()
+	dir := t.TempDir()
+	sink := &testSink{}
+	opts := MinifyOptions{
+		Source: testMinifySource(t),
+		Keeper: testKeeper{"/app/run": "test"},
+		Sinks:  []MinifySink{sink, &OCIArchiveSink{File: path.Join(dir, "out.tar")}},
+		Ref:    "example.com/app:min",
+		OCIDir: path.Join(dir, "oci"),
+	}
+	result, err := Minify(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Digest == "" || result.Provenance == nil || !reflect.DeepEqual(sink.dirs, []string{opts.OCIDir}) {
+		t.Fatal("bad result", result, sink.dirs)
+	}
+	if !Exists(path.Join(dir, "out.tar")) {
+		t.Fatal("expected oci archive")
+	}
+	archive, err := ImageOpen(ctx, "oci:"+opts.OCIDir, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = archive.Close() }()
+	paths := testPlatformFiles(t, archive)
+	if !reflect.DeepEqual(paths, []string{"/app/", "/app/run"}) {
+		t.Fatal("bad files", paths)
+	}
+}
+
+func TestMinifyDryRun(t *testing.T) {
+	t.Setenv("DOCKER_TRACE_DATA_DIR", t.TempDir())
+	sink := &testSink{}
+	result, err := Minify(context.Background(), MinifyOptions{
+		Source: testMinifySource(t),
+		Keeper: testKeeper{"/app/run": "test"},
+		Sinks:  []MinifySink{sink},
+		DryRun: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := result.Reports[""]
+	if report == nil || report.Total.KeptFiles != 1 || report.Total.RemovedFiles != 4 || len(sink.dirs) != 0 {
+		t.Fatal("bad report", report, sink.dirs)
+	}
+}
+
+func TestMinifyErrors(t *testing.T) {
+	t.Setenv("DOCKER_TRACE_DATA_DIR", t.TempDir())
+	ctx := context.Background()
+	_, err := Minify(ctx, MinifyOptions{
+		Source: testMinifySource(t),
+		Keeper: testKeeper(nil),
+		Sinks:  []MinifySink{&testSink{}},
+	})
+	if err == nil {
+		t.Fatal("expected keeper error to be returned")
+	}
+	out := testMultiPlatform(t, "example.com/app:latest", "amd64", "arm64")
+	_, err = Minify(ctx, MinifyOptions{
+		Source:    ImageSource{Image: "oci:" + out},
+		Keeper:    testKeeper{},
+		Sinks:     []MinifySink{&DockerSink{Name: "app:min"}},
+		Platforms: []string{"all"},
+	})
+	if err == nil {
+		t.Fatal("expected docker sink to reject a multi platform image")
+	}
+}
+
+func TestMinifyLayerModes(t *testing.T) {
+	t.Setenv("DOCKER_TRACE_DATA_DIR", t.TempDir())
+	ctx := context.Background()
+	source := testMinifyLayers(t,
+		[]testEntry{
+			testDir("app"),
+			testFile("app/a", "a0"),
+			testFile("app/shared", "shared0"),
+			testFile("app/unused", "unused"),
+		},
+		[]testEntry{
+			testFile("app/b", "b1"),
+			testFile("app/shared", "shared1"),
+		},
+		[]testEntry{
+			testFile("app/unused", "unused2"),
+		},
+		[]testEntry{
+			testFile("app/c", "c3"),
+			testFile("app/shared", "shared3"),
+		},
+	)
+	keeper := testKeeper{"/app/a": "test", "/app/b": "test", "/app/c": "test", "/app/shared": "test"}
+	for _, test := range []struct {
+		name           string
+		flatten        bool
+		preserveLayers bool
+		expected       [][]string
+	}{
+		{"concat", false, false, [][]string{{"app/", "app/a=a0", "app/b=b1", "app/c=c3", "app/shared=shared3"}}},
+		{"preserve", false, true, [][]string{{"app/", "app/a=a0"}, {"app/", "app/b=b1"}, {"app/", "app/c=c3", "app/shared=shared3"}}},
+		{"flatten", true, false, [][]string{{"app/", "app/a=a0", "app/b=b1", "app/c=c3", "app/shared=shared3"}}},
+	} {
+		dir := path.Join(t.TempDir(), "oci")
+		_, err := Minify(ctx, MinifyOptions{
+			Source:         source,
+			Keeper:         keeper,
+			Sinks:          []MinifySink{&testSink{}},
+			Ref:            "example.com/app:min",
+			OCIDir:         dir,
+			Flatten:        test.flatten,
+			PreserveLayers: test.preserveLayers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers := testMinifyOutput(t, dir)
+		if !reflect.DeepEqual(layers, test.expected) {
+			t.Fatalf("%s\n%q\n!=\n%q", test.name, layers, test.expected)
+		}
+	}
+}
+
+func TestMinifyWhiteouts(t *testing.T) {
+	t.Setenv("DOCKER_TRACE_DATA_DIR", t.TempDir())
+	source := testMinifyLayers(t,
+		[]testEntry{
+			testDir("app"),
+			testFile("app/deleted", "deleted"),
+			testDir("app/replaced"),
+			testFile("app/replaced/old", "old"),
+			testDir("app/opaque"),
+			testFile("app/opaque/old", "old"),
+		},
+		[]testEntry{
+			testFile("app/.wh.deleted", ""),
+			testFile("app/replaced", "file"),
+			testDir("app/opaque"),
+			testFile("app/opaque/.wh..wh..opq", ""),
+			testFile("app/opaque/new", "new"),
+		},
+	)
+	keeper := testKeeper{
+		"/app/deleted":      "test",
+		"/app/replaced":     "test",
+		"/app/replaced/old": "test",
+		"/app/opaque/old":   "test",
+		"/app/opaque/new":   "test",
+	}
+	for _, preserveLayers := range []bool{false, true} {
+		dir := path.Join(t.TempDir(), "oci")
+		_, err := Minify(context.Background(), MinifyOptions{
+			Source:         source,
+			Keeper:         keeper,
+			Sinks:          []MinifySink{&testSink{}},
+			Ref:            "example.com/app:min",
+			OCIDir:         dir,
+			PreserveLayers: preserveLayers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []string
+		for _, layer := range testMinifyOutput(t, dir) {
+			entries = append(entries, layer...)
+		}
+		expected := []string{"app/", "app/replaced=file", "app/opaque/", "app/opaque/new=new"}
+		if !reflect.DeepEqual(entries, expected) {
+			t.Fatalf("preserve layers %v\n%q\n!=\n%q", preserveLayers, entries, expected)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/client"
+)
+
+type TraceEvent struct {
+	Container string `json:"container,omitempty"`
+	Path      string `json:"path"`
+}
+
+type traceEventJSON struct {
+	Container   string `json:"container"`
+	ContainerID string `json:"container_id"`
+	ID          string `json:"id"`
+	Path        string `json:"path"`
+	File        string `json:"file"`
+}
+
+var traceFilesLine = regexp.MustCompile(`^([0-9a-f]{64}) (.*)$`)
+
+// ParseTrace reads raw `files` output, ndjson events or plain path lists, detecting the format per line
+func ParseTrace(r io.Reader) ([]TraceEvent, error) {
+	var events []TraceEvent
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.Trim(scanner.Text(), " \r")
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "{") {
+			var val traceEventJSON
+			err := json.Unmarshal([]byte(line), &val)
+			if err != nil {
+				Logger.Println("error:", err)
+				return nil, err
+			}
+			event := TraceEvent{Path: val.Path}
+			if event.Path == "" {
+				event.Path = val.File
+			}
+			for _, id := range []string{val.Container, val.ContainerID, val.ID} {
+				if id != "" {
+					event.Container = id
+					break
+				}
+			}
+			if event.Path != "" {
+				events = append(events, event)
+			}
+		} else if match := traceFilesLine.FindStringSubmatch(line); match != nil {
+			events = append(events, TraceEvent{Container: match[1], Path: match[2]})
+		} else {
+			events = append(events, TraceEvent{Path: line})
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return events, nil
+}
+
+// TraceFilterImage drops events from containers not started from image, events without a container are kept
+func TraceFilterImage(ctx context.Context, cli *client.Client, image string, events []TraceEvent) ([]TraceEvent, error) {
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return TraceFilterImageIDs(ctx, cli, []string{inspect.ID}, events)
+}
+
+// TraceFilterImageIDs drops events from containers not started from an image with one of these ids,
+// which docker sets to the config digest, or to the manifest digest when it stores images in
+// containerd. events without a container are kept. containers must still exist, and it is an error
+// when none of them match, since that usually means they were run with --rm.
+func TraceFilterImageIDs(ctx context.Context, cli *client.Client, ids []string, events []TraceEvent) ([]TraceEvent, error) {
+	matches := make(map[string]bool)
+	matched := 0
+	missing := 0
+	for _, event := range events {
+		if event.Container == "" {
+			continue
+		}
+		_, ok := matches[event.Container]
+		if ok {
+			continue
+		}
+		container, err := cli.ContainerInspect(ctx, event.Container)
+		if err != nil {
+			Logger.Println("skipping trace of container that could not be inspected:", event.Container, err)
+			matches[event.Container] = false
+			missing++
+			continue
+		}
+		matches[event.Container] = Contains(ids, container.Image)
+		if matches[event.Container] {
+			matched++
+		} else {
+			Logger.Println("skipping trace of container from another image:", event.Container, container.Image)
+		}
+	}
+	if len(matches) > 0 && matched == 0 {
+		err := fmt.Errorf("none of %d traced containers were started from the image, %d could not be inspected, containers run with --rm are removed when they exit and cannot be matched", len(matches), missing)
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	var result []TraceEvent
+	for _, event := range events {
+		if event.Container == "" || matches[event.Container] {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+const (
+	TracesUnion     = "union"
+	TracesIntersect = "intersect"
+	TracesDiff      = "diff"
+)
+
+// TraceRun is the events of one traced workload
+type TraceRun struct {
+	Name   string
+	Events []TraceEvent
+}
+
+// TracePath is a path in the result of combining runs, with the runs that touched it
+type TracePath struct {
+	Path string   `json:"path"`
+	Runs []string `json:"runs"`
+}
+
+// TracesCombine unions, intersects or diffs the paths of runs, where diff is the paths of the first run
+// not in any other. keep-list rules are compared as written. when filesystem is not nil, paths are
+// compared after resolving symlinks, so /lib/x and /usr/lib/x are equal on merged-usr images, and
+// every spelling of a selected path is returned so minify keeps the links too.
+func TracesCombine(op string, runs []TraceRun, filesystem *Filesystem) ([]TracePath, error) {
+	if op != TracesUnion && op != TracesIntersect && op != TracesDiff {
+		err := fmt.Errorf("unknown traces operation: %s", op)
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	type key struct {
+		paths map[string]bool
+		runs  []bool
+	}
+	keys := make(map[string]*key)
+	for i, run := range runs {
+		for _, event := range run.Events {
+			p := strings.Trim(event.Path, " ")
+			k := p
+			_, rule := ParseKeepRule(p)
+			if event.Container != "" || !rule {
+				p = filepath.Clean(p)
+				p = strings.ReplaceAll(p, "/./", "/")
+				k = p
+				if filesystem != nil {
+					k, _, _ = filesystem.Resolve(p)
+				}
+			}
+			if p == "" {
+				continue
+			}
+			val, ok := keys[k]
+			if !ok {
+				val = &key{paths: make(map[string]bool), runs: make([]bool, len(runs))}
+				keys[k] = val
+			}
+			val.paths[p] = true
+			val.runs[i] = true
+		}
+	}
+	//
+	var result []TracePath
+	for _, val := range keys {
+		var names []string
+		for i, ok := range val.runs {
+			if ok {
+				names = append(names, runs[i].Name)
+			}
+		}
+		switch op {
+		case TracesIntersect:
+			if len(names) != len(runs) {
+				continue
+			}
+		case TracesDiff:
+			if len(names) != 1 || !val.runs[0] {
+				continue
+			}
+		default:
+		}
+		for p := range val.paths {
+			result = append(result, TracePath{Path: p, Runs: names})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result, nil
+}
@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/client"
+)
+
+func TestParseTraceFormats(t *testing.T) {
+	id := strings.Repeat("ab", 32)
+	input := strings.Join([]string{
+		id + " /usr/bin/curl",
+		`{"container": "` + id + `", "path": "/etc/hosts"}`,
+		`{"Syscall": "openat", "File": "/etc/ssl/openssl.cnf"}`,
+		"/usr/lib/libcurl.so.4",
+		"",
+	}, "\n")
+	events, err := ParseTrace(strings.NewReader(input))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := []TraceEvent{
+		{Container: id, Path: "/usr/bin/curl"},
+		{Container: id, Path: "/etc/hosts"},
+		{Path: "/etc/ssl/openssl.cnf"},
+		{Path: "/usr/lib/libcurl.so.4"},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("\n%s\n!=\n%s", Pformat(events), Pformat(expected))
+		return
+	}
+}
+
+func TestTracesCombine(t *testing.T) {
+	runs := []TraceRun{
+		{Name: "a", Events: []TraceEvent{{Path: "/usr/bin/curl"}, {Path: "/lib/libc.so"}, {Path: "/etc/hosts"}, {Path: "/usr/share/zoneinfo/**"}}},
+		{Name: "b", Events: []TraceEvent{{Path: "/usr/bin/curl"}, {Container: "abc", Path: "/usr/lib/libc.so"}, {Path: "/etc/passwd"}}},
+	}
+	filesystem := testPackageFiles(map[string]string{"/usr/lib/libc.so": ""}, map[string]string{"/lib": "usr/lib"})
+	for _, test := range []struct {
+		op         string
+		filesystem *Filesystem
+		expected   []TracePath
+	}{
+		{TracesIntersect, nil, []TracePath{
+			{Path: "/usr/bin/curl", Runs: []string{"a", "b"}},
+		}},
+		{TracesIntersect, filesystem, []TracePath{
+			{Path: "/lib/libc.so", Runs: []string{"a", "b"}},
+			{Path: "/usr/bin/curl", Runs: []string{"a", "b"}},
+			{Path: "/usr/lib/libc.so", Runs: []string{"a", "b"}},
+		}},
+		{TracesDiff, filesystem, []TracePath{
+			{Path: "/etc/hosts", Runs: []string{"a"}},
+			{Path: "/usr/share/zoneinfo/**", Runs: []string{"a"}},
+		}},
+		{TracesUnion, nil, []TracePath{
+			{Path: "/etc/hosts", Runs: []string{"a"}},
+			{Path: "/etc/passwd", Runs: []string{"b"}},
+			{Path: "/lib/libc.so", Runs: []string{"a"}},
+			{Path: "/usr/bin/curl", Runs: []string{"a", "b"}},
+			{Path: "/usr/lib/libc.so", Runs: []string{"b"}},
+			{Path: "/usr/share/zoneinfo/**", Runs: []string{"a"}},
+		}},
+	} {
+		paths, err := TracesCombine(test.op, runs, test.filesystem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(paths, test.expected) {
+			t.Fatalf("%s\n%s\n!=\n%s", test.op, Pformat(paths), Pformat(test.expected))
+		}
+	}
+	_, err := TracesCombine("xor", runs, nil)
+	if err == nil {
+		t.Fatal("expected unknown operation to fail")
+	}
+}
+
+func TestTraceFilterImageIDs(t *testing.T) {
+	// a docker api where container abc is from image sha256:app, def from another image, and others are gone
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path.Base(path.Dir(r.URL.Path)) {
+		case "abc":
+			_, _ = w.Write([]byte(`{"Id": "abc", "Image": "sha256:app"}`))
+		case "def":
+			_, _ = w.Write([]byte(`{"Id": "def", "Image": "sha256:other"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"message": "no such container"}`))
+		}
+	}))
+	defer server.Close()
+	cli, err := client.NewClientWithOpts(client.WithHost("tcp://"+strings.TrimPrefix(server.URL, "http://")), client.WithVersion("1.41"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	events := []TraceEvent{{Container: "abc", Path: "/bin/sh"}, {Container: "def", Path: "/bin/ls"}, {Container: "gone", Path: "/bin/cat"}, {Path: "/etc/passwd"}}
+	result, err := TraceFilterImageIDs(ctx, cli, []string{"sha256:app"}, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, []TraceEvent{events[0], events[3]}) {
+		t.Fatal("bad events", result)
+	}
+	_, err = TraceFilterImageIDs(ctx, cli, []string{"sha256:app"}, events[1:])
+	if err == nil {
+		t.Fatal("expected an error when no traced container matches the image")
+	}
+	result, err = TraceFilterImageIDs(ctx, cli, []string{"sha256:app"}, events[3:])
+	if err != nil || len(result) != 1 {
+		t.Fatal("path lists do not need containers", result, err)
+	}
+}
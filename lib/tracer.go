@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const tracerBpftraceFilterFilename = `/strncmp("/proc/", str(args->filename), 6) != 0 && strncmp("/sys/", str(args->filename), 5) != 0 && strncmp("/dev/", str(args->filename), 5) != 0/`
+const tracerBpftraceFilterPathname = `/strncmp("/proc/", str(args->pathname), 6) != 0 && strncmp("/sys/", str(args->pathname), 5) != 0 && strncmp("/dev/", str(args->pathname), 5) != 0/`
+const tracerBpftraceFilterPath = `    /strncmp("/proc/", str(args->path),     6) != 0 && strncmp("/sys/", str(args->path),     5) != 0 && strncmp("/dev/", str(args->path),     5) != 0/`
+const tracerBpftraceFilterTID = `     /strncmp("/proc/", str(@filename[tid]), 6) != 0 && strncmp("/sys/", str(@filename[tid]), 5) != 0 && strncmp("/dev/", str(@filename[tid]), 5) != 0/`
+
+const tracerBpftrace = `#!/usr/bin/env bpftrace
+
+#include <linux/sched.h>
+
+tracepoint:cgroup:cgroup_mkdir { printf("cgroup_mkdir\t%d\t\t\t\t\t%s\n", args->id, str(args->path)); }
+
+tracepoint:syscalls:sys_enter_exec* FILTER_FILENAME { printf("exec\t%d\t%d\t%d\t%s\t0\t%s\n", cgroup, pid, curtask->real_parent->pid, comm, str(args->filename)); }
+
+tracepoint:syscalls:sys_enter_creat,
+tracepoint:syscalls:sys_enter_statfs,
+tracepoint:syscalls:sys_enter_readlinkat FILTER_PATHNAME { @filename[tid] = args->pathname; }
+
+tracepoint:syscalls:sys_enter_readlink,
+tracepoint:syscalls:sys_enter_truncate FILTER_PATH { @filename[tid] = args->path; }
+
+tracepoint:syscalls:sys_enter_utimensat,
+tracepoint:syscalls:sys_enter_chdir,
+tracepoint:syscalls:sys_enter_open,
+tracepoint:syscalls:sys_enter_futimesat,
+tracepoint:syscalls:sys_enter_access,
+tracepoint:syscalls:sys_enter_openat,
+tracepoint:syscalls:sys_enter_statx,
+tracepoint:syscalls:sys_enter_mknod,
+tracepoint:syscalls:sys_enter_mknodat,
+tracepoint:syscalls:sys_enter_faccessat,
+tracepoint:syscalls:sys_enter_utime,
+tracepoint:syscalls:sys_enter_utimes,
+tracepoint:syscalls:sys_enter_newstat,
+tracepoint:syscalls:sys_enter_newlstat FILTER_FILENAME { @filename[tid] = args->filename; }
+
+tracepoint:syscalls:sys_exit_utimensat  FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("utimensat\t%d\t%d\t%d\t%s\t%d\t%s\n",  cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_faccessat  FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("faccessat\t%d\t%d\t%d\t%s\t%d\t%s\n",  cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_chdir      FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("chdir\t%d\t%d\t%d\t%s\t%d\t%s\n",      cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_access     FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("access\t%d\t%d\t%d\t%s\t%d\t%s\n",     cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_futimesat  FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("futimesat\t%d\t%d\t%d\t%s\t%d\t%s\n",  cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_open       FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("open\t%d\t%d\t%d\t%s\t%d\t%s\n",       cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_openat     FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("openat\t%d\t%d\t%d\t%s\t%d\t%s\n",     cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_readlink   FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("readlink\t%d\t%d\t%d\t%s\t%d\t%s\n",   cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_truncate   FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("truncate\t%d\t%d\t%d\t%s\t%d\t%s\n",   cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_readlinkat FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("readlinkat\t%d\t%d\t%d\t%s\t%d\t%s\n", cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_statfs     FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("statfs\t%d\t%d\t%d\t%s\t%d\t%s\n",     cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_creat      FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("creat\t%d\t%d\t%d\t%s\t%d\t%s\n",      cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_statx      FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("statx\t%d\t%d\t%d\t%s\t%d\t%s\n",      cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_newstat    FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("newstat\t%d\t%d\t%d\t%s\t%d\t%s\n",    cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_mknod      FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("mknod\t%d\t%d\t%d\t%s\t%d\t%s\n",      cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_mknodat    FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("mknodat\t%d\t%d\t%d\t%s\t%d\t%s\n",    cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_utimes     FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("utimes\t%d\t%d\t%d\t%s\t%d\t%s\n",     cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+tracepoint:syscalls:sys_exit_newlstat   FILTER_TID { $ret = args->ret; $errno = $ret >= 0 ? 0 : - $ret; printf("newlstat\t%d\t%d\t%d\t%s\t%d\t%s\n",   cgroup, pid, curtask->real_parent->pid, comm, $errno, str(@filename[tid])); delete(@filename[tid]); }
+
+END { clear(@filename); }
+
+`
+
+func tracerUpdateFilters() string {
+	filters := tracerBpftrace
+	filters = strings.ReplaceAll(filters, "FILTER_PATHNAME", tracerBpftraceFilterPathname)
+	filters = strings.ReplaceAll(filters, "FILTER_FILENAME", tracerBpftraceFilterFilename)
+	filters = strings.ReplaceAll(filters, "FILTER_PATH", tracerBpftraceFilterPath)
+	filters = strings.ReplaceAll(filters, "FILTER_TID", tracerBpftraceFilterTID)
+	return filters
+}
+
+type Tracer struct {
+	ctx    context.Context
+	ws     *Workspace
+	cancel func()
+	buf    *bufio.Reader
+	done   chan error
+}
+
+// TracerCheck returns an error when the host cannot run the tracer
+func TracerCheck() error {
+	if exec.Command("bash", "-c", "mount | grep cgroup2").Run() != nil {
+		err := fmt.Errorf("cgroups v2 are required, see https://wiki.archlinux.org/index.php/cgroups#Switching_to_cgroups_v2")
+		Logger.Println("error:", err)
+		return err
+	}
+	return nil
+}
+
+// TracerStart starts bpftrace and returns once its probes are attached, so containers started after
+// this call are traced
+func TracerStart(ctx context.Context, rbPages int) (*Tracer, error) {
+	ws, err := NewWorkspace("trace")
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	//
+	// filter out events from cgroups created before this process started and from filepaths in /proc/, /sys/, /dev/
+	err = os.WriteFile(ws.Dir+"/files.bt", []byte(tracerUpdateFilters()), 0666)
+	if err != nil {
+		_ = ws.Remove()
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	//
+	ctx, cancel := context.WithCancel(ctx)
+	tracer := &Tracer{
+		ctx:    ctx,
+		ws:     ws,
+		cancel: cancel,
+		done:   make(chan error, 1),
+	}
+	env := "BPFTRACE_STRLEN=200 BPFTRACE_MAP_KEYS_MAX=8192 BPFTRACE_PERF_RB_PAGES=" + fmt.Sprint(rbPages)
+	cmd := exec.CommandContext(ctx, "/usr/bin/sudo", "bash", "-c", env+" bpftrace "+ws.Dir+"/files.bt")
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		tracer.Close()
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		tracer.Close()
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	go func() {
+		// defer func() {}()
+		tracer.done <- cmd.Wait()
+	}()
+	//
+	tracer.buf = bufio.NewReader(stdout)
+	line, err := tracer.buf.ReadBytes('\n')
+	if err != nil {
+		tracer.Close()
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	if !(strings.HasPrefix(string(line), "Attaching ") && strings.HasSuffix(string(line), " probes...\n")) {
+		tracer.Close()
+		err := fmt.Errorf("unexected startup log: %s", string(line))
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	return tracer, nil
+}
+
+// Run reads bpftrace output until the tracer is closed, calling fn with the container id and the
+// absolute path of every successful or ENOENT file access in a container
+func (tracer *Tracer) Run(fn func(container string, file File)) error {
+	cwds := make(map[string]string)
+	cgroups := make(map[string]string)
+	for {
+		line, err := tracer.buf.ReadString('\n')
+		if err != nil {
+			closed := tracer.ctx.Err() != nil
+			tracer.Close()
+			waitErr := <-tracer.done
+			if closed {
+				return nil
+			}
+			if err == io.EOF {
+				err = waitErr
+			}
+			if err != nil {
+				Logger.Println("error:", err)
+			}
+			return err
+		}
+		line = strings.TrimRight(line, "\n")
+		container, file, ok := FilesResolveLine(cwds, cgroups, line)
+		if ok {
+			fn(container, file)
+		}
+	}
+}
+
+// Close stops bpftrace and removes its temp files
+func (tracer *Tracer) Close() {
+	_ = tracer.ws.Remove()
+	tracer.cancel()
+}
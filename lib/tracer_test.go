@@ -0,0 +1,44 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestFilesResolveLine(t *testing.T) {
+	id := "425428dfb2644cfd111d406b5f8f68a7596731a451f0169caa7393f3a39db9ca"
+	cwds := make(map[string]string)
+	cgroups := make(map[string]string)
+	lines := []string{
+		"cgroup_mkdir\t7\t\t\t\t\t/sys/fs/cgroup/system.slice/docker-" + id + ".scope",
+		"openat\t99\t10\t1\tsh\t0\t/etc/passwd",
+		"chdir\t7\t10\t1\tsh\t2\t/missing",
+		"chdir\t7\t10\t1\tsh\t0\t/app",
+		"openat\t7\t10\t1\tsh\t0\tconfig.json",
+		"openat\t7\t11\t10\tpython\t2\tlib/site.py",
+		"openat\t7\t11\t10\tpython\t13\t/root/secret",
+	}
+	var results []string
+	for _, line := range lines {
+		container, file, ok := FilesResolveLine(cwds, cgroups, line)
+		if ok {
+			if container != id {
+				t.Fatal("bad container", container)
+			}
+			results = append(results, file.Errno+" "+file.File)
+		}
+	}
+	expected := []string{
+		"2 /missing",
+		"0 /app",
+		"0 /app/config.json",
+		"2 /app/lib/site.py",
+	}
+	if len(results) != len(expected) {
+		t.Fatal("bad results", results)
+	}
+	for i := range expected {
+		if results[i] != expected[i] {
+			t.Fatal("bad results", results)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+type VerifyOptions struct {
+	RunArgs []string
+	Cmd     string
+	HTTP    string
+	Timeout time.Duration
+}
+
+var verifyInterval = 1 * time.Second
+
+func verifyDocker(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("docker %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// verifyProbeOnce runs the probe a single time, returning the exit status of the command or the
+// status code of the http response
+func verifyProbeOnce(ctx context.Context, opts VerifyOptions, env []string) (int, error) {
+	if opts.HTTP != "" {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+				IdleConnTimeout:     1 * time.Second,
+				TLSHandshakeTimeout: 1 * time.Second,
+			},
+			Timeout: 1 * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, opts.HTTP, nil)
+		if err != nil {
+			return 0, err
+		}
+		out, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		_, _ = io.Copy(io.Discard, out.Body)
+		_ = out.Body.Close()
+		return out.StatusCode, nil
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", opts.Cmd)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// verifyProbe runs the probe until it returns a wanted status or the timeout passes, returning the
+// last status seen. alive is checked between attempts and stops the probe early when it fails.
+func verifyProbe(ctx context.Context, opts VerifyOptions, env []string, want func(int) bool, alive func() error) (int, error) {
+	start := time.Now()
+	status := 0
+	seen := false
+	var lastErr error
+	for {
+		s, err := verifyProbeOnce(ctx, opts, env)
+		if err == nil {
+			status = s
+			seen = true
+			if want(status) {
+				return status, nil
+			}
+		} else {
+			lastErr = err
+		}
+		if time.Since(start) > opts.Timeout {
+			break
+		}
+		if alive != nil {
+			err := alive()
+			if err != nil {
+				return status, err
+			}
+		}
+		time.Sleep(verifyInterval)
+	}
+	if !seen {
+		err := fmt.Errorf("probe never completed within %s: %v", opts.Timeout, lastErr)
+		return 0, err
+	}
+	return status, nil
+}
+
+// VerifyRun starts an image with the run args, probes it until a wanted status or the timeout, then
+// removes the container, returning its id and the last status
+func VerifyRun(ctx context.Context, image string, opts VerifyOptions, want func(int) bool) (string, int, error) {
+	args := append([]string{"run", "-d", "-t"}, opts.RunArgs...)
+	args = append(args, image)
+	id, err := verifyDocker(ctx, args...)
+	if err != nil {
+		Logger.Println("error:", err)
+		return "", 0, err
+	}
+	defer func() { _, _ = verifyDocker(context.Background(), "rm", "-f", id) }()
+	alive := func() error {
+		running, err := verifyDocker(ctx, "inspect", "-f", "{{.State.Running}}", id)
+		if err != nil {
+			return err
+		}
+		if running != "true" {
+			logs, _ := verifyDocker(ctx, "logs", "--tail", "20", id)
+			return fmt.Errorf("container for %s exited before the probe passed: %s", image, logs)
+		}
+		return nil
+	}
+	env := []string{"DOCKER_TRACE_CONTAINER=" + id, "DOCKER_TRACE_IMAGE=" + image}
+	status, err := verifyProbe(ctx, opts, env, want, alive)
+	if err != nil {
+		Logger.Println("error:", err)
+		return id, 0, err
+	}
+	return id, status, nil
+}
+
+func verifySuccess(opts VerifyOptions) func(int) bool {
+	return func(status int) bool {
+		if opts.HTTP != "" {
+			return status < 400
+		}
+		return status == 0
+	}
+}
+
+// Verify probes a baseline run of the original image, then a run of the minified image, and fails
+// when the minified image does not produce the same status
+func Verify(ctx context.Context, original, minified string, opts VerifyOptions) error {
+	if opts.Timeout == 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	success := verifySuccess(opts)
+	Logger.Println("verify baseline run of", original)
+	_, baseline, err := VerifyRun(ctx, original, opts, success)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	if !success(baseline) {
+		Logger.Println("warning: baseline probe did not succeed, comparing against status", baseline)
+	}
+	Logger.Println("verify run of", minified)
+	_, status, err := VerifyRun(ctx, minified, opts, func(status int) bool { return status == baseline })
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	if status != baseline {
+		err := fmt.Errorf("verification failed, %s returned %d but %s returned %d", original, baseline, minified, status)
+		Logger.Println("error:", err)
+		return err
+	}
+	Logger.Println("verification passed with status", status)
+	return nil
+}
@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestVerifyProbeHTTP(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, r, "/elsewhere", http.StatusMovedPermanently)
+	}))
+	defer server.Close()
+	verifyInterval = 10 * time.Millisecond
+	opts := VerifyOptions{HTTP: server.URL, Timeout: 5 * time.Second}
+	status, err := verifyProbe(context.Background(), opts, nil, func(status int) bool { return status < 400 }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusMovedPermanently || requests != 3 {
+		t.Fatal("bad probe", status, requests)
+	}
+}
+
+func TestVerifyProbeHTTPUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+	verifyInterval = 10 * time.Millisecond
+	opts := VerifyOptions{HTTP: url, Timeout: 100 * time.Millisecond}
+	_, err := verifyProbe(context.Background(), opts, nil, func(status int) bool { return true }, nil)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestVerifyProbeCmd(t *testing.T) {
+	verifyInterval = 10 * time.Millisecond
+	counter := path.Join(t.TempDir(), "counter")
+	opts := VerifyOptions{
+		Cmd:     fmt.Sprintf(`echo >> %s; test "$(wc -l < %s)" -ge 3 && test "$DOCKER_TRACE_CONTAINER" = abc`, counter, counter),
+		Timeout: 5 * time.Second,
+	}
+	env := []string{"DOCKER_TRACE_CONTAINER=abc"}
+	status, err := verifyProbe(context.Background(), opts, env, func(status int) bool { return status == 0 }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 0 {
+		t.Fatal("bad status", status)
+	}
+	opts = VerifyOptions{Cmd: "exit 7", Timeout: 50 * time.Millisecond}
+	status, err = verifyProbe(context.Background(), opts, nil, func(status int) bool { return status == 0 }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 7 {
+		t.Fatal("bad status", status)
+	}
+}
+
+func TestVerifyProbeAlive(t *testing.T) {
+	verifyInterval = 10 * time.Millisecond
+	opts := VerifyOptions{Cmd: "exit 1", Timeout: 5 * time.Second}
+	_, err := verifyProbe(context.Background(), opts, nil, func(status int) bool { return status == 0 }, func() error {
+		return fmt.Errorf("container exited")
+	})
+	if err == nil || err.Error() != "container exited" {
+		t.Fatal("expected alive error", err)
+	}
+}
@@ -0,0 +1,200 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+var exitHooks = struct {
+	sync.Mutex
+	next int
+	fns  map[int]func()
+}{fns: make(map[int]func())}
+
+// AtExit registers fn to run when the process exits through Logger.Fatal or a signal, returning a
+// func that unregisters it
+func AtExit(fn func()) func() {
+	exitHooks.Lock()
+	defer exitHooks.Unlock()
+	id := exitHooks.next
+	exitHooks.next++
+	exitHooks.fns[id] = fn
+	return func() {
+		exitHooks.Lock()
+		defer exitHooks.Unlock()
+		delete(exitHooks.fns, id)
+	}
+}
+
+// RunExitHooks runs and unregisters every exit hook, newest first
+func RunExitHooks() {
+	exitHooks.Lock()
+	var ids []int
+	for id := range exitHooks.fns {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	var fns []func()
+	for _, id := range ids {
+		fns = append(fns, exitHooks.fns[id])
+		delete(exitHooks.fns, id)
+	}
+	exitHooks.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// legacy temp files written directly into DataDir() by older versions
+var workspaceLegacyPatterns = []string{"in.tar.*", "out.tar.*", "save.tar.*", "oci.*", "Dockerfile.*"}
+
+// Workspace is a directory under DataDir()/work for the temp files of one operation. It is removed
+// by Remove, by Logger.Fatal, or on SIGINT or SIGTERM once HandleSignals was called. The pid of its
+// owner is recorded so that gc skips workspaces in use.
+type Workspace struct {
+	Dir    string
+	remove func()
+}
+
+func NewWorkspace(name string) (*Workspace, error) {
+	dataDir, err := DataDir()
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	dir := path.Join(dataDir, "work", name+"."+uuid.Must(uuid.NewV4()).String())
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	err = os.WriteFile(path.Join(dir, "pid"), []byte(fmt.Sprint(os.Getpid())), 0644)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	ws := &Workspace{Dir: dir}
+	ws.remove = AtExit(func() { _ = os.RemoveAll(dir) })
+	return ws, nil
+}
+
+// HandleSignals runs the exit hooks and exits on SIGINT or SIGTERM, so the cli removes its workspaces
+// when interrupted. code using this package as a library removes workspaces by returning, through
+// Remove in a defer, and stops long operations by canceling their context.
+func HandleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		// defer func() {}()
+		<-c
+		RunExitHooks()
+		os.Exit(1)
+	}()
+}
+
+// Remove deletes the workspace and everything in it
+func (ws *Workspace) Remove() error {
+	ws.remove()
+	err := os.RemoveAll(ws.Dir)
+	if err != nil {
+		Logger.Println("error:", err)
+		return err
+	}
+	return nil
+}
+
+type WorkspaceInfo struct {
+	Path string
+	Age  time.Duration
+	Size int64
+	Live bool
+}
+
+// Workspaces lists the workspaces in DataDir(), including temp files left by older versions, oldest
+// first
+func Workspaces() ([]WorkspaceInfo, error) {
+	dataDir, err := DataDir()
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	matches, err := filepath.Glob(path.Join(dataDir, "work", "*"))
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	for _, pattern := range workspaceLegacyPatterns {
+		legacy, err := filepath.Glob(path.Join(dataDir, pattern))
+		if err != nil {
+			Logger.Println("error:", err)
+			return nil, err
+		}
+		matches = append(matches, legacy...)
+	}
+	var result []WorkspaceInfo
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil {
+			continue
+		}
+		result = append(result, WorkspaceInfo{
+			Path: match,
+			Age:  time.Since(info.ModTime()),
+			Size: NewDiskUsage(match).Sample(),
+			Live: workspaceLive(match),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Age > result[j].Age })
+	return result, nil
+}
+
+// workspaceLive is true when the process that created a workspace is still running
+func workspaceLive(dir string) bool {
+	data, err := os.ReadFile(path.Join(dir, "pid"))
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return false
+	}
+	err = syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// WorkspacesGC removes workspaces not in use by a live process which are at least minAge old and
+// minSize bytes, returning them. With dryRun nothing is removed.
+func WorkspacesGC(minAge time.Duration, minSize int64, dryRun bool) ([]WorkspaceInfo, error) {
+	workspaces, err := Workspaces()
+	if err != nil {
+		Logger.Println("error:", err)
+		return nil, err
+	}
+	var result []WorkspaceInfo
+	for _, ws := range workspaces {
+		if ws.Live || ws.Age < minAge || ws.Size < minSize {
+			continue
+		}
+		if !dryRun {
+			err := os.RemoveAll(ws.Path)
+			if err != nil {
+				Logger.Println("error:", err)
+				return result, err
+			}
+		}
+		result = append(result, ws)
+	}
+	return result, nil
+}
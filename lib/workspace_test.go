@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestWorkspaceExitHooks(t *testing.T) {
+	t.Setenv("DOCKER_TRACE_DATA_DIR", path.Join(t.TempDir(), "data"))
+	ws, err := NewWorkspace("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Dir(ws.Dir) != path.Join(os.Getenv("DOCKER_TRACE_DATA_DIR"), "work") || !Exists(ws.Dir) {
+		t.Fatal("bad workspace", ws.Dir)
+	}
+	removed, err := NewWorkspace("removed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = removed.Remove()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	AtExit(func() { order = append(order, "first") })
+	unregister := AtExit(func() { order = append(order, "unregistered") })
+	AtExit(func() { order = append(order, "last") })
+	unregister()
+	RunExitHooks()
+	if Exists(ws.Dir) || Exists(removed.Dir) {
+		t.Fatal("workspace not removed")
+	}
+	if len(order) != 2 || order[0] != "last" || order[1] != "first" {
+		t.Fatal("bad hook order", order)
+	}
+	RunExitHooks()
+	if len(order) != 2 {
+		t.Fatal("hooks ran twice", order)
+	}
+}
+
+func TestWorkspaceDataDirError(t *testing.T) {
+	file := path.Join(t.TempDir(), "file")
+	err := os.WriteFile(file, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DOCKER_TRACE_DATA_DIR", path.Join(file, "data"))
+	_, err = DataDir()
+	if err == nil {
+		t.Fatal("expected data dir under a file to fail")
+	}
+	_, err = NewWorkspace("test")
+	if err == nil {
+		t.Fatal("expected workspace under a file to fail")
+	}
+}
+
+func TestWorkspacesGC(t *testing.T) {
+	t.Setenv("DOCKER_TRACE_DATA_DIR", t.TempDir())
+	live, err := NewWorkspace("live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = live.Remove() }()
+	dead := path.Join(os.Getenv("DOCKER_TRACE_DATA_DIR"), "work", "minify.dead")
+	err = os.MkdirAll(dead, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(dead, "in.tar"), make([]byte, 100), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := path.Join(os.Getenv("DOCKER_TRACE_DATA_DIR"), "in.tar.old")
+	err = os.WriteFile(legacy, make([]byte, 10), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recent := path.Join(os.Getenv("DOCKER_TRACE_DATA_DIR"), "save.tar.recent")
+	err = os.WriteFile(recent, make([]byte, 1000), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for _, p := range []string{live.Dir, dead, legacy} {
+		err = os.Chtimes(p, old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	//
+	workspaces, err := Workspaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(workspaces) != 4 {
+		t.Fatal("bad workspaces", Pformat(workspaces))
+	}
+	removed, err := WorkspacesGC(time.Hour, 50, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Path != dead || removed[0].Size != 100 || !Exists(dead) {
+		t.Fatal("bad dry run", Pformat(removed))
+	}
+	removed, err = WorkspacesGC(time.Hour, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 || Exists(dead) || Exists(legacy) || !Exists(recent) || !Exists(live.Dir) {
+		t.Fatal("bad gc", Pformat(removed))
+	}
+}
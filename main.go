@@ -46,5 +46,6 @@ func main() {
 		}
 	}
 	os.Args = args
+	lib.HandleSignals()
 	fn()
 }